@@ -0,0 +1,432 @@
+package pgvertica
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgproto3/v2"
+	vertigo "github.com/vertica/vertica-sql-go"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+type AuthMethod string
+
+const (
+	AuthMethodTrust       AuthMethod = "trust"
+	AuthMethodCleartext   AuthMethod = "cleartext"
+	AuthMethodMD5         AuthMethod = "md5"
+	AuthMethodScramSHA256 AuthMethod = "scram-sha-256"
+)
+
+const (
+	scramSHA256Mechanism  = "SCRAM-SHA-256"
+	scramIterations       = 4096
+	scramNonceLength      = 18
+	scramSaltLength       = 16
+	invalidPasswordCode   = "28P01"
+	invalidAuthSpecCode   = "28000"
+	protocolViolationCode = "08P01"
+)
+
+func ParseAuthMethod(method string) (AuthMethod, error) {
+	switch AuthMethod(strings.ToLower(method)) {
+	case AuthMethodTrust:
+		return AuthMethodTrust, nil
+	case AuthMethodCleartext, "password":
+		return AuthMethodCleartext, nil
+	case AuthMethodMD5:
+		return AuthMethodMD5, nil
+	case AuthMethodScramSHA256:
+		return AuthMethodScramSHA256, nil
+	default:
+		return "", fmt.Errorf("unknown auth method: %s", method)
+	}
+}
+
+// CredentialStore provides plaintext passwords of proxy users. The md5 and
+// scram-sha-256 methods never send the password over the wire, so the proxy
+// needs it to check the client's proof and to log in to Vertica.
+type CredentialStore interface {
+	Password(user string) (string, bool)
+}
+
+// StaticCredentialStore is a CredentialStore backed by a user -> password map.
+type StaticCredentialStore map[string]string
+
+func (s StaticCredentialStore) Password(user string) (string, bool) {
+	password, ok := s[user]
+	return password, ok
+}
+
+// LoadCredentialsFile reads a StaticCredentialStore from a file with one
+// "user:password" entry per line. Empty lines and lines starting with '#' are skipped.
+func LoadCredentialsFile(path string) (StaticCredentialStore, error) {
+	entries, err := readColonSeparatedFile(path, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials := make(StaticCredentialStore, len(entries))
+	for _, entry := range entries {
+		credentials[entry[0]] = entry[1]
+	}
+	return credentials, nil
+}
+
+// AuthError is returned when a client fails to authenticate. It is sent to
+// the client as an ErrorResponse with the given SQLSTATE code.
+type AuthError struct {
+	Code    string
+	Message string
+}
+
+func (e *AuthError) Error() string {
+	return e.Message
+}
+
+func (e *AuthError) errorResponse() *pgproto3.ErrorResponse {
+	return &pgproto3.ErrorResponse{Severity: "FATAL", Code: e.Code, Message: e.Message}
+}
+
+func passwordAuthFailed(user string) *AuthError {
+	return &AuthError{
+		Code:    invalidPasswordCode,
+		Message: fmt.Sprintf("password authentication failed for user \"%s\"", user),
+	}
+}
+
+func (config *ServerConfig) authMethod() AuthMethod {
+	if config.AuthMethod != "" {
+		return config.AuthMethod
+	}
+	if config.RequirePassword {
+		return AuthMethodCleartext
+	}
+	return AuthMethodTrust
+}
+
+// authenticatePassword runs the password exchange for the given method and
+// returns the password the client proved to know. The trust method does not
+// request a password.
+func authenticatePassword(c *Conn, user string, method AuthMethod, credentials CredentialStore) (string, error) {
+	switch method {
+	case AuthMethodTrust:
+		return "", nil
+	case AuthMethodCleartext:
+		return authenticateCleartext(c)
+	case AuthMethodMD5:
+		return authenticateMD5(c, user, credentials)
+	case AuthMethodScramSHA256:
+		return authenticateScramSHA256(c, user, credentials)
+	default:
+		return "", fmt.Errorf("unsupported auth method: %s", method)
+	}
+}
+
+func authenticateCleartext(c *Conn) (string, error) {
+	if err := c.receiver.SetAuthType(pgproto3.AuthTypeCleartextPassword); err != nil {
+		return "", err
+	}
+	if err := writeMessages(c, &pgproto3.AuthenticationCleartextPassword{}); err != nil {
+		return "", err
+	}
+
+	msg, err := c.receiver.Receive()
+	if err != nil {
+		return "", err
+	}
+	pmsg, ok := msg.(*pgproto3.PasswordMessage)
+	if !ok {
+		return "", fmt.Errorf("unexpected message type: %#v", msg)
+	}
+	return pmsg.Password, nil
+}
+
+func authenticateMD5(c *Conn, user string, credentials CredentialStore) (string, error) {
+	var salt [4]byte
+	if _, err := rand.Read(salt[:]); err != nil {
+		return "", err
+	}
+
+	if err := c.receiver.SetAuthType(pgproto3.AuthTypeMD5Password); err != nil {
+		return "", err
+	}
+	if err := writeMessages(c, &pgproto3.AuthenticationMD5Password{Salt: salt}); err != nil {
+		return "", err
+	}
+
+	msg, err := c.receiver.Receive()
+	if err != nil {
+		return "", err
+	}
+	pmsg, ok := msg.(*pgproto3.PasswordMessage)
+	if !ok {
+		return "", fmt.Errorf("unexpected message type: %#v", msg)
+	}
+
+	password, ok := lookupPassword(credentials, user)
+	if !ok {
+		return "", passwordAuthFailed(user)
+	}
+	expected := md5PasswordHash(user, password, salt)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(pmsg.Password)) != 1 {
+		return "", passwordAuthFailed(user)
+	}
+	return password, nil
+}
+
+// md5PasswordHash computes the response a client sends for md5 authentication:
+// "md5" + md5(md5(password + user) + salt).
+func md5PasswordHash(user, password string, salt [4]byte) string {
+	inner := md5.Sum([]byte(password + user))
+	innerHex := hex.EncodeToString(inner[:])
+	outer := md5.Sum(append([]byte(innerHex), salt[:]...))
+	return "md5" + hex.EncodeToString(outer[:])
+}
+
+func authenticateScramSHA256(c *Conn, user string, credentials CredentialStore) (string, error) {
+	if err := c.receiver.SetAuthType(pgproto3.AuthTypeSASL); err != nil {
+		return "", err
+	}
+	if err := writeMessages(c, &pgproto3.AuthenticationSASL{AuthMechanisms: []string{scramSHA256Mechanism}}); err != nil {
+		return "", err
+	}
+
+	msg, err := c.receiver.Receive()
+	if err != nil {
+		return "", err
+	}
+	initial, ok := msg.(*pgproto3.SASLInitialResponse)
+	if !ok {
+		return "", fmt.Errorf("unexpected message type: %#v", msg)
+	}
+	if initial.AuthMechanism != scramSHA256Mechanism {
+		return "", &AuthError{Code: protocolViolationCode, Message: fmt.Sprintf("unsupported SASL mechanism: %s", initial.AuthMechanism)}
+	}
+
+	password, known := lookupPassword(credentials, user)
+	conversation, err := newScramConversation(password)
+	if err != nil {
+		return "", err
+	}
+
+	serverFirst, err := conversation.serverFirst(initial.Data)
+	if err != nil {
+		return "", &AuthError{Code: protocolViolationCode, Message: err.Error()}
+	}
+	if err := c.receiver.SetAuthType(pgproto3.AuthTypeSASLContinue); err != nil {
+		return "", err
+	}
+	if err := writeMessages(c, &pgproto3.AuthenticationSASLContinue{Data: serverFirst}); err != nil {
+		return "", err
+	}
+
+	msg, err = c.receiver.Receive()
+	if err != nil {
+		return "", err
+	}
+	response, ok := msg.(*pgproto3.SASLResponse)
+	if !ok {
+		return "", fmt.Errorf("unexpected message type: %#v", msg)
+	}
+
+	serverFinal, err := conversation.serverFinal(response.Data)
+	if err != nil || !known {
+		return "", passwordAuthFailed(user)
+	}
+	if err := writeMessages(c, &pgproto3.AuthenticationSASLFinal{Data: serverFinal}); err != nil {
+		return "", err
+	}
+	return password, nil
+}
+
+func lookupPassword(credentials CredentialStore, user string) (string, bool) {
+	if credentials == nil {
+		return "", false
+	}
+	return credentials.Password(user)
+}
+
+// scramConversation holds the server side state of a SCRAM-SHA-256 exchange
+// as described in RFC 5802 and RFC 7677.
+type scramConversation struct {
+	saltedPassword  []byte
+	salt            []byte
+	nonce           string
+	clientFirstBare string
+	serverFirstMsg  string
+	gs2Header       string
+}
+
+func newScramConversation(password string) (*scramConversation, error) {
+	salt := make([]byte, scramSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return &scramConversation{
+		salt:           salt,
+		saltedPassword: pbkdf2.Key([]byte(password), salt, scramIterations, sha256.Size, sha256.New),
+	}, nil
+}
+
+func (sc *scramConversation) serverFirst(clientFirst []byte) ([]byte, error) {
+	msg := string(clientFirst)
+	// gs2-header: channel binding flag, optional authzid, followed by the bare message
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed SCRAM client-first-message")
+	}
+	switch {
+	case parts[0] == "n" || parts[0] == "y":
+	case strings.HasPrefix(parts[0], "p="):
+		return nil, fmt.Errorf("SCRAM channel binding is not supported")
+	default:
+		return nil, fmt.Errorf("malformed SCRAM gs2 header")
+	}
+	if parts[1] != "" {
+		return nil, fmt.Errorf("SCRAM authorization identity is not supported")
+	}
+	sc.gs2Header = parts[0] + "," + parts[1] + ","
+	sc.clientFirstBare = parts[2]
+
+	clientNonce := scramAttribute(sc.clientFirstBare, 'r')
+	if clientNonce == "" {
+		return nil, fmt.Errorf("SCRAM client nonce is missing")
+	}
+
+	nonce := make([]byte, scramNonceLength)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sc.nonce = clientNonce + base64.StdEncoding.EncodeToString(nonce)
+	sc.serverFirstMsg = fmt.Sprintf("r=%s,s=%s,i=%d", sc.nonce, base64.StdEncoding.EncodeToString(sc.salt), scramIterations)
+	return []byte(sc.serverFirstMsg), nil
+}
+
+func (sc *scramConversation) serverFinal(clientFinal []byte) ([]byte, error) {
+	msg := string(clientFinal)
+	proofIdx := strings.LastIndex(msg, ",p=")
+	if proofIdx < 0 {
+		return nil, fmt.Errorf("SCRAM client proof is missing")
+	}
+	withoutProof := msg[:proofIdx]
+
+	if scramAttribute(withoutProof, 'c') != base64.StdEncoding.EncodeToString([]byte(sc.gs2Header)) {
+		return nil, fmt.Errorf("SCRAM channel binding mismatch")
+	}
+	if scramAttribute(withoutProof, 'r') != sc.nonce {
+		return nil, fmt.Errorf("SCRAM nonce mismatch")
+	}
+	proof, err := base64.StdEncoding.DecodeString(msg[proofIdx+len(",p="):])
+	if err != nil || len(proof) != sha256.Size {
+		return nil, fmt.Errorf("malformed SCRAM client proof")
+	}
+
+	authMessage := []byte(sc.clientFirstBare + "," + sc.serverFirstMsg + "," + withoutProof)
+
+	clientKey := hmacSHA256(sc.saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	clientSignature := hmacSHA256(storedKey[:], authMessage)
+
+	recoveredClientKey := make([]byte, len(proof))
+	for i := range proof {
+		recoveredClientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	recoveredStoredKey := sha256.Sum256(recoveredClientKey)
+	if subtle.ConstantTimeCompare(recoveredStoredKey[:], storedKey[:]) != 1 {
+		return nil, fmt.Errorf("SCRAM client proof mismatch")
+	}
+
+	serverKey := hmacSHA256(sc.saltedPassword, []byte("Server Key"))
+	serverSignature := hmacSHA256(serverKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil
+}
+
+func scramAttribute(msg string, name byte) string {
+	for _, attr := range strings.Split(msg, ",") {
+		if len(attr) >= 2 && attr[0] == name && attr[1] == '=' {
+			return attr[2:]
+		}
+	}
+	return ""
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// verticaCredentialVerifier verifies the credentials of a client by opening
+// the Vertica connection with them. The opened connection is handed over to
+// the session, so the check costs no extra round trip.
+type verticaCredentialVerifier struct {
+	opener           DBOpener
+	connectionString string
+	// nodes are tried in turn until one accepts the connection, when nil
+	// only the node of the connection string is.
+	nodes *verticaNodes
+}
+
+func newVerticaCredentialVerifier(config *ServerConfig, opener DBOpener, nodes *verticaNodes) *verticaCredentialVerifier {
+	return &verticaCredentialVerifier{
+		opener:           opener,
+		connectionString: config.VerticaConnectionString,
+		nodes:            nodes,
+	}
+}
+
+func (v *verticaCredentialVerifier) verify(params map[string]string) (*sql.DB, error) {
+	if v.nodes == nil {
+		return v.connect(v.connectionString, params)
+	}
+
+	var err error
+	for _, addr := range v.nodes.candidates() {
+		var connectionString string
+		if connectionString, err = WithHost(v.connectionString, addr); err != nil {
+			return nil, err
+		}
+		var db *sql.DB
+		db, err = v.connect(connectionString, params)
+		if err == nil {
+			return db, nil
+		}
+		// Vertica answered, another node would refuse the session the same way
+		if _, ok := err.(*AuthError); ok {
+			return nil, err
+		}
+		if _, ok := err.(*vertigo.VError); ok {
+			return nil, err
+		}
+		v.nodes.markDown(addr, err)
+		Logger.Warn("Can't connect to Vertica node, try the next one", "node", addr, "error", err)
+	}
+	return nil, err
+}
+
+func (v *verticaCredentialVerifier) connect(connectionString string, params map[string]string) (*sql.DB, error) {
+	db, err := connectToDB(v.opener, "vertica", connectionString, params)
+	if err != nil {
+		if isInvalidPasswordError(err) {
+			return nil, passwordAuthFailed(params["user"])
+		}
+		return nil, err
+	}
+	return db, nil
+}
+
+func isInvalidPasswordError(err error) bool {
+	if verr, ok := err.(*vertigo.VError); ok {
+		return verr.SQLState == invalidPasswordCode || verr.SQLState == invalidAuthSpecCode
+	}
+	return strings.Contains(strings.ToLower(err.Error()), "authentication failed")
+}
@@ -0,0 +1,217 @@
+package pgvertica
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// scriptedReceiver answers Receive with messages produced from what the
+// server has written so far, which lets tests play the client side of
+// challenge-response exchanges.
+type scriptedReceiver struct {
+	conn    *MockConn
+	replies []func(written []byte) pgproto3.FrontendMessage
+}
+
+func (r *scriptedReceiver) Receive() (pgproto3.FrontendMessage, error) {
+	if len(r.replies) == 0 {
+		return nil, fmt.Errorf("no more scripted replies")
+	}
+	reply := r.replies[0]
+	r.replies = r.replies[1:]
+	return reply(r.conn.buf.Bytes()), nil
+}
+
+func (r *scriptedReceiver) ReceiveStartupMessage() (pgproto3.FrontendMessage, error) {
+	return r.Receive()
+}
+
+func (r *scriptedReceiver) SetAuthType(authType uint32) error {
+	return nil
+}
+
+func lastWrittenMessage(t *testing.T, written []byte) pgproto3.BackendMessage {
+	frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(strings.NewReader(string(written))), nil)
+	var last pgproto3.BackendMessage
+	for {
+		msg, err := frontend.Receive()
+		if err != nil {
+			return last
+		}
+		last = msg
+	}
+}
+
+func TestParseAuthMethod(t *testing.T) {
+	for input, expected := range map[string]AuthMethod{
+		"password":      AuthMethodCleartext,
+		"cleartext":     AuthMethodCleartext,
+		"MD5":           AuthMethodMD5,
+		"scram-sha-256": AuthMethodScramSHA256,
+	} {
+		method, err := ParseAuthMethod(input)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, method)
+	}
+
+	_, err := ParseAuthMethod("kerberos")
+	assert.Error(t, err)
+}
+
+func TestMD5PasswordHash(t *testing.T) {
+	assert.Equal(t, "md598a0412b9c31436fc53776e863350083", md5PasswordHash("alice", "secret", [4]byte{1, 2, 3, 4}))
+}
+
+func TestAuthenticatePassword_Cleartext(t *testing.T) {
+	mockReceiver := new(MockReceiver)
+	mockReceiver.On("Receive").Return(&pgproto3.PasswordMessage{Password: "secret"}, nil)
+	c := &Conn{Conn: &MockConn{}, receiver: mockReceiver}
+
+	password, err := authenticatePassword(c, "alice", AuthMethodCleartext, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", password)
+}
+
+func TestAuthenticatePassword_NoPassword(t *testing.T) {
+	c := &Conn{Conn: &MockConn{}, receiver: new(MockReceiver)}
+
+	password, err := authenticatePassword(c, "alice", AuthMethodTrust, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "", password)
+}
+
+func TestAuthenticatePassword_MD5(t *testing.T) {
+	credentials := StaticCredentialStore{"alice": "secret"}
+	md5Reply := func(password string) func([]byte) pgproto3.FrontendMessage {
+		return func(written []byte) pgproto3.FrontendMessage {
+			salt := lastWrittenMessage(t, written).(*pgproto3.AuthenticationMD5Password).Salt
+			return &pgproto3.PasswordMessage{Password: md5PasswordHash("alice", password, salt)}
+		}
+	}
+
+	t.Run("valid password", func(t *testing.T) {
+		mockConn := &MockConn{}
+		c := &Conn{Conn: mockConn, receiver: &scriptedReceiver{
+			conn:    mockConn,
+			replies: []func([]byte) pgproto3.FrontendMessage{md5Reply("secret")},
+		}}
+
+		password, err := authenticatePassword(c, "alice", AuthMethodMD5, credentials)
+		assert.NoError(t, err)
+		assert.Equal(t, "secret", password)
+	})
+
+	t.Run("invalid password", func(t *testing.T) {
+		mockConn := &MockConn{}
+		c := &Conn{Conn: mockConn, receiver: &scriptedReceiver{
+			conn:    mockConn,
+			replies: []func([]byte) pgproto3.FrontendMessage{md5Reply("wrong")},
+		}}
+
+		_, err := authenticatePassword(c, "alice", AuthMethodMD5, credentials)
+		require.Error(t, err)
+		assert.Equal(t, invalidPasswordCode, err.(*AuthError).Code)
+	})
+}
+
+// scramClient computes the client side of a SCRAM-SHA-256 exchange.
+type scramClient struct {
+	password    string
+	clientFirst string
+}
+
+func newScramClient(password string) *scramClient {
+	return &scramClient{password: password, clientFirst: "n=,r=clientnonce"}
+}
+
+func (sc *scramClient) finalMessage(serverFirst string) string {
+	salt, _ := base64.StdEncoding.DecodeString(scramAttribute(serverFirst, 's'))
+	withoutProof := "c=biws,r=" + scramAttribute(serverFirst, 'r')
+	authMessage := sc.clientFirst + "," + serverFirst + "," + withoutProof
+
+	saltedPassword := pbkdf2.Key([]byte(sc.password), salt, scramIterations, sha256.Size, sha256.New)
+	clientKey := hmacSHA256(saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	clientSignature := hmacSHA256(storedKey[:], []byte(authMessage))
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)
+}
+
+func TestAuthenticatePassword_ScramSHA256(t *testing.T) {
+	credentials := StaticCredentialStore{"alice": "secret"}
+	scramReplies := func(client *scramClient) []func([]byte) pgproto3.FrontendMessage {
+		return []func([]byte) pgproto3.FrontendMessage{
+			func([]byte) pgproto3.FrontendMessage {
+				return &pgproto3.SASLInitialResponse{AuthMechanism: scramSHA256Mechanism, Data: []byte("n,," + client.clientFirst)}
+			},
+			func(written []byte) pgproto3.FrontendMessage {
+				serverFirst := string(lastWrittenMessage(t, written).(*pgproto3.AuthenticationSASLContinue).Data)
+				return &pgproto3.SASLResponse{Data: []byte(client.finalMessage(serverFirst))}
+			},
+		}
+	}
+
+	t.Run("valid password", func(t *testing.T) {
+		mockConn := &MockConn{}
+		c := &Conn{Conn: mockConn, receiver: &scriptedReceiver{conn: mockConn, replies: scramReplies(newScramClient("secret"))}}
+
+		password, err := authenticatePassword(c, "alice", AuthMethodScramSHA256, credentials)
+		assert.NoError(t, err)
+		assert.Equal(t, "secret", password)
+
+		final, ok := lastWrittenMessage(t, mockConn.buf.Bytes()).(*pgproto3.AuthenticationSASLFinal)
+		require.True(t, ok)
+		assert.True(t, strings.HasPrefix(string(final.Data), "v="))
+	})
+
+	t.Run("invalid password", func(t *testing.T) {
+		mockConn := &MockConn{}
+		c := &Conn{Conn: mockConn, receiver: &scriptedReceiver{conn: mockConn, replies: scramReplies(newScramClient("wrong"))}}
+
+		_, err := authenticatePassword(c, "alice", AuthMethodScramSHA256, credentials)
+		require.Error(t, err)
+		assert.Equal(t, invalidPasswordCode, err.(*AuthError).Code)
+	})
+
+	t.Run("unknown user", func(t *testing.T) {
+		mockConn := &MockConn{}
+		c := &Conn{Conn: mockConn, receiver: &scriptedReceiver{conn: mockConn, replies: scramReplies(newScramClient("secret"))}}
+
+		_, err := authenticatePassword(c, "bob", AuthMethodScramSHA256, credentials)
+		require.Error(t, err)
+		assert.Equal(t, invalidPasswordCode, err.(*AuthError).Code)
+	})
+}
+
+func TestScramConversation_RejectsChannelBinding(t *testing.T) {
+	conversation, err := newScramConversation("secret")
+	require.NoError(t, err)
+
+	_, err = conversation.serverFirst([]byte("p=tls-server-end-point,,n=,r=nonce"))
+	assert.Error(t, err)
+}
+
+func TestLoadCredentialsFile(t *testing.T) {
+	path := t.TempDir() + "/credentials"
+	require.NoError(t, os.WriteFile(path, []byte("# proxy users\nalice:secret\n\nbob:p:ss\n"), 0600))
+
+	credentials, err := LoadCredentialsFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, StaticCredentialStore{"alice": "secret", "bob": "p:ss"}, credentials)
+
+	require.NoError(t, os.WriteFile(path, []byte("alice\n"), 0600))
+	_, err = LoadCredentialsFile(path)
+	assert.Error(t, err)
+}
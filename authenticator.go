@@ -0,0 +1,191 @@
+package pgvertica
+
+import (
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// VerticaCredentials is the Vertica login used by an authenticated proxy user.
+type VerticaCredentials struct {
+	User     string
+	Password string
+}
+
+// Authenticator decides whether a proxy user may log in and which Vertica
+// credentials its session uses. It is called from handleStartupMessage with
+// the password obtained by the configured AuthMethod, which is empty when no
+// password was requested. Rejections should be returned as *AuthError.
+type Authenticator interface {
+	Authenticate(user string, password string) (*VerticaCredentials, error)
+}
+
+// CertificateAuthenticator is implemented by authenticators able to log in
+// users whose identity was already proven by a verified client certificate.
+// Clients authenticated by a certificate are only asked for a password when
+// the configured Authenticator does not implement it.
+type CertificateAuthenticator interface {
+	AuthenticateCertificate(user string) (*VerticaCredentials, error)
+}
+
+// VerticaPassthroughAuthenticator forwards the client's credentials to
+// Vertica, which is the one to accept or reject them.
+type VerticaPassthroughAuthenticator struct{}
+
+func (VerticaPassthroughAuthenticator) Authenticate(user string, password string) (*VerticaCredentials, error) {
+	return &VerticaCredentials{User: user, Password: password}, nil
+}
+
+// AuthenticateCertificate logs in to Vertica without a password, which works
+// when Vertica itself trusts the proxy host for that user.
+func (VerticaPassthroughAuthenticator) AuthenticateCertificate(user string) (*VerticaCredentials, error) {
+	return &VerticaCredentials{User: user}, nil
+}
+
+// HtpasswdAuthenticator checks passwords against an htpasswd-style file with
+// "user:hash" lines. bcrypt ($2a$, $2b$, $2y$) and {SHA} hashes are supported.
+// Accepted users are forwarded to Vertica with the same user name and password;
+// wrap it in a ServiceAccountAuthenticator to log in with a different account.
+type HtpasswdAuthenticator struct {
+	hashes map[string]string
+}
+
+func NewHtpasswdAuthenticator(path string) (*HtpasswdAuthenticator, error) {
+	entries, err := readColonSeparatedFile(path, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		if !isSupportedHtpasswdHash(entry[1]) {
+			return nil, fmt.Errorf("%s: unsupported hash format for user %s", path, entry[0])
+		}
+		hashes[entry[0]] = entry[1]
+	}
+	return &HtpasswdAuthenticator{hashes: hashes}, nil
+}
+
+func (a *HtpasswdAuthenticator) Authenticate(user string, password string) (*VerticaCredentials, error) {
+	hash, ok := a.hashes[user]
+	if !ok || !checkHtpasswdHash(hash, password) {
+		return nil, passwordAuthFailed(user)
+	}
+	return &VerticaCredentials{User: user, Password: password}, nil
+}
+
+func isSupportedHtpasswdHash(hash string) bool {
+	return isBcryptHash(hash) || strings.HasPrefix(hash, "{SHA}")
+}
+
+func isBcryptHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func checkHtpasswdHash(hash string, password string) bool {
+	switch {
+	case isBcryptHash(hash):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expected := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(expected), []byte(hash)) == 1
+	default:
+		return false
+	}
+}
+
+// ServiceAccountAuthenticator maps proxy users to shared Vertica logins, so
+// BI service accounts do not need real Vertica passwords. The proxy password
+// of a user is checked by Users; users without an account are rejected.
+type ServiceAccountAuthenticator struct {
+	Users    Authenticator
+	Accounts map[string]VerticaCredentials
+}
+
+// NewServiceAccountAuthenticator reads the accounts from a file with
+// "proxy_user:vertica_user:vertica_password" lines. The proxy user "*" matches
+// every user that has no line of its own.
+func NewServiceAccountAuthenticator(path string, users Authenticator) (*ServiceAccountAuthenticator, error) {
+	entries, err := readColonSeparatedFile(path, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	accounts := make(map[string]VerticaCredentials, len(entries))
+	for _, entry := range entries {
+		accounts[entry[0]] = VerticaCredentials{User: entry[1], Password: entry[2]}
+	}
+	return &ServiceAccountAuthenticator{Users: users, Accounts: accounts}, nil
+}
+
+func (a *ServiceAccountAuthenticator) Authenticate(user string, password string) (*VerticaCredentials, error) {
+	account, err := a.account(user)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := a.Users.Authenticate(user, password); err != nil {
+		return nil, err
+	}
+	Logger.Debug("Mapped user to service account", "user", user, "account", account.User)
+	return account, nil
+}
+
+// AuthenticateCertificate maps a user authenticated by its client certificate
+// to its service account without checking a proxy password.
+func (a *ServiceAccountAuthenticator) AuthenticateCertificate(user string) (*VerticaCredentials, error) {
+	account, err := a.account(user)
+	if err != nil {
+		return nil, err
+	}
+	Logger.Debug("Mapped certificate user to service account", "user", user, "account", account.User)
+	return account, nil
+}
+
+func (a *ServiceAccountAuthenticator) account(user string) (*VerticaCredentials, error) {
+	account, ok := a.Accounts[user]
+	if !ok {
+		if account, ok = a.Accounts["*"]; !ok {
+			return nil, &AuthError{
+				Code:    invalidAuthSpecCode,
+				Message: fmt.Sprintf("no service account configured for user \"%s\"", user),
+			}
+		}
+	}
+	return &VerticaCredentials{User: account.User, Password: account.Password}, nil
+}
+
+func (config *ServerConfig) authenticator() Authenticator {
+	if config.Authenticator == nil {
+		return VerticaPassthroughAuthenticator{}
+	}
+	return config.Authenticator
+}
+
+// readColonSeparatedFile reads a file with one entry per line, splitting each
+// line on the first fields-1 colons. Empty lines and '#' comments are skipped.
+func readColonSeparatedFile(path string, fields int) ([][]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries [][]string
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entry := strings.SplitN(line, ":", fields)
+		if len(entry) != fields || entry[0] == "" {
+			return nil, fmt.Errorf("%s:%d: expected %d colon separated fields", path, i+1, fields)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
@@ -0,0 +1,90 @@
+package pgvertica
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeTempFile(t *testing.T, content string) string {
+	path := t.TempDir() + "/file"
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestVerticaPassthroughAuthenticator(t *testing.T) {
+	credentials, err := VerticaPassthroughAuthenticator{}.Authenticate("alice", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, &VerticaCredentials{User: "alice", Password: "secret"}, credentials)
+}
+
+func TestHtpasswdAuthenticator(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("bcrypt-secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	path := writeTempFile(t, fmt.Sprintf("# users\nalice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\nbob:%s\n", bcryptHash))
+
+	authenticator, err := NewHtpasswdAuthenticator(path)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc, user, password string
+		accepted             bool
+	}{
+		{desc: "sha password", user: "alice", password: "secret", accepted: true},
+		{desc: "bcrypt password", user: "bob", password: "bcrypt-secret", accepted: true},
+		{desc: "wrong password", user: "alice", password: "wrong", accepted: false},
+		{desc: "unknown user", user: "carol", password: "secret", accepted: false},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			credentials, err := authenticator.Authenticate(tC.user, tC.password)
+			if tC.accepted {
+				assert.NoError(t, err)
+				assert.Equal(t, &VerticaCredentials{User: tC.user, Password: tC.password}, credentials)
+			} else {
+				require.Error(t, err)
+				assert.Equal(t, invalidPasswordCode, err.(*AuthError).Code)
+			}
+		})
+	}
+}
+
+func TestHtpasswdAuthenticator_UnsupportedHash(t *testing.T) {
+	_, err := NewHtpasswdAuthenticator(writeTempFile(t, "alice:$apr1$salt$hash\n"))
+	assert.Error(t, err)
+}
+
+func TestServiceAccountAuthenticator(t *testing.T) {
+	path := writeTempFile(t, "tableau:bi_reader:vertica-secret\n")
+	authenticator, err := NewServiceAccountAuthenticator(path, VerticaPassthroughAuthenticator{})
+	require.NoError(t, err)
+
+	credentials, err := authenticator.Authenticate("tableau", "")
+	assert.NoError(t, err)
+	assert.Equal(t, &VerticaCredentials{User: "bi_reader", Password: "vertica-secret"}, credentials)
+
+	_, err = authenticator.Authenticate("alice", "secret")
+	require.Error(t, err)
+	assert.Equal(t, invalidAuthSpecCode, err.(*AuthError).Code)
+}
+
+func TestServiceAccountAuthenticator_Wildcard(t *testing.T) {
+	users, err := NewHtpasswdAuthenticator(writeTempFile(t, "alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"))
+	require.NoError(t, err)
+	authenticator := &ServiceAccountAuthenticator{
+		Users:    users,
+		Accounts: map[string]VerticaCredentials{"*": {User: "bi_reader", Password: "vertica-secret"}},
+	}
+
+	credentials, err := authenticator.Authenticate("alice", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, "bi_reader", credentials.User)
+
+	_, err = authenticator.Authenticate("alice", "wrong")
+	assert.Error(t, err)
+}
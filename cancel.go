@@ -0,0 +1,135 @@
+package pgvertica
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"sync"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+const queryCanceledCode = "57014"
+
+// cancelRequest is returned by serveConnStartup when the client opened the
+// connection only to cancel the query running in another session.
+type cancelRequest struct {
+	processID uint32
+	secretKey uint32
+}
+
+func (r *cancelRequest) Error() string {
+	return "cancel request"
+}
+
+// queryCanceler provides the context statements of a session run with, so a
+// CancelRequest received on another connection can interrupt them. The context
+// is replaced by a fresh one once it was canceled.
+type queryCanceler struct {
+	mu     sync.Mutex
+	parent context.Context
+	ctx    context.Context
+	cancel context.CancelFunc
+	active bool
+}
+
+func newQueryCanceler(parent context.Context) *queryCanceler {
+	qc := &queryCanceler{parent: parent}
+	qc.ctx, qc.cancel = context.WithCancel(parent)
+	return qc
+}
+
+// begin marks the session as busy and returns the context to run its
+// statements with.
+func (qc *queryCanceler) begin() context.Context {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	if qc.ctx.Err() != nil {
+		qc.ctx, qc.cancel = context.WithCancel(qc.parent)
+	}
+	qc.active = true
+	return qc.ctx
+}
+
+// end marks the session as idle, cancel requests received afterwards are
+// ignored like Postgres does.
+func (qc *queryCanceler) end() {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	qc.active = false
+}
+
+func (qc *queryCanceler) cancelQuery() bool {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	if !qc.active {
+		return false
+	}
+	qc.cancel()
+	return true
+}
+
+func (qc *queryCanceler) close() {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	qc.cancel()
+}
+
+// newBackendKey returns the BackendKeyData identifying a session in cancel
+// requests. Process IDs are unique per server, secret keys are random.
+func (s *Server) newBackendKey() (pgproto3.BackendKeyData, error) {
+	var secret [4]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		return pgproto3.BackendKeyData{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastProcessID++
+	return pgproto3.BackendKeyData{
+		ProcessID: s.lastProcessID,
+		SecretKey: binary.BigEndian.Uint32(secret[:]),
+	}, nil
+}
+
+func (s *Server) registerSession(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sessions == nil {
+		s.sessions = make(map[uint32]*Conn)
+	}
+	s.sessions[c.backendKey.ProcessID] = c
+	if s.draining {
+		c.drain.drain()
+	}
+}
+
+func (s *Server) unregisterSession(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, c.backendKey.ProcessID)
+}
+
+// cancelQuery interrupts the statement running in the session identified by
+// the key. Requests with an unknown process ID or a wrong secret are ignored.
+func (s *Server) cancelQuery(processID uint32, secretKey uint32) {
+	s.mu.Lock()
+	c, ok := s.sessions[processID]
+	s.mu.Unlock()
+
+	// compare in constant time, so the secret can't be guessed from timings
+	if !ok || subtle.ConstantTimeEq(int32(c.backendKey.SecretKey), int32(secretKey)) != 1 {
+		Logger.Warn("Ignore cancel request for unknown session", "pid", processID)
+		return
+	}
+	if c.canceler.cancelQuery() {
+		Logger.Info("Canceled query", "pid", processID, "address", c.RemoteAddr())
+	}
+}
@@ -0,0 +1,72 @@
+package pgvertica
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryCanceler(t *testing.T) {
+	qc := newQueryCanceler(context.Background())
+
+	assert.False(t, qc.cancelQuery(), "idle sessions are not canceled")
+
+	ctx := qc.begin()
+	assert.True(t, qc.cancelQuery())
+	assert.ErrorIs(t, ctx.Err(), context.Canceled)
+	qc.end()
+
+	ctx = qc.begin()
+	assert.NoError(t, ctx.Err(), "a canceled context is replaced")
+	qc.end()
+}
+
+func TestServerCancelQuery(t *testing.T) {
+	s := NewServer(&ServerConfig{})
+	key, err := s.newBackendKey()
+	require.NoError(t, err)
+	otherKey, err := s.newBackendKey()
+	require.NoError(t, err)
+	assert.NotEqual(t, key.ProcessID, otherKey.ProcessID)
+
+	c := &Conn{Conn: &MockConn{}, backendKey: key, canceler: newQueryCanceler(context.Background())}
+	s.registerSession(c)
+	ctx := c.canceler.begin()
+
+	s.cancelQuery(key.ProcessID, key.SecretKey+1)
+	assert.NoError(t, ctx.Err(), "wrong secret key")
+	s.cancelQuery(otherKey.ProcessID, otherKey.SecretKey)
+	assert.NoError(t, ctx.Err(), "other session")
+
+	s.cancelQuery(key.ProcessID, key.SecretKey)
+	assert.ErrorIs(t, ctx.Err(), context.Canceled)
+
+	s.unregisterSession(c)
+	assert.Empty(t, s.sessions)
+}
+
+func TestServeConnStartup_CancelRequest(t *testing.T) {
+	mockReceiver := new(MockReceiver)
+	mockReceiver.On("ReceiveStartupMessage").Return(&pgproto3.CancelRequest{ProcessID: 7, SecretKey: 42}, nil)
+	c := &Conn{Conn: &MockConn{}, receiver: mockReceiver}
+
+	_, err := serveConnStartup(context.Background(), c, &ServerConfig{})
+
+	var cancelReq *cancelRequest
+	require.True(t, errors.As(err, &cancelReq))
+	assert.Equal(t, &cancelRequest{processID: 7, secretKey: 42}, cancelReq)
+}
+
+func TestGetErrorResponse_Canceled(t *testing.T) {
+	qe := QueryExecutor{}
+
+	response := qe.getErrorResponse(fmt.Errorf("rows: %w", context.Canceled))
+
+	assert.Equal(t, queryCanceledCode, response.Code)
+	assert.Equal(t, "canceling statement due to user request", response.Message)
+}
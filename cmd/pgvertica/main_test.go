@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zbigniewtomanek/pgvertica"
+)
+
+func TestParseConfig(t *testing.T) {
+	env := map[string]string{
+		"PGVERTICA_VCONN":                   "vertica://env@localhost:5433/db",
+		"PGVERTICA_ADDR":                    ":6432",
+		"PGVERTICA_SCHEMAS_SYNC_INTERVAL_S": "30",
+		"PGVERTICA_REQUIRE_PASSWORD":        "true",
+	}
+	lookupEnv := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	config, err := parseConfig("serve", []string{"-addr", ":7432", "-pgconn", "postgres://flag@localhost:5432/db"}, lookupEnv)
+	require.NoError(t, err)
+
+	assert.Equal(t, ":7432", config.Addr, "flags take precedence over the environment")
+	assert.Equal(t, "postgres://flag@localhost:5432/db", config.PostgresConnection)
+	assert.Equal(t, "vertica://env@localhost:5433/db", config.VerticaConnection)
+	assert.Equal(t, 30, config.SchemasSyncIntervalS)
+	assert.True(t, config.RequirePassword)
+	assert.Equal(t, "INFO", config.LogLevel)
+}
+
+func TestParseConfig_RepeatedParameterStatus(t *testing.T) {
+	lookupEnv := func(name string) (string, bool) {
+		if name == "PGVERTICA_PARAMETER_STATUS" {
+			return "is_superuser=on;IntervalStyle=iso_8601", true
+		}
+		return "", false
+	}
+
+	config, err := parseConfig("serve", nil, lookupEnv)
+	require.NoError(t, err)
+	assert.Equal(t, stringList{"is_superuser=on", "IntervalStyle=iso_8601"}, config.ParameterStatus)
+
+	config, err = parseConfig("serve", []string{"-parameter-status", "DateStyle=ISO, DMY", "-parameter-status", "TimeZone=UTC"}, lookupEnv)
+	require.NoError(t, err)
+	assert.Equal(t, stringList{"DateStyle=ISO, DMY", "TimeZone=UTC"}, config.ParameterStatus)
+}
+
+func TestConfigListenAddrs(t *testing.T) {
+	config, err := parseConfig("serve", []string{"-listen", "/tmp/.s.PGSQL.5432", "-listen", "127.0.0.1:6432", "-unix-socket-mode", "0770"}, func(string) (string, bool) { return "", false })
+	require.NoError(t, err)
+
+	addrs, err := config.listenAddrs()
+	require.NoError(t, err)
+	assert.Equal(t, []pgvertica.ListenAddr{
+		{Network: "unix", Address: "/tmp/.s.PGSQL.5432", Mode: 0770},
+		{Network: "tcp", Address: "127.0.0.1:6432"},
+	}, addrs)
+
+	config.UnixSocketMode = "rw"
+	_, err = config.listenAddrs()
+	assert.Error(t, err)
+}
+
+func TestParseConfig_InvalidEnv(t *testing.T) {
+	lookupEnv := func(name string) (string, bool) {
+		if name == "PGVERTICA_SCHEMAS_SYNC_INTERVAL_S" {
+			return "often", true
+		}
+		return "", false
+	}
+
+	_, err := parseConfig("serve", nil, lookupEnv)
+	assert.Error(t, err)
+}
+
+func TestRun_UnknownCommand(t *testing.T) {
+	err := run(context.Background(), []string{"bogus"}, &bytes.Buffer{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown command")
+}
+
+func TestRun_UsageErrors(t *testing.T) {
+	err := run(context.Background(), []string{"-h"}, &bytes.Buffer{})
+	assert.ErrorIs(t, err, flag.ErrHelp)
+
+	var usageErr *usageError
+	for _, args := range [][]string{{"bogus"}, {"-no-such-flag"}, {"serve", "extra"}} {
+		err := run(context.Background(), args, &bytes.Buffer{})
+		assert.ErrorAs(t, err, &usageErr, args)
+		assert.NotErrorIs(t, err, flag.ErrHelp, args)
+	}
+}
+
+func TestPrintDiff(t *testing.T) {
+	var out bytes.Buffer
+	printDiff(&out, &pgvertica.SchemasDiff{
+		CreatedSchemas: []string{"sales"},
+		CreatedTables:  []string{"sales.orders"},
+		DroppedTables:  []string{"sales.old_orders"},
+		CreatedRoles:   []string{"analyst"},
+	})
+	assert.Equal(t, "+ schema sales\n+ table sales.orders\n- table sales.old_orders\n+ role analyst\n", out.String())
+
+	out.Reset()
+	printDiff(&out, &pgvertica.SchemasDiff{})
+	assert.Equal(t, "Postgres schemas are up to date\n", out.String())
+}
+
+func TestBuildAuthenticator(t *testing.T) {
+	authenticator, err := buildAuthenticator(&Config{Authenticator: "passthrough"}, false)
+	require.NoError(t, err)
+	assert.Equal(t, pgvertica.VerticaPassthroughAuthenticator{}, authenticator)
+
+	_, err = buildAuthenticator(&Config{Authenticator: "htpasswd"}, false)
+	assert.Error(t, err)
+
+	_, err = buildAuthenticator(&Config{Authenticator: "service-account"}, false)
+	assert.Error(t, err)
+
+	_, err = buildAuthenticator(&Config{Authenticator: "ldap"}, false)
+	assert.Error(t, err)
+}
+
+func TestBuildAuthenticator_ServiceAccount(t *testing.T) {
+	dir := t.TempDir()
+	accountsFile := dir + "/accounts"
+	require.NoError(t, os.WriteFile(accountsFile, []byte("*:bi_service:vertica-secret\n"), 0600))
+	htpasswdFile := dir + "/htpasswd"
+	require.NoError(t, os.WriteFile(htpasswdFile, []byte("alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0600))
+
+	_, err := buildAuthenticator(&Config{Authenticator: "service-account", ServiceAccountsFile: accountsFile}, false)
+	assert.Error(t, err, "nothing would check the password of the client")
+
+	authenticator, err := buildAuthenticator(&Config{Authenticator: "service-account", ServiceAccountsFile: accountsFile, HtpasswdFile: htpasswdFile}, false)
+	require.NoError(t, err)
+	_, err = authenticator.Authenticate("alice", "wrong")
+	assert.Error(t, err)
+	credentials, err := authenticator.Authenticate("alice", "secret")
+	require.NoError(t, err)
+	assert.Equal(t, "bi_service", credentials.User)
+
+	_, err = buildAuthenticator(&Config{Authenticator: "service-account", ServiceAccountsFile: accountsFile}, true)
+	assert.NoError(t, err, "md5 and scram-sha-256 check the password against the credentials file")
+}
+
+func TestAdminHandler_Usage(t *testing.T) {
+	server := pgvertica.NewServer(&pgvertica.ServerConfig{Limits: pgvertica.Limits{MaxConnections: 10}})
+	handler := newAdminHandler(server)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/usage", nil))
+
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	var usage pgvertica.Usage
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &usage))
+	assert.Equal(t, server.Usage(), usage)
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/usage", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+}
@@ -1,6 +1,7 @@
 package pgvertica
 
 import (
+	"crypto/tls"
 	"database/sql"
 	"fmt"
 	"net"
@@ -50,15 +51,17 @@ type DBOpener interface {
 type RealDBOpener struct{}
 
 func (ro RealDBOpener) Open(driverName, dataSourceName string) (*sql.DB, error) {
-	return sql.Open(driverName, dataSourceName)
+	return openStateDB(driverName, dataSourceName)
 }
 
 type Receiver interface {
 	Receive() (pgproto3.FrontendMessage, error)
 	ReceiveStartupMessage() (pgproto3.FrontendMessage, error)
+	SetAuthType(authType uint32) error
 }
 
 type BackendWrapper struct {
+	cr      pgproto3.ChunkReader
 	backend *pgproto3.Backend
 }
 
@@ -67,7 +70,11 @@ func (bw *BackendWrapper) Receive() (pgproto3.FrontendMessage, error) {
 }
 
 func (bw *BackendWrapper) ReceiveStartupMessage() (pgproto3.FrontendMessage, error) {
-	return bw.backend.ReceiveStartupMessage()
+	return receiveStartupMessage(bw.cr)
+}
+
+func (bw *BackendWrapper) SetAuthType(authType uint32) error {
+	return bw.backend.SetAuthType(authType)
 }
 
 type Conn struct {
@@ -75,18 +82,63 @@ type Conn struct {
 	receiver Receiver
 	vdb      *sql.DB
 	pgdb     *sql.DB
+	// pools shares vdb and pgdb with other sessions, when nil they are
+	// opened for this connection only and closed with it.
+	pools *BackendPools
+	// vnodes are the Vertica nodes the session may connect to.
+	vnodes  *verticaNodes
+	vlease  backendLease
+	pglease backendLease
+	// routeCache remembers fallback routes, it is nil when the fallback
+	// is disabled.
+	routeCache *routeCache
+	// limits counts the session against the server limits, releaseSlot
+	// gives its place back when it ends.
+	limits      *sessionLimits
+	releaseSlot func()
+
+	// user is the proxy user the client logged in as.
+	user       string
+	backendKey pgproto3.BackendKeyData
+	canceler   *queryCanceler
+	drain      *sessionDrain
+	// parameterStatus holds the values reported at startup, SET ... TO
+	// DEFAULT reports them again.
+	parameterStatus map[string]string
+	// settings are the session settings requested at startup, RESET
+	// restores them.
+	settings map[string]string
 }
 
 func newConn(conn net.Conn) *Conn {
+	cr := pgproto3.NewChunkReader(conn)
 	return &Conn{
 		Conn: conn,
 		receiver: &BackendWrapper{
-			backend: pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn),
+			cr:      cr,
+			backend: pgproto3.NewBackend(cr, conn),
 		},
 	}
 }
 
+func (c *Conn) isTLS() bool {
+	_, ok := c.Conn.(*tls.Conn)
+	return ok
+}
+
+// dbOpener returns the opener of the session databases.
+func (c *Conn) dbOpener() DBOpener {
+	if c.pools != nil {
+		return c.pools
+	}
+	return RealDBOpener{}
+}
+
 func (c *Conn) Close() (err error) {
+	if c.pools != nil {
+		return c.Conn.Close()
+	}
+
 	if c.vdb != nil {
 		if e := c.vdb.Close(); err == nil {
 			err = e
@@ -146,3 +198,12 @@ func connectToDB(opener DBOpener, driverName string, connectionString string, pa
 	}
 	return db, nil
 }
+
+// CheckConnection opens a connection with the given driver, pings it and closes it.
+func CheckConnection(driverName string, connectionString string) error {
+	db, err := connectToDB(RealDBOpener{}, driverName, connectionString, nil)
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
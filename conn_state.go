@@ -0,0 +1,151 @@
+package pgvertica
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+)
+
+// connState is the session state a lease left on a pooled connection.
+type connState struct {
+	owner *leaseOwner
+	setup string
+}
+
+// leaseOwner identifies the lease that set a connection up. It is never
+// zero sized, so every lease gets a distinct pointer.
+type leaseOwner struct {
+	_ byte
+}
+
+// openStateDB opens a database whose driver connections remember the state
+// a lease left on them. The state goes away with the connection, when the
+// pool closes it.
+func openStateDB(driverName, dataSourceName string) (*sql.DB, error) {
+	db, err := sql.Open(driverName, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	drv := db.Driver()
+	db.Close() // it has no connection yet
+
+	var connector driver.Connector = dsnConnector{driver: drv, dsn: dataSourceName}
+	if driverCtx, ok := drv.(driver.DriverContext); ok {
+		if connector, err = driverCtx.OpenConnector(dataSourceName); err != nil {
+			return nil, err
+		}
+	}
+	return sql.OpenDB(stateConnector{connector}), nil
+}
+
+// dsnConnector connects with a driver that has no Connector of its own.
+type dsnConnector struct {
+	driver driver.Driver
+	dsn    string
+}
+
+func (c dsnConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+type stateConnector struct {
+	driver.Connector
+}
+
+func (c stateConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &stateConn{Conn: conn}, nil
+}
+
+// stateConn is a driver connection with the state a lease left on it,
+// known is false until a lease released it. Only the session holding the
+// connection uses the state. Every optional driver interface is passed on
+// to the wrapped connection.
+type stateConn struct {
+	driver.Conn
+	state connState
+	known bool
+}
+
+// leasedConnState returns the driver connection of conn, nil when its
+// state is not tracked.
+func leasedConnState(conn *sql.Conn) (tracked *stateConn) {
+	conn.Raw(func(driverConn any) error {
+		tracked, _ = driverConn.(*stateConn)
+		return nil
+	})
+	return tracked
+}
+
+func (c *stateConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if conn, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return conn.PrepareContext(ctx, query)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *stateConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if conn, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return conn.BeginTx(ctx, opts)
+	}
+	if opts.Isolation != driver.IsolationLevel(sql.LevelDefault) || opts.ReadOnly {
+		return nil, errors.New("driver does not support transaction options")
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.Conn.Begin()
+}
+
+func (c *stateConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if conn, ok := c.Conn.(driver.ExecerContext); ok {
+		return conn.ExecContext(ctx, query, args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *stateConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if conn, ok := c.Conn.(driver.QueryerContext); ok {
+		return conn.QueryContext(ctx, query, args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *stateConn) Ping(ctx context.Context) error {
+	if conn, ok := c.Conn.(driver.Pinger); ok {
+		return conn.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *stateConn) ResetSession(ctx context.Context) error {
+	if conn, ok := c.Conn.(driver.SessionResetter); ok {
+		return conn.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *stateConn) IsValid() bool {
+	if conn, ok := c.Conn.(driver.Validator); ok {
+		return conn.IsValid()
+	}
+	return true
+}
+
+func (c *stateConn) CheckNamedValue(value *driver.NamedValue) error {
+	if conn, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return conn.CheckNamedValue(value)
+	}
+	return driver.ErrSkip
+}
@@ -1,6 +1,7 @@
 package pgvertica
 
 import (
+	"context"
 	"database/sql"
 
 	"github.com/jackc/pgproto3/v2"
@@ -17,6 +18,7 @@ type Cursor struct {
 	name        string
 	query       string
 	scanFunc    func(rows *sql.Rows, cols []*sql.ColumnType) (*pgproto3.DataRow, error)
+	stmt        *sql.Stmt
 	rows        *sql.Rows
 	columnTypes []*sql.ColumnType
 }
@@ -41,15 +43,25 @@ func newCursor(name string, query string, ctype CursorType) *Cursor {
 	}
 }
 
-func (c *Cursor) open(db *sql.DB) error {
-	stmt, err := db.Prepare(c.query)
+// preparer is implemented by *sql.DB and *sql.Conn.
+type preparer interface {
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+}
+
+func (c *Cursor) open(db preparer, args ...interface{}) error {
+	// the rows outlive the query declaring the cursor, canceling a later
+	// query must not close them
+	ctx := context.Background()
+	stmt, err := db.PrepareContext(ctx, c.query)
 	if err != nil {
 		Logger.Error("Error opening cursor", "name", c.name, "error", err)
 		return err
 	}
-	result, err := stmt.Query()
+	c.stmt = stmt
+	result, err := stmt.QueryContext(ctx, args...)
 	if err != nil {
 		Logger.Error("Error opening cursor", "name", c.name, "error", err)
+		stmt.Close()
 		return err
 	}
 	cTypes, err := result.ColumnTypes()
@@ -69,7 +81,12 @@ func (c *Cursor) close() error {
 		Logger.Debug("Cursor already closed", "name", c.name)
 		return nil
 	}
-	return c.rows.Close()
+	err := c.rows.Close()
+	c.rows = nil
+	if e := c.stmt.Close(); err == nil {
+		err = e
+	}
+	return err
 }
 
 func (c *Cursor) fetch(n int) ([]pgproto3.Message, error) {
@@ -12,8 +12,10 @@ type SchemasSynchronizator struct {
 	pgdb *sql.DB
 }
 
-func NewSchemasSynchronizator(vConnStr string, pgConnStr string) (*SchemasSynchronizator, error) {
-	vdb, vErr := connectToDB(RealDBOpener{}, "vertica", vConnStr, nil)
+// NewSchemasSynchronizator connects to Vertica and Postgres. When the
+// Vertica node of vConnStr is down the backup nodes are tried in turn.
+func NewSchemasSynchronizator(vConnStr string, pgConnStr string, vBackupNodes ...string) (*SchemasSynchronizator, error) {
+	vdb, vErr := connectToVertica(vConnStr, vBackupNodes)
 	if vErr != nil {
 		Logger.Error("Can't connect to Vertica")
 		return nil, vErr
@@ -23,7 +25,7 @@ func NewSchemasSynchronizator(vConnStr string, pgConnStr string) (*SchemasSynchr
 	pgdb, pgErr := connectToDB(RealDBOpener{}, "postgres", pgConnStr, nil)
 	if pgErr != nil {
 		Logger.Error("Can't connect to Postgres")
-		return nil, vErr
+		return nil, pgErr
 	}
 	Logger.Info("established connection to Postgres")
 
@@ -33,6 +35,21 @@ func NewSchemasSynchronizator(vConnStr string, pgConnStr string) (*SchemasSynchr
 	}, nil
 }
 
+func connectToVertica(connectionString string, backupNodes []string) (*sql.DB, error) {
+	db, err := connectToDB(RealDBOpener{}, "vertica", connectionString, nil)
+	for _, addr := range backupNodes {
+		if err == nil {
+			break
+		}
+		Logger.Warn("Can't connect to Vertica, try a backup node", "node", addr, "error", err)
+		var nodeConnectionString string
+		if nodeConnectionString, err = WithHost(connectionString, addr); err == nil {
+			db, err = connectToDB(RealDBOpener{}, "vertica", nodeConnectionString, nil)
+		}
+	}
+	return db, err
+}
+
 func (s *SchemasSynchronizator) Close() (err error) {
 	if s.vdb != nil {
 		if e := s.vdb.Close(); err == nil {
@@ -79,6 +96,79 @@ func (s *SchemasSynchronizator) SyncDBschemas() error {
 	return nil
 }
 
+// SchemasDiff describes the changes a call to SyncDBschemas would apply to Postgres.
+type SchemasDiff struct {
+	CreatedSchemas []string
+	CreatedTables  []string
+	DroppedTables  []string
+	CreatedRoles   []string
+}
+
+// IsEmpty reports whether the diff contains no changes.
+func (d *SchemasDiff) IsEmpty() bool {
+	return len(d.CreatedSchemas) == 0 && len(d.CreatedTables) == 0 && len(d.DroppedTables) == 0 && len(d.CreatedRoles) == 0
+}
+
+// DiffDBschemas computes what SyncDBschemas would change without modifying Postgres.
+func (s *SchemasSynchronizator) DiffDBschemas() (*SchemasDiff, error) {
+	diff := &SchemasDiff{}
+	schemasToSync, err := s.ListSchemas()
+	if err != nil {
+		return nil, err
+	}
+
+	postgresSchemas, err := s.listSchemasPostgres()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, schemaName := range schemasToSync {
+		if !contains(postgresSchemas, schemaName) {
+			diff.CreatedSchemas = append(diff.CreatedSchemas, schemaName)
+		}
+
+		verticaTables, err := s.listTablesInSchemaVertica(schemaName)
+		if err != nil {
+			return nil, err
+		}
+		postgresTables, err := s.listTablesInSchemaPostgres(schemaName)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, tableName := range verticaTables {
+			if !contains(postgresTables, tableName) {
+				diff.CreatedTables = append(diff.CreatedTables, fmt.Sprintf("%s.%s", schemaName, tableName))
+			}
+		}
+		for _, tableName := range postgresTables {
+			if !contains(verticaTables, tableName) {
+				diff.DroppedTables = append(diff.DroppedTables, fmt.Sprintf("%s.%s", schemaName, tableName))
+			}
+		}
+	}
+
+	if len(schemasToSync) == 0 {
+		return diff, nil
+	}
+
+	roles, err := s.listRoles()
+	if err != nil {
+		return nil, err
+	}
+	for _, role := range roles {
+		exists, err := s.roleExists(role)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			diff.CreatedRoles = append(diff.CreatedRoles, role)
+		}
+	}
+
+	return diff, nil
+}
+
 func (s *SchemasSynchronizator) syncRoles(schemas []string) error {
 	Logger.Debug("Sync roles")
 	roles, err := s.listRoles()
@@ -203,6 +293,11 @@ func (s *SchemasSynchronizator) listTablesInSchemaPostgres(schema string) ([]str
 	return s.listIds(s.pgdb, query)
 }
 
+func (s *SchemasSynchronizator) listSchemasPostgres() ([]string, error) {
+	query := `SELECT schema_name FROM information_schema.schemata;`
+	return s.listIds(s.pgdb, query)
+}
+
 func (s *SchemasSynchronizator) listIds(db *sql.DB, query string) ([]string, error) {
 	rows, err := db.Query(query)
 	if err != nil {
@@ -237,6 +332,15 @@ func contains(slice []string, item string) bool {
 	return false
 }
 
+func containsFold(slice []string, item string) bool {
+	for _, a := range slice {
+		if strings.EqualFold(a, item) {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *SchemasSynchronizator) recreateSchemaOnPostgres(schemaName string) error {
 	_, err := s.pgdb.Exec(fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s", schemaName))
 	if err != nil {
@@ -163,3 +163,44 @@ func TestRecreateSchemaOnPostgres(t *testing.T) {
 	err = s.recreateSchemaOnPostgres("test_schema")
 	assert.NoError(err)
 }
+
+func TestDiffDBschemas(t *testing.T) {
+	assert := assert.New(t)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	s := SchemasSynchronizator{
+		vdb:  db,
+		pgdb: db,
+	}
+
+	mock.ExpectQuery("SELECT schema_name FROM v_catalog.schemata").
+		WillReturnRows(sqlmock.NewRows([]string{"schema_name"}).AddRow("schema1"))
+	mock.ExpectQuery("SELECT schema_name FROM information_schema.schemata;").
+		WillReturnRows(sqlmock.NewRows([]string{"schema_name"}).AddRow("public"))
+	mock.ExpectQuery("SELECT table_name FROM v_catalog.tables WHERE table_schema='schema1';").
+		WillReturnRows(sqlmock.NewRows([]string{"table_name"}).AddRow("table1").AddRow("table2"))
+	mock.ExpectQuery("SELECT tablename FROM pg_catalog.pg_tables WHERE schemaname = 'schema1';").
+		WillReturnRows(sqlmock.NewRows([]string{"tablename"}).AddRow("table2").AddRow("table3"))
+	mock.ExpectQuery("SELECT name from v_catalog.roles;").
+		WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("analyst"))
+	mock.ExpectQuery("SELECT user_name from v_catalog.users;").
+		WillReturnRows(sqlmock.NewRows([]string{"user_name"}).AddRow("dbadmin"))
+	mock.ExpectQuery("SELECT 1 FROM pg_roles WHERE rolname='analyst'").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}))
+	mock.ExpectQuery("SELECT 1 FROM pg_roles WHERE rolname='dbadmin'").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	diff, err := s.DiffDBschemas()
+	assert.NoError(err)
+	assert.Equal([]string{"schema1"}, diff.CreatedSchemas)
+	assert.Equal([]string{"schema1.table1"}, diff.CreatedTables)
+	assert.Equal([]string{"schema1.table3"}, diff.DroppedTables)
+	assert.Equal([]string{"analyst"}, diff.CreatedRoles)
+	assert.False(diff.IsEmpty())
+	assert.NoError(mock.ExpectationsWereMet())
+}
@@ -0,0 +1,905 @@
+package pgvertica
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+const featureNotSupportedCode = "0A000"
+
+// dialectError is returned for a query using a PostgreSQL construct the
+// translator can't express in Vertica.
+type dialectError struct {
+	construct string
+}
+
+func (e *dialectError) Error() string {
+	return e.construct + " is not supported by Vertica"
+}
+
+func (e *dialectError) errorResponse() *pgproto3.ErrorResponse {
+	return &pgproto3.ErrorResponse{Severity: "ERROR", Code: featureNotSupportedCode, Message: e.Error()}
+}
+
+// sqlNode is a node of the syntax tree the dialect translator works on: a
+// token, a parenthesized group of nodes, an interval literal or a construct
+// already translated to Vertica.
+type sqlNode struct {
+	token sqlToken
+	// children are the nodes between the parentheses of a group, closed is
+	// false when the query ends before the closing one.
+	children []*sqlNode
+	group    bool
+	closed   bool
+	// start and end are the byte offsets of the node in the query.
+	start, end int
+	// text replaces a translated node.
+	text       string
+	translated bool
+	// interval holds the parts of an interval literal, nil when they can't
+	// be parsed.
+	interval   []intervalPart
+	isInterval bool
+}
+
+func (n *sqlNode) isLeaf() bool {
+	return !n.group && !n.translated && !n.isInterval
+}
+
+func (n *sqlNode) isKeyword(keyword string) bool {
+	return n.isLeaf() && n.token.isKeyword(keyword)
+}
+
+func (n *sqlNode) isOperator(operator string) bool {
+	return n.isLeaf() && n.token.isOperator(operator)
+}
+
+func (n *sqlNode) isString() bool {
+	return n.isLeaf() && n.token.kind == sqlString
+}
+
+// clauseKeywords end the operands of the operators translated to function
+// calls.
+var clauseKeywords = map[string]bool{
+	"SELECT": true, "FROM": true, "WHERE": true, "AND": true, "OR": true, "NOT": true, "ON": true,
+	"CASE": true, "WHEN": true, "THEN": true, "ELSE": true, "END": true, "AS": true, "HAVING": true,
+	"GROUP": true, "BY": true, "ORDER": true, "LIMIT": true, "OFFSET": true, "FETCH": true,
+	"JOIN": true, "LEFT": true, "RIGHT": true, "INNER": true, "OUTER": true, "FULL": true,
+	"CROSS": true, "NATURAL": true, "LATERAL": true, "UNION": true, "INTERSECT": true, "EXCEPT": true,
+	"ALL": true, "DISTINCT": true, "IN": true, "IS": true, "LIKE": true, "ILIKE": true,
+	"SIMILAR": true, "BETWEEN": true, "ESCAPE": true, "USING": true, "WITH": true, "OVER": true,
+	"PARTITION": true, "WINDOW": true, "ASC": true, "DESC": true, "NULLS": true, "INTO": true,
+	"VALUES": true, "RETURNING": true, "SET": true, "FILTER": true, "WITHIN": true,
+}
+
+// isName reports whether the node is an identifier that is not a clause
+// keyword, e.g. a column or a function name.
+func (n *sqlNode) isName() bool {
+	if !n.isLeaf() {
+		return false
+	}
+	return n.token.kind == sqlQuotedIdentifier ||
+		n.token.kind == sqlIdentifier && !clauseKeywords[strings.ToUpper(n.token.text)]
+}
+
+// isOperand reports whether the node can be a whole operand or start one.
+func (n *sqlNode) isOperand() bool {
+	if !n.isLeaf() {
+		return true
+	}
+	switch n.token.kind {
+	case sqlString, sqlNumber, sqlParameter:
+		return true
+	}
+	return n.isName()
+}
+
+// isBinaryOperator excludes the punctuation tokenized as operators.
+func (n *sqlNode) isBinaryOperator() bool {
+	if !n.isLeaf() || n.token.kind != sqlOperator {
+		return false
+	}
+	switch n.token.text {
+	case "(", ")", ",", ";", ".", "::", "[", "]":
+		return false
+	}
+	return true
+}
+
+const (
+	additivePrecedence = 4
+	// otherPrecedence is the precedence of the operators PostgreSQL doesn't
+	// single out, like ~ or ||.
+	otherPrecedence = 3
+)
+
+func operatorPrecedence(operator string) int {
+	switch operator {
+	case "^":
+		return 6
+	case "*", "/", "%":
+		return 5
+	case "+", "-":
+		return additivePrecedence
+	case "=", "<", ">", "<=", ">=", "<>", "!=":
+		return 2
+	default:
+		return otherPrecedence
+	}
+}
+
+// typedLiteralKeywords precede a string literal to give it a type, as in
+// DATE '2024-01-01'.
+var typedLiteralKeywords = []string{"DATE", "TIME", "TIMESTAMP", "TIMESTAMPTZ"}
+
+func isTypedLiteral(keyword, literal *sqlNode) bool {
+	return keyword.isLeaf() && keyword.token.kind == sqlIdentifier &&
+		contains(typedLiteralKeywords, strings.ToUpper(keyword.token.text)) && literal.isString()
+}
+
+// parseSQLTree groups the tokens of a query, without comments, into a tree
+// following the parentheses.
+func parseSQLTree(query string) []*sqlNode {
+	tokens := significantTokens(tokenizeSQL(query))
+	var nodes []*sqlNode
+	for i := 0; i < len(tokens); {
+		part, next, closed := parseSQLNodes(tokens, i, len(query))
+		nodes = append(nodes, part...)
+		if closed {
+			// a stray closing parenthesis
+			token := tokens[next-1]
+			nodes = append(nodes, &sqlNode{token: token, start: token.pos, end: token.pos + len(token.text)})
+		}
+		i = next
+	}
+	return nodes
+}
+
+// parseSQLNodes reads nodes from tokens[i] up to the parenthesis closing
+// their group. It returns the index of the token after it.
+func parseSQLNodes(tokens []sqlToken, i int, queryLen int) (nodes []*sqlNode, next int, closed bool) {
+	for i < len(tokens) {
+		token := tokens[i]
+		switch {
+		case token.isOperator("("):
+			node := &sqlNode{token: token, group: true, start: token.pos, end: queryLen}
+			node.children, i, node.closed = parseSQLNodes(tokens, i+1, queryLen)
+			if node.closed {
+				node.end = tokens[i-1].pos + 1
+			}
+			nodes = append(nodes, node)
+		case token.isOperator(")"):
+			return nodes, i + 1, true
+		default:
+			nodes = append(nodes, &sqlNode{token: token, start: token.pos, end: token.pos + len(token.text)})
+			i++
+		}
+	}
+	return nodes, i, false
+}
+
+// splitArguments splits the nodes of a group at its commas.
+func splitArguments(nodes []*sqlNode) [][]*sqlNode {
+	if len(nodes) == 0 {
+		return nil
+	}
+	var args [][]*sqlNode
+	start := 0
+	for i, node := range nodes {
+		if node.isOperator(",") {
+			args = append(args, nodes[start:i])
+			start = i + 1
+		}
+	}
+	return append(args, nodes[start:])
+}
+
+// translateToVertica rewrites the PostgreSQL constructs of a query Vertica
+// lacks into Vertica equivalents. Everything else, including whitespace and
+// comments outside the translated constructs, is kept as written.
+func translateToVertica(query string) (string, error) {
+	t := &dialectTranslator{query: query}
+	nodes, err := t.translate(parseSQLTree(query))
+	if err != nil {
+		return "", err
+	}
+	if !t.changed || len(nodes) == 0 {
+		return query, nil
+	}
+	return query[:nodes[0].start] + t.render(nodes) + query[nodes[len(nodes)-1].end:], nil
+}
+
+type dialectTranslator struct {
+	query   string
+	changed bool
+}
+
+// translate translates the nodes of a group, after the groups they hold.
+func (t *dialectTranslator) translate(nodes []*sqlNode) ([]*sqlNode, error) {
+	for _, node := range nodes {
+		if node.group {
+			children, err := t.translate(node.children)
+			if err != nil {
+				return nil, err
+			}
+			node.children = children
+		}
+	}
+	for _, pass := range []func([]*sqlNode) ([]*sqlNode, error){
+		t.collapseIntervals,
+		t.translateFunctions,
+		t.translateIntervalArithmetic,
+		t.translateRegexOperators,
+		t.translateDistinctOn,
+		t.translateLimits,
+	} {
+		var err error
+		if nodes, err = pass(nodes); err != nil {
+			return nil, err
+		}
+	}
+	return nodes, nil
+}
+
+func (t *dialectTranslator) render(nodes []*sqlNode) string {
+	var b strings.Builder
+	for i, node := range nodes {
+		if i > 0 {
+			b.WriteString(t.query[nodes[i-1].end:node.start])
+		}
+		b.WriteString(t.renderNode(node))
+	}
+	return b.String()
+}
+
+func (t *dialectTranslator) renderNode(node *sqlNode) string {
+	switch {
+	case node.translated:
+		return node.text
+	case !node.group || len(node.children) == 0:
+		return t.query[node.start:node.end]
+	}
+	first, last := node.children[0], node.children[len(node.children)-1]
+	return t.query[node.start:first.start] + t.render(node.children) + t.query[last.end:node.end]
+}
+
+// replace substitutes nodes[i:j] with a node holding text. An empty text
+// removes the nodes together with the whitespace separating them from the
+// next one.
+func (t *dialectTranslator) replace(nodes []*sqlNode, i, j int, text string) []*sqlNode {
+	node := &sqlNode{start: nodes[i].start, end: nodes[j-1].end, text: text, translated: true}
+	if text == "" {
+		if j < len(nodes) {
+			node.end = nodes[j].start
+		} else if i > 0 {
+			node.start = nodes[i-1].end
+		}
+	}
+	t.changed = true
+	return append(nodes[:i:i], append([]*sqlNode{node}, nodes[j:]...)...)
+}
+
+// primaryStart returns the index of the first node of the operand ending
+// at nodes[k], like t.col, f(x) or x::varchar(10).
+func primaryStart(nodes []*sqlNode, k int) (int, bool) {
+	if k < 0 || !nodes[k].isOperand() {
+		return 0, false
+	}
+	j := k
+	for {
+		switch {
+		case nodes[j].group && j > 0 && nodes[j-1].isName():
+			j--
+		case j > 0 && isTypedLiteral(nodes[j-1], nodes[j]):
+			j--
+		case j >= 2 && (nodes[j-1].isOperator(".") || nodes[j-1].isOperator("::")) && nodes[j-2].isOperand():
+			j -= 2
+		default:
+			return j, true
+		}
+	}
+}
+
+// primaryEnd returns the index after the last node of the operand starting
+// at nodes[k].
+func primaryEnd(nodes []*sqlNode, k int) (int, bool) {
+	if k >= len(nodes) {
+		return 0, false
+	}
+	if nodes[k].isOperator("-") || nodes[k].isOperator("+") {
+		return primaryEnd(nodes, k+1)
+	}
+	if !nodes[k].isOperand() {
+		return 0, false
+	}
+	j := k + 1
+	for {
+		switch {
+		case j < len(nodes) && nodes[j].group && nodes[j-1].isName():
+			j++
+		case j < len(nodes) && isTypedLiteral(nodes[j-1], nodes[j]):
+			j++
+		case j+1 < len(nodes) && (nodes[j].isOperator(".") || nodes[j].isOperator("::")) && nodes[j+1].isOperand():
+			j += 2
+		default:
+			return j, true
+		}
+	}
+}
+
+// leftOperandStart returns the index of the first node of the left operand
+// of the binary operator at nodes[i] with the precedence.
+func leftOperandStart(nodes []*sqlNode, i, precedence int) (int, bool) {
+	k := i - 1
+	for {
+		s, ok := primaryStart(nodes, k)
+		if !ok {
+			return 0, false
+		}
+		if s >= 2 && nodes[s-1].isBinaryOperator() && operatorPrecedence(nodes[s-1].token.text) >= precedence {
+			k = s - 2
+			continue
+		}
+		return s, true
+	}
+}
+
+// rightOperandEnd returns the index after the last node of the right
+// operand of the binary operator at nodes[i] with the precedence.
+func rightOperandEnd(nodes []*sqlNode, i, precedence int) (int, bool) {
+	k := i + 1
+	for {
+		e, ok := primaryEnd(nodes, k)
+		if !ok {
+			return 0, false
+		}
+		if e+1 < len(nodes) && nodes[e].isBinaryOperator() && operatorPrecedence(nodes[e].token.text) > precedence {
+			k = e + 1
+			continue
+		}
+		return e, true
+	}
+}
+
+// collapseIntervals turns interval literals, INTERVAL '1 day', INTERVAL '1'
+// DAY or '1 day'::interval, into single nodes.
+func (t *dialectTranslator) collapseIntervals(nodes []*sqlNode) ([]*sqlNode, error) {
+	for i := 0; i < len(nodes); i++ {
+		var literal string
+		var j int
+		switch {
+		case nodes[i].isKeyword("INTERVAL") && i+1 < len(nodes) && nodes[i+1].isString():
+			literal, j = nodes[i+1].token.value, i+2
+			if j < len(nodes) && nodes[j].isLeaf() && nodes[j].token.kind == sqlIdentifier && intervalFields[strings.ToUpper(nodes[j].token.text)] {
+				literal += " " + nodes[j].token.value
+				j++
+			}
+		case nodes[i].isString() && i+2 < len(nodes) && nodes[i+1].isOperator("::") && nodes[i+2].isKeyword("INTERVAL"):
+			literal, j = nodes[i].token.value, i+3
+		default:
+			continue
+		}
+		interval, _ := parseInterval(literal)
+		node := &sqlNode{token: nodes[i].token, start: nodes[i].start, end: nodes[j-1].end, interval: interval, isInterval: true}
+		nodes = append(nodes[:i:i], append([]*sqlNode{node}, nodes[j:]...)...)
+	}
+	return nodes, nil
+}
+
+func (t *dialectTranslator) translateFunctions(nodes []*sqlNode) ([]*sqlNode, error) {
+	for i := 0; i+1 < len(nodes); i++ {
+		if !nodes[i+1].group || !nodes[i].isLeaf() || nodes[i].token.kind != sqlIdentifier || i > 0 && nodes[i-1].isOperator(".") {
+			continue
+		}
+		var err error
+		switch nodes[i].token.value {
+		case "string_agg":
+			nodes, err = t.translateStringAgg(nodes, i)
+		case "date_trunc":
+			nodes, err = t.translateDateTrunc(nodes, i)
+		case "to_char":
+			nodes, err = t.translateToChar(nodes, i)
+		case "extract":
+			nodes, err = t.translateExtract(nodes, i)
+		case "generate_series":
+			nodes, err = t.translateGenerateSeries(nodes, i)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nodes, nil
+}
+
+// translateStringAgg turns string_agg(x, ',' ORDER BY y) into
+// LISTAGG(x USING PARAMETERS separator=',') WITHIN GROUP (ORDER BY y).
+func (t *dialectTranslator) translateStringAgg(nodes []*sqlNode, i int) ([]*sqlNode, error) {
+	args := nodes[i+1].children
+	var order []*sqlNode
+	for k := 0; k+1 < len(args); k++ {
+		if args[k].isKeyword("ORDER") && args[k+1].isKeyword("BY") {
+			args, order = args[:k], args[k+2:]
+			break
+		}
+	}
+	parts := splitArguments(args)
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) != 1 || !parts[1][0].isString() {
+		return nil, &dialectError{construct: "string_agg without a constant delimiter"}
+	}
+
+	text := fmt.Sprintf("LISTAGG(%s USING PARAMETERS separator=%s)", t.render(parts[0]), t.renderNode(parts[1][0]))
+	if len(order) > 0 {
+		text += " WITHIN GROUP (ORDER BY " + t.render(order) + ")"
+	}
+	return t.replace(nodes, i, i+2, text), nil
+}
+
+// translateDateTrunc truncates in the time zone given as the third
+// argument by converting to it and back.
+func (t *dialectTranslator) translateDateTrunc(nodes []*sqlNode, i int) ([]*sqlNode, error) {
+	parts := splitArguments(nodes[i+1].children)
+	switch len(parts) {
+	case 2:
+		return nodes, nil
+	case 3:
+		zone := t.render(parts[2])
+		text := fmt.Sprintf("(DATE_TRUNC(%s, (%s) AT TIME ZONE %s) AT TIME ZONE %s)", t.render(parts[0]), t.render(parts[1]), zone, zone)
+		return t.replace(nodes, i, i+2, text), nil
+	default:
+		return nil, &dialectError{construct: fmt.Sprintf("date_trunc with %d arguments", len(parts))}
+	}
+}
+
+func (t *dialectTranslator) translateToChar(nodes []*sqlNode, i int) ([]*sqlNode, error) {
+	parts := splitArguments(nodes[i+1].children)
+	if len(parts) != 2 {
+		return nodes, nil
+	}
+	if len(parts[1]) != 1 || !parts[1][0].isString() {
+		return nil, &dialectError{construct: "to_char without a constant format"}
+	}
+	format := parts[1][0].token.value
+	verticaFormat, err := verticaToCharFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	if verticaFormat == format {
+		return nodes, nil
+	}
+	return t.replace(nodes, i, i+2, fmt.Sprintf("TO_CHAR(%s, %s)", t.render(parts[0]), quoteLiteral(verticaFormat))), nil
+}
+
+// verticaToCharFormat converts the PostgreSQL to_char template patterns
+// Vertica spells differently.
+func verticaToCharFormat(format string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(format); {
+		rest := format[i:]
+		switch {
+		case rest[0] == '"':
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				b.WriteString(rest)
+				return b.String(), nil
+			}
+			b.WriteString(rest[:end+2])
+			i += end + 2
+		case rest[0] == '\\' && len(rest) > 1:
+			b.WriteString(rest[:2])
+			i += 2
+		case strings.HasPrefix(rest, "TZH"), strings.HasPrefix(rest, "TZM"):
+			return "", &dialectError{construct: "to_char pattern " + rest[:3]}
+		case strings.HasPrefix(rest, "OF"):
+			return "", &dialectError{construct: "to_char pattern OF"}
+		case strings.HasPrefix(rest, "SSSSS"):
+			b.WriteString("SSSS")
+			i += 5
+		case strings.HasPrefix(rest, "SSSS"):
+			b.WriteString("SSSS")
+			i += 4
+		case len(rest) >= 3 && strings.EqualFold(rest[:2], "FF") && isDigit(rest[2]):
+			switch rest[2] {
+			case '3':
+				b.WriteString("MS")
+			case '6':
+				b.WriteString("US")
+			default:
+				return "", &dialectError{construct: fmt.Sprintf("to_char pattern %s", rest[:3])}
+			}
+			i += 3
+		case len(rest) > 2 && strings.EqualFold(rest[:2], "TM") && isIdentifierStart(rest[2:]):
+			// Vertica always uses the translation mode's English names
+			i += 2
+		default:
+			b.WriteByte(rest[0])
+			i++
+		}
+	}
+	return b.String(), nil
+}
+
+func (t *dialectTranslator) translateExtract(nodes []*sqlNode, i int) ([]*sqlNode, error) {
+	args := nodes[i+1].children
+	if len(args) < 3 || !args[0].isKeyword("EPOCH") || !args[1].isKeyword("FROM") {
+		return nodes, nil
+	}
+	return t.replace(nodes, i, i+2, fmt.Sprintf("DATE_PART('epoch', %s)", t.render(args[2:]))), nil
+}
+
+// translateGenerateSeries turns generate_series in a FROM clause into a
+// subquery filling the gaps between its bounds with TIMESERIES. Integer
+// series are built from a series of seconds. The bounds are filtered out
+// when stop is before start, TIMESERIES would sort them and fill the gap
+// where Postgres returns no rows.
+func (t *dialectTranslator) translateGenerateSeries(nodes []*sqlNode, i int) ([]*sqlNode, error) {
+	if !inFromClause(nodes, i) {
+		return nil, &dialectError{construct: "generate_series outside a FROM clause"}
+	}
+	parts := splitArguments(nodes[i+1].children)
+	if len(parts) != 2 && len(parts) != 3 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return nil, &dialectError{construct: fmt.Sprintf("generate_series with %d arguments", len(parts))}
+	}
+	start, stop := t.render(parts[0]), t.render(parts[1])
+
+	j := i + 2
+	alias, column := "generate_series", "generate_series"
+	if k := j; k < len(nodes) {
+		if nodes[k].isKeyword("AS") {
+			k++
+		}
+		if k < len(nodes) && nodes[k].isName() {
+			alias, column = t.renderNode(nodes[k]), t.renderNode(nodes[k])
+			j = k + 1
+			if j < len(nodes) && nodes[j].group {
+				columns := splitArguments(nodes[j].children)
+				if len(columns) != 1 || len(columns[0]) != 1 {
+					return nil, &dialectError{construct: "generate_series with several column aliases"}
+				}
+				column = t.renderNode(columns[0][0])
+				j++
+			}
+		}
+	}
+
+	var series string
+	switch {
+	case len(parts) == 3 && len(parts[2]) == 1 && parts[2][0].isInterval:
+		slice, err := timeseriesSlice(parts[2][0].interval)
+		if err != nil {
+			return nil, err
+		}
+		series = fmt.Sprintf("(SELECT pgvertica_slice AS %s FROM (SELECT (%s)::TIMESTAMP AS pgvertica_bound UNION ALL SELECT (%s)::TIMESTAMP) pgvertica_bounds WHERE (%s)::TIMESTAMP >= (%s)::TIMESTAMP TIMESERIES pgvertica_slice AS '%s' OVER (ORDER BY pgvertica_bound)) AS %s",
+			column, start, stop, stop, start, slice, alias)
+	case len(parts) == 2 || len(parts[2]) == 1 && isPositiveInteger(parts[2][0]):
+		step := "1"
+		if len(parts) == 3 {
+			step = parts[2][0].token.text
+		}
+		series = fmt.Sprintf("(SELECT (%s) + DATEDIFF('second', '2000-01-01'::TIMESTAMP, pgvertica_slice) AS %s FROM (SELECT '2000-01-01'::TIMESTAMP AS pgvertica_bound UNION ALL SELECT TIMESTAMPADD('second', (%s) - (%s), '2000-01-01'::TIMESTAMP)) pgvertica_bounds WHERE (%s) >= (%s) TIMESERIES pgvertica_slice AS '%s seconds' OVER (ORDER BY pgvertica_bound)) AS %s",
+			start, column, stop, start, stop, start, step, alias)
+	default:
+		return nil, &dialectError{construct: "generate_series without a constant positive step"}
+	}
+	return t.replace(nodes, i, j, series), nil
+}
+
+// inFromClause reports whether nodes[i] is in the FROM clause of its
+// SELECT.
+func inFromClause(nodes []*sqlNode, i int) bool {
+	for k := i - 1; k >= 0; k-- {
+		switch {
+		case nodes[k].isKeyword("FROM"), nodes[k].isKeyword("JOIN"):
+			return true
+		case nodes[k].isKeyword("SELECT"), nodes[k].isKeyword("WHERE"), nodes[k].isKeyword("ON"):
+			return false
+		}
+	}
+	return false
+}
+
+func isPositiveInteger(node *sqlNode) bool {
+	if !node.isLeaf() || node.token.kind != sqlNumber {
+		return false
+	}
+	n, err := strconv.Atoi(node.token.text)
+	return err == nil && n > 0
+}
+
+// translateIntervalArithmetic turns adding an interval literal to a date
+// or a timestamp into TIMESTAMPADD calls, one per unit of the interval.
+func (t *dialectTranslator) translateIntervalArithmetic(nodes []*sqlNode) ([]*sqlNode, error) {
+	for i := 1; i < len(nodes); i++ {
+		if !nodes[i].isOperator("+") && !nodes[i].isOperator("-") {
+			continue
+		}
+		switch {
+		case i+1 < len(nodes) && nodes[i+1].isInterval:
+			s, ok := leftOperandStart(nodes, i, additivePrecedence)
+			if !ok || s == i-1 && nodes[s].isInterval {
+				continue
+			}
+			if next := i + 2; next < len(nodes) && nodes[next].isBinaryOperator() && operatorPrecedence(nodes[next].token.text) > additivePrecedence {
+				return nil, &dialectError{construct: "interval arithmetic with " + nodes[next].token.text}
+			}
+			text, err := t.timestampAdd(t.render(nodes[s:i]), nodes[i+1], nodes[i].isOperator("-"))
+			if err != nil {
+				return nil, err
+			}
+			nodes = t.replace(nodes, s, i+2, text)
+			i = s
+		case nodes[i-1].isInterval && nodes[i].isOperator("+"):
+			if i >= 2 && nodes[i-2].isBinaryOperator() {
+				return nil, &dialectError{construct: "interval arithmetic with " + nodes[i-2].token.text}
+			}
+			e, ok := rightOperandEnd(nodes, i, additivePrecedence)
+			if !ok || e == i+2 && nodes[i+1].isInterval {
+				continue
+			}
+			text, err := t.timestampAdd(t.render(nodes[i+1:e]), nodes[i-1], false)
+			if err != nil {
+				return nil, err
+			}
+			nodes = t.replace(nodes, i-1, e, text)
+			i--
+		}
+	}
+	return nodes, nil
+}
+
+func (t *dialectTranslator) timestampAdd(operand string, interval *sqlNode, subtract bool) (string, error) {
+	if interval.interval == nil {
+		return "", &dialectError{construct: "interval " + t.renderNode(interval)}
+	}
+	text := operand
+	for _, part := range interval.interval {
+		amount := part.amount
+		if subtract {
+			amount = -amount
+		}
+		text = fmt.Sprintf("TIMESTAMPADD('%s', %d, %s)", part.unit, amount, text)
+	}
+	return text, nil
+}
+
+// translateRegexOperators turns the ~, ~*, !~ and !~* operators into
+// REGEXP_LIKE calls.
+func (t *dialectTranslator) translateRegexOperators(nodes []*sqlNode) ([]*sqlNode, error) {
+	for i := 0; i < len(nodes); i++ {
+		if !nodes[i].isLeaf() || nodes[i].token.kind != sqlOperator {
+			continue
+		}
+		operator := nodes[i].token.text
+		if operator != "~" && operator != "~*" && operator != "!~" && operator != "!~*" {
+			continue
+		}
+		s, ok := leftOperandStart(nodes, i, otherPrecedence)
+		if !ok {
+			continue // the bitwise not
+		}
+		e, ok := rightOperandEnd(nodes, i, otherPrecedence)
+		if !ok {
+			return nil, &dialectError{construct: fmt.Sprintf("operator %s without a right operand", operator)}
+		}
+
+		text := fmt.Sprintf("REGEXP_LIKE(%s, %s", t.render(nodes[s:i]), t.render(nodes[i+1:e]))
+		if strings.HasSuffix(operator, "*") {
+			text += ", 'i'"
+		}
+		text += ")"
+		if strings.HasPrefix(operator, "!") {
+			text = "NOT " + text
+		}
+		nodes = t.replace(nodes, s, e, text)
+		i = s
+	}
+	return nodes, nil
+}
+
+// translateDistinctOn turns SELECT DISTINCT ON (a) ... ORDER BY b into
+// SELECT ... ORDER BY b LIMIT 1 OVER (PARTITION BY a ORDER BY b), the rows
+// kept are still sorted by b.
+func (t *dialectTranslator) translateDistinctOn(nodes []*sqlNode) ([]*sqlNode, error) {
+	for i := 1; i+2 < len(nodes); i++ {
+		if !nodes[i-1].isKeyword("SELECT") || !nodes[i].isKeyword("DISTINCT") || !nodes[i+1].isKeyword("ON") || !nodes[i+2].group {
+			continue
+		}
+		partition := t.render(nodes[i+2].children)
+
+		end, orderStart := len(nodes), -1
+		for k := i + 3; k < end; k++ {
+			switch {
+			case nodes[k].isKeyword("UNION"), nodes[k].isKeyword("INTERSECT"), nodes[k].isKeyword("EXCEPT"):
+				return nil, &dialectError{construct: "DISTINCT ON with " + strings.ToUpper(nodes[k].token.text)}
+			case nodes[k].isKeyword("LIMIT"), nodes[k].isKeyword("OFFSET"), nodes[k].isKeyword("FETCH"):
+				return nil, &dialectError{construct: "DISTINCT ON with " + strings.ToUpper(nodes[k].token.text)}
+			case nodes[k].isKeyword("ORDER") && k+1 < end && nodes[k+1].isKeyword("BY"):
+				orderStart = k
+			case nodes[k].isOperator(";"):
+				end = k
+			}
+		}
+
+		if end <= i+3 {
+			continue
+		}
+		order := partition
+		if orderStart >= 0 && orderStart+2 < end {
+			order = t.render(nodes[orderStart+2 : end])
+		}
+		over := fmt.Sprintf("LIMIT 1 OVER (PARTITION BY %s ORDER BY %s)", partition, order)
+		nodes = t.replace(nodes, end-1, end, t.renderNode(nodes[end-1])+" "+over)
+		nodes = t.replace(nodes, i, i+3, "")
+	}
+	return nodes, nil
+}
+
+func isRowKeyword(node *sqlNode) bool {
+	return node.isKeyword("ROW") || node.isKeyword("ROWS")
+}
+
+// translateLimits drops LIMIT ALL and turns OFFSET n ROWS FETCH FIRST m
+// ROWS ONLY into LIMIT m OFFSET n.
+func (t *dialectTranslator) translateLimits(nodes []*sqlNode) ([]*sqlNode, error) {
+	offset := -1
+	for i := 0; i < len(nodes); i++ {
+		switch {
+		case nodes[i].isKeyword("LIMIT") && i+1 < len(nodes) && nodes[i+1].isKeyword("ALL"):
+			nodes = t.replace(nodes, i, i+2, "")
+		case nodes[i].isKeyword("OFFSET") && i+1 < len(nodes):
+			if i+2 < len(nodes) && isRowKeyword(nodes[i+2]) {
+				nodes = t.replace(nodes, i, i+3, "OFFSET "+t.renderNode(nodes[i+1]))
+			} else {
+				nodes = append(nodes[:i:i], append([]*sqlNode{t.group(nodes[i : i+2])}, nodes[i+2:]...)...)
+			}
+			offset = i
+		case nodes[i].isKeyword("FETCH") && i+1 < len(nodes) && (nodes[i+1].isKeyword("FIRST") || nodes[i+1].isKeyword("NEXT")):
+			j, count := i+2, "1"
+			if j < len(nodes) && !isRowKeyword(nodes[j]) {
+				count = t.renderNode(nodes[j])
+				j++
+			}
+			if j >= len(nodes) || !isRowKeyword(nodes[j]) {
+				return nil, &dialectError{construct: "FETCH without ROWS"}
+			}
+			j++
+			if j >= len(nodes) || !nodes[j].isKeyword("ONLY") {
+				return nil, &dialectError{construct: "FETCH FIRST ... WITH TIES"}
+			}
+			j++
+
+			limit := "LIMIT " + count
+			if offset < 0 {
+				nodes = t.replace(nodes, i, j, limit)
+				continue
+			}
+			// Vertica expects the LIMIT before the OFFSET
+			nodes = t.replace(nodes, i, j, limit+" "+t.renderNode(nodes[offset]))
+			nodes = t.replace(nodes, offset, offset+1, "")
+			offset = -1
+		}
+	}
+	return nodes, nil
+}
+
+// group merges nodes into one translated node keeping their text.
+func (t *dialectTranslator) group(nodes []*sqlNode) *sqlNode {
+	return &sqlNode{start: nodes[0].start, end: nodes[len(nodes)-1].end, text: t.render(nodes), translated: true}
+}
+
+// intervalPart is an amount of one unit of an interval, the unit is a
+// TIMESTAMPADD datepart.
+type intervalPart struct {
+	amount int
+	unit   string
+}
+
+// intervalFields may follow the string of an SQL standard interval
+// literal, as in INTERVAL '1' DAY.
+var intervalFields = map[string]bool{
+	"YEAR": true, "MONTH": true, "DAY": true, "HOUR": true, "MINUTE": true, "SECOND": true,
+}
+
+var intervalUnits = map[string]string{
+	"microsecond": "microsecond", "microseconds": "microsecond", "us": "microsecond",
+	"millisecond": "millisecond", "milliseconds": "millisecond", "ms": "millisecond",
+	"second": "second", "seconds": "second", "sec": "second", "secs": "second", "s": "second",
+	"minute": "minute", "minutes": "minute", "min": "minute", "mins": "minute", "m": "minute",
+	"hour": "hour", "hours": "hour", "hr": "hour", "hrs": "hour", "h": "hour",
+	"day": "day", "days": "day", "d": "day",
+	"week": "week", "weeks": "week", "w": "week",
+	"month": "month", "months": "month", "mon": "month", "mons": "month",
+	"year": "year", "years": "year", "yr": "year", "yrs": "year", "y": "year",
+}
+
+// parseInterval parses the PostgreSQL interval input like '1 day 2 hours',
+// '3 mons ago' or '1 day 02:30:00'.
+func parseInterval(literal string) ([]intervalPart, error) {
+	fields := strings.Fields(strings.ToLower(literal))
+	var parts []intervalPart
+	sign := 1
+	for i := 0; i < len(fields); i++ {
+		field := fields[i]
+		switch {
+		case field == "@":
+			continue
+		case field == "ago":
+			sign = -sign
+			continue
+		case strings.Contains(field, ":"):
+			clock, err := parseIntervalClock(field)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, clock...)
+			continue
+		}
+
+		digits := len(field) - len(strings.TrimLeft(field, "+-0123456789"))
+		number, unit := field[:digits], field[digits:]
+		if unit == "" && i+1 < len(fields) {
+			i++
+			unit = fields[i]
+		}
+		amount, err := strconv.Atoi(number)
+		if err != nil {
+			return nil, fmt.Errorf("invalid interval amount %q", field)
+		}
+		verticaUnit, ok := intervalUnits[unit]
+		if !ok {
+			return nil, fmt.Errorf("invalid interval unit %q", unit)
+		}
+		parts = append(parts, intervalPart{amount: amount, unit: verticaUnit})
+	}
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("empty interval")
+	}
+	for i := range parts {
+		parts[i].amount *= sign
+	}
+	return parts, nil
+}
+
+func parseIntervalClock(field string) ([]intervalPart, error) {
+	sign := 1
+	if strings.HasPrefix(field, "-") {
+		sign, field = -1, field[1:]
+	}
+	units := []string{"hour", "minute", "second"}
+	values := strings.Split(field, ":")
+	if len(values) > len(units) {
+		return nil, fmt.Errorf("invalid interval time %q", field)
+	}
+	var parts []intervalPart
+	for i, value := range values {
+		amount, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid interval time %q", field)
+		}
+		if amount != 0 {
+			parts = append(parts, intervalPart{amount: sign * amount, unit: units[i]})
+		}
+	}
+	return parts, nil
+}
+
+var intervalUnitSeconds = map[string]int{"second": 1, "minute": 60, "hour": 3600, "day": 86400, "week": 604800}
+
+// timeseriesSlice returns the TIMESERIES slice length of an interval, which
+// must have a fixed length.
+func timeseriesSlice(interval []intervalPart) (string, error) {
+	seconds := 0
+	for _, part := range interval {
+		unitSeconds, ok := intervalUnitSeconds[part.unit]
+		if !ok {
+			return "", &dialectError{construct: "generate_series with a step in " + part.unit + "s"}
+		}
+		seconds += part.amount * unitSeconds
+	}
+	if seconds <= 0 {
+		return "", &dialectError{construct: "generate_series without a positive step"}
+	}
+	return fmt.Sprintf("%d seconds", seconds), nil
+}
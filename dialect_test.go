@@ -0,0 +1,169 @@
+package pgvertica
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTranslateToVertica(t *testing.T) {
+	testCases := []struct {
+		desc, input, expected string
+	}{
+		{
+			desc:     "untouched query keeps its formatting",
+			input:    "SELECT a,  b -- note ~ 'x'\nFROM sales.orders WHERE note = 'LIMIT ALL'",
+			expected: "SELECT a,  b -- note ~ 'x'\nFROM sales.orders WHERE note = 'LIMIT ALL'",
+		},
+		{
+			desc:     "DISTINCT ON with ORDER BY",
+			input:    "SELECT DISTINCT ON (customer_id) customer_id, total FROM sales.orders ORDER BY customer_id, created_at DESC",
+			expected: "SELECT customer_id, total FROM sales.orders ORDER BY customer_id, created_at DESC LIMIT 1 OVER (PARTITION BY customer_id ORDER BY customer_id, created_at DESC)",
+		},
+		{
+			desc:     "DISTINCT ON without ORDER BY in a subquery",
+			input:    "SELECT * FROM (SELECT DISTINCT ON (a, b) a, b, c FROM t) s",
+			expected: "SELECT * FROM (SELECT a, b, c FROM t LIMIT 1 OVER (PARTITION BY a, b ORDER BY a, b)) s",
+		},
+		{
+			desc:     "string_agg",
+			input:    "SELECT string_agg(name, ', ') FROM sales.customers",
+			expected: "SELECT LISTAGG(name USING PARAMETERS separator=', ') FROM sales.customers",
+		},
+		{
+			desc:     "string_agg with ORDER BY",
+			input:    "SELECT string_agg(DISTINCT c.name, ';' ORDER BY c.name, c.id) FROM sales.customers c",
+			expected: "SELECT LISTAGG(DISTINCT c.name USING PARAMETERS separator=';') WITHIN GROUP (ORDER BY c.name, c.id) FROM sales.customers c",
+		},
+		{
+			desc:     "regex operators",
+			input:    "SELECT * FROM t WHERE a ~ '^x' AND t.b !~* lower('Y') OR c || d ~* e",
+			expected: "SELECT * FROM t WHERE REGEXP_LIKE(a, '^x') AND NOT REGEXP_LIKE(t.b, lower('Y'), 'i') OR REGEXP_LIKE(c || d, e, 'i')",
+		},
+		{
+			desc:     "bitwise not is kept",
+			input:    "SELECT ~ flags FROM t",
+			expected: "SELECT ~ flags FROM t",
+		},
+		{
+			desc:     "EXTRACT EPOCH",
+			input:    "SELECT EXTRACT(EPOCH FROM created_at - started_at), EXTRACT(YEAR FROM created_at) FROM t",
+			expected: "SELECT DATE_PART('epoch', created_at - started_at), EXTRACT(YEAR FROM created_at) FROM t",
+		},
+		{
+			desc:     "date_trunc with time zone",
+			input:    "SELECT date_trunc('day', created_at, 'Europe/Warsaw') FROM t",
+			expected: "SELECT (DATE_TRUNC('day', (created_at) AT TIME ZONE 'Europe/Warsaw') AT TIME ZONE 'Europe/Warsaw') FROM t",
+		},
+		{
+			desc:     "date_trunc without time zone",
+			input:    "SELECT date_trunc('month', created_at) FROM t",
+			expected: "SELECT date_trunc('month', created_at) FROM t",
+		},
+		{
+			desc:     "LIMIT ALL",
+			input:    "SELECT * FROM t LIMIT ALL OFFSET 5",
+			expected: "SELECT * FROM t OFFSET 5",
+		},
+		{
+			desc:     "FETCH FIRST",
+			input:    "SELECT * FROM t ORDER BY a FETCH FIRST 10 ROWS ONLY",
+			expected: "SELECT * FROM t ORDER BY a LIMIT 10",
+		},
+		{
+			desc:     "OFFSET ROWS FETCH NEXT ROW",
+			input:    "SELECT * FROM t ORDER BY a OFFSET 20 ROWS FETCH NEXT ROW ONLY",
+			expected: "SELECT * FROM t ORDER BY a LIMIT 1 OFFSET 20",
+		},
+		{
+			desc:     "to_char",
+			input:    `SELECT to_char(created_at, 'FMDD TMMonth YYYY HH24:MI:SS.FF3 "SSSSS"') FROM t`,
+			expected: `SELECT TO_CHAR(created_at, 'FMDD Month YYYY HH24:MI:SS.MS "SSSSS"') FROM t`,
+		},
+		{
+			desc:     "to_char Vertica understands",
+			input:    "SELECT to_char(created_at, 'YYYY-MM-DD') FROM t",
+			expected: "SELECT to_char(created_at, 'YYYY-MM-DD') FROM t",
+		},
+		{
+			desc:     "interval arithmetic",
+			input:    "SELECT * FROM t WHERE created_at > now() - interval '1 day 2 hours' AND d < DATE '2024-01-01' + '1 week'::interval",
+			expected: "SELECT * FROM t WHERE created_at > TIMESTAMPADD('hour', -2, TIMESTAMPADD('day', -1, now())) AND d < TIMESTAMPADD('week', 1, DATE '2024-01-01')",
+		},
+		{
+			desc:     "interval first and SQL standard literal",
+			input:    "SELECT INTERVAL '3' MONTH + t.created_at::date FROM t",
+			expected: "SELECT TIMESTAMPADD('month', 3, t.created_at::date) FROM t",
+		},
+		{
+			desc:     "interval without arithmetic is kept",
+			input:    "SELECT interval '1 day' FROM t",
+			expected: "SELECT interval '1 day' FROM t",
+		},
+		{
+			desc:     "integer generate_series",
+			input:    "SELECT n FROM generate_series(1, 10) AS g(n)",
+			expected: "SELECT n FROM (SELECT (1) + DATEDIFF('second', '2000-01-01'::TIMESTAMP, pgvertica_slice) AS n FROM (SELECT '2000-01-01'::TIMESTAMP AS pgvertica_bound UNION ALL SELECT TIMESTAMPADD('second', (10) - (1), '2000-01-01'::TIMESTAMP)) pgvertica_bounds WHERE (10) >= (1) TIMESERIES pgvertica_slice AS '1 seconds' OVER (ORDER BY pgvertica_bound)) AS g",
+		},
+		{
+			desc:     "empty integer generate_series",
+			input:    "SELECT * FROM generate_series(5, 1, 2)",
+			expected: "SELECT * FROM (SELECT (5) + DATEDIFF('second', '2000-01-01'::TIMESTAMP, pgvertica_slice) AS generate_series FROM (SELECT '2000-01-01'::TIMESTAMP AS pgvertica_bound UNION ALL SELECT TIMESTAMPADD('second', (1) - (5), '2000-01-01'::TIMESTAMP)) pgvertica_bounds WHERE (1) >= (5) TIMESERIES pgvertica_slice AS '2 seconds' OVER (ORDER BY pgvertica_bound)) AS generate_series",
+		},
+		{
+			desc:     "timestamp generate_series",
+			input:    "SELECT day FROM generate_series('2024-01-01', '2024-01-31', interval '1 day') day",
+			expected: "SELECT day FROM (SELECT pgvertica_slice AS day FROM (SELECT ('2024-01-01')::TIMESTAMP AS pgvertica_bound UNION ALL SELECT ('2024-01-31')::TIMESTAMP) pgvertica_bounds WHERE ('2024-01-31')::TIMESTAMP >= ('2024-01-01')::TIMESTAMP TIMESERIES pgvertica_slice AS '86400 seconds' OVER (ORDER BY pgvertica_bound)) AS day",
+		},
+		{
+			desc:     "nested translations",
+			input:    "SELECT string_agg(name, ',') FROM t WHERE name ~ 'a' AND ts > now() - interval '1 hour'",
+			expected: "SELECT LISTAGG(name USING PARAMETERS separator=',') FROM t WHERE REGEXP_LIKE(name, 'a') AND ts > TIMESTAMPADD('hour', -1, now())",
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			result, err := translateToVertica(tC.input)
+			require.NoError(t, err)
+			assert.Equal(t, tC.expected, result)
+		})
+	}
+}
+
+func TestTranslateToVertica_NotSupported(t *testing.T) {
+	for _, query := range []string{
+		"SELECT string_agg(name, sep) FROM t",
+		"SELECT generate_series(1, 10)",
+		"SELECT * FROM generate_series('2024-01-01', '2024-12-01', interval '1 month')",
+		"SELECT to_char(created_at, 'HH24:MI OF') FROM t",
+		"SELECT * FROM t FETCH FIRST 5 ROWS WITH TIES",
+		"SELECT DISTINCT ON (a) a FROM t LIMIT 5",
+		"SELECT now() + interval 'soon' FROM t",
+	} {
+		_, err := translateToVertica(query)
+		var dialectErr *dialectError
+		if assert.ErrorAs(t, err, &dialectErr, query) {
+			assert.Equal(t, featureNotSupportedCode, dialectErr.errorResponse().Code)
+		}
+	}
+}
+
+func TestTranslateToVertica_Incomplete(t *testing.T) {
+	for _, query := range []string{"SELECT (", "SELECT )", "SELECT a ~", "SELECT DISTINCT ON (a", "SELECT string_agg(", "SELECT * FROM t FETCH FIRST"} {
+		assert.NotPanics(t, func() { translateToVertica(query) }, query)
+	}
+}
+
+func TestParseInterval(t *testing.T) {
+	parts, err := parseInterval("1 day 02:30:00")
+	require.NoError(t, err)
+	assert.Equal(t, []intervalPart{{1, "day"}, {2, "hour"}, {30, "minute"}}, parts)
+
+	parts, err = parseInterval("@ 3 mons ago")
+	require.NoError(t, err)
+	assert.Equal(t, []intervalPart{{-3, "month"}}, parts)
+
+	_, err = parseInterval("1.5 hours")
+	assert.Error(t, err)
+}
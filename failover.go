@@ -0,0 +1,165 @@
+package pgvertica
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// defaultHealthCheckTimeout bounds the connection attempt of a health check.
+const defaultHealthCheckTimeout = 3 * time.Second
+
+// FailoverConfig lists the other nodes of the Vertica cluster. New sessions
+// are balanced across them and the node of VerticaConnectionString, a node
+// that can't be reached is skipped until a health check finds it up again.
+type FailoverConfig struct {
+	// BackupNodes are "host:port" addresses of the other Vertica nodes.
+	BackupNodes []string
+	// HealthCheckInterval is how often the nodes are dialed, 0 disables the
+	// health checks so only failed connections mark a node down.
+	HealthCheckInterval time.Duration
+	// HealthCheckTimeout bounds a health check, it defaults to 3s.
+	HealthCheckTimeout time.Duration
+}
+
+type verticaNode struct {
+	addr    string
+	healthy bool
+}
+
+// verticaNodes balances connections across the Vertica nodes and tracks
+// which of them are up.
+type verticaNodes struct {
+	mu    sync.Mutex
+	nodes []*verticaNode
+	next  int
+
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// newVerticaNodes returns the nodes of the connection string followed by
+// the backup nodes, nil when the connection string has no host.
+func newVerticaNodes(connectionString string, backupNodes []string) *verticaNodes {
+	parsedConn, err := parseConnectionString(connectionString)
+	if err != nil {
+		return nil
+	}
+
+	var dialer net.Dialer
+	n := &verticaNodes{dial: dialer.DialContext}
+	for _, addr := range append([]string{parsedConn.url.Host}, backupNodes...) {
+		if n.find(addr) == nil {
+			n.nodes = append(n.nodes, &verticaNode{addr: addr, healthy: true})
+		}
+	}
+	return n
+}
+
+func (n *verticaNodes) find(addr string) *verticaNode {
+	for _, node := range n.nodes {
+		if node.addr == addr {
+			return node
+		}
+	}
+	return nil
+}
+
+// candidates returns the addresses a new connection tries in order: the
+// healthy nodes starting with the next one in turn, then the unhealthy ones
+// as a last resort.
+func (n *verticaNodes) candidates() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var healthy, unhealthy []string
+	for _, node := range n.nodes {
+		if node.healthy {
+			healthy = append(healthy, node.addr)
+		} else {
+			unhealthy = append(unhealthy, node.addr)
+		}
+	}
+	if len(healthy) > 0 {
+		start := n.next % len(healthy)
+		healthy = append(healthy[start:], healthy[:start]...)
+		n.next++
+	}
+	return append(healthy, unhealthy...)
+}
+
+func (n *verticaNodes) setHealthy(addr string, healthy bool, err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	node := n.find(addr)
+	if node == nil || node.healthy == healthy {
+		return
+	}
+	node.healthy = healthy
+	if healthy {
+		Logger.Info("Vertica node is up", "node", addr)
+	} else {
+		Logger.Warn("Vertica node is down", "node", addr, "error", err)
+	}
+}
+
+func (n *verticaNodes) markDown(addr string, err error) {
+	n.setHealthy(addr, false, err)
+}
+
+// check dials every node and updates its health.
+func (n *verticaNodes) check(ctx context.Context, timeout time.Duration) {
+	n.mu.Lock()
+	addrs := make([]string, 0, len(n.nodes))
+	for _, node := range n.nodes {
+		addrs = append(addrs, node.addr)
+	}
+	n.mu.Unlock()
+
+	for _, addr := range addrs {
+		dialCtx, cancel := context.WithTimeout(ctx, timeout)
+		conn, err := n.dial(dialCtx, "tcp", addr)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			n.setHealthy(addr, false, err)
+			continue
+		}
+		conn.Close()
+		n.setHealthy(addr, true, nil)
+	}
+}
+
+// watch runs the health checks until ctx is done.
+func (n *verticaNodes) watch(ctx context.Context, config FailoverConfig) {
+	timeout := config.HealthCheckTimeout
+	if timeout <= 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+
+	ticker := time.NewTicker(config.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n.check(ctx, timeout)
+		}
+	}
+}
+
+// WithHost returns the connection string pointing at another host:port,
+// e.g. a Vertica backup node.
+func WithHost(connectionString string, addr string) (string, error) {
+	u, err := url.Parse(connectionString)
+	if err != nil {
+		return "", err
+	}
+	u.Host = addr
+	return u.String(), nil
+}
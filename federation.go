@@ -0,0 +1,321 @@
+package pgvertica
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// federationBatchSize is the number of rows inserted into Vertica by a
+// single statement when a temporary table is shipped.
+const federationBatchSize = 100
+
+// tempTableChanges returns the temporary tables a statement creates, with
+// CREATE TEMP TABLE or SELECT ... INTO TEMP, and the unqualified tables it
+// drops. tokens must not contain comments.
+func tempTableChanges(tokens []sqlToken) (created, dropped []string) {
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	switch {
+	case tokens[0].isKeyword("CREATE"):
+		i := 1
+		if i < len(tokens) && (tokens[i].isKeyword("GLOBAL") || tokens[i].isKeyword("LOCAL")) {
+			i++
+		}
+		if i >= len(tokens) || !tokens[i].isKeyword("TEMP") && !tokens[i].isKeyword("TEMPORARY") {
+			return nil, nil
+		}
+		i++
+		if i >= len(tokens) || !tokens[i].isKeyword("TABLE") {
+			return nil, nil
+		}
+		i = skipKeywords(tokens, i+1, "IF", "NOT", "EXISTS")
+		if name, _ := tempTableName(tokens, i); name != "" {
+			created = append(created, name)
+		}
+	case tokens[0].isKeyword("SELECT") || tokens[0].isKeyword("WITH"):
+		for i, token := range tokens {
+			if !token.isKeyword("INTO") {
+				continue
+			}
+			i++
+			if i >= len(tokens) || !tokens[i].isKeyword("TEMP") && !tokens[i].isKeyword("TEMPORARY") {
+				return nil, nil
+			}
+			i = skipKeywords(tokens, i+1, "TABLE")
+			if name, _ := tempTableName(tokens, i); name != "" {
+				created = append(created, name)
+			}
+			break
+		}
+	case tokens[0].isKeyword("DROP"):
+		if len(tokens) < 2 || !tokens[1].isKeyword("TABLE") {
+			return nil, nil
+		}
+		i := skipKeywords(tokens, 2, "IF", "EXISTS")
+		for i < len(tokens) {
+			var name string
+			if name, i = tempTableName(tokens, i); name != "" {
+				dropped = append(dropped, name)
+			}
+			for i < len(tokens) && !tokens[i].isOperator(",") {
+				i++
+			}
+			i++
+		}
+	}
+	return created, dropped
+}
+
+// skipKeywords returns the index of the first token from i on that is not
+// one of the keywords.
+func skipKeywords(tokens []sqlToken, i int, keywords ...string) int {
+	for ; i < len(tokens); i++ {
+		if tokens[i].kind != sqlIdentifier || !contains(keywords, strings.ToUpper(tokens[i].text)) {
+			return i
+		}
+	}
+	return i
+}
+
+// tempTableName reads the table name at tokens[i], it is empty when the
+// name is qualified by another schema than pg_temp.
+func tempTableName(tokens []sqlToken, i int) (string, int) {
+	if i >= len(tokens) || !tokens[i].isName() {
+		return "", i
+	}
+	if i+2 < len(tokens) && tokens[i+1].isOperator(".") && tokens[i+2].isName() {
+		if tokens[i].value != "pg_temp" {
+			return "", i + 3
+		}
+		return tokens[i+2].value, i + 3
+	}
+	return tokens[i].value, i + 1
+}
+
+// dropsOnCommit reports whether a CREATE TEMP TABLE statement has the
+// ON COMMIT DROP clause.
+func dropsOnCommit(tokens []sqlToken) bool {
+	for i := 0; i+2 < len(tokens); i++ {
+		if tokens[i].isKeyword("ON") && tokens[i+1].isKeyword("COMMIT") && tokens[i+2].isKeyword("DROP") {
+			return true
+		}
+	}
+	return false
+}
+
+// transactionEnd returns COMMIT or ROLLBACK for a statement ending the
+// transaction that way, DISCARD for one dropping the temporary tables of
+// the session, and "" for other statements.
+func transactionEnd(tokens []sqlToken) string {
+	if len(tokens) == 0 {
+		return ""
+	}
+	switch {
+	case tokens[0].isKeyword("COMMIT") || tokens[0].isKeyword("END"):
+		return "COMMIT"
+	case tokens[0].isKeyword("ROLLBACK") || tokens[0].isKeyword("ABORT"):
+		i := skipKeywords(tokens, 1, "WORK", "TRANSACTION")
+		if i < len(tokens) && tokens[i].isKeyword("TO") {
+			return "" // ROLLBACK TO SAVEPOINT
+		}
+		return "ROLLBACK"
+	case tokens[0].isKeyword("DISCARD"):
+		if len(tokens) > 1 && (tokens[1].isKeyword("ALL") || tokens[1].isKeyword("TEMP") || tokens[1].isKeyword("TEMPORARY")) {
+			return "DISCARD"
+		}
+	}
+	return ""
+}
+
+// trackTempTables follows the temporary tables of the session after a
+// successful statement. Tables created in a transaction are forgotten when
+// it rolls back, and the ON COMMIT DROP ones when it commits, so the
+// Postgres connection is not kept for tables that no longer exist.
+func (qe *QueryExecutor) trackTempTables(query string) {
+	tokens := significantTokens(tokenizeSQL(query))
+	switch transactionEnd(tokens) {
+	case "COMMIT":
+		for _, name := range qe.onCommitDrop {
+			delete(qe.tempTables, name)
+		}
+		qe.tempTablesAtBegin, qe.onCommitDrop = nil, nil
+		return
+	case "ROLLBACK":
+		if qe.tempTablesAtBegin != nil {
+			qe.tempTables = qe.tempTablesAtBegin
+		}
+		qe.tempTablesAtBegin, qe.onCommitDrop = nil, nil
+		return
+	case "DISCARD":
+		qe.tempTables = make(map[string]struct{})
+		qe.tempTablesAtBegin, qe.onCommitDrop = nil, nil
+		return
+	}
+	if qe.queryUtil.isBeginQuery(query) && !qe.inTransaction {
+		qe.tempTablesAtBegin = make(map[string]struct{}, len(qe.tempTables))
+		for name := range qe.tempTables {
+			qe.tempTablesAtBegin[name] = struct{}{}
+		}
+		return
+	}
+
+	created, dropped := tempTableChanges(tokens)
+	if created == nil && dropped == nil {
+		return
+	}
+	if qe.tempTables == nil {
+		qe.tempTables = make(map[string]struct{})
+	}
+	if created != nil && dropsOnCommit(tokens) {
+		if !qe.inTransaction {
+			return // dropped as soon as the statement commits
+		}
+		qe.onCommitDrop = append(qe.onCommitDrop, created...)
+	}
+	for _, name := range created {
+		qe.tempTables[name] = struct{}{}
+	}
+	for _, name := range dropped {
+		delete(qe.tempTables, name)
+	}
+}
+
+// referencedTempTables returns the temporary tables of the session the
+// query references without schema.
+func (qe *QueryExecutor) referencedTempTables(query string) []string {
+	var tables []string
+	for _, relation := range referencedRelations(significantTokens(tokenizeSQL(query))) {
+		if _, ok := qe.tempTables[relation.name]; ok && relation.schema == "" && !contains(tables, relation.name) {
+			tables = append(tables, relation.name)
+		}
+	}
+	return tables
+}
+
+// shipTempTables copies the temporary tables of the session a query sent
+// to Vertica references into Vertica local temporary tables of the same
+// names, so the whole query runs on Vertica. They are dropped before the
+// Vertica connection goes back to the pool.
+func (qe *QueryExecutor) shipTempTables(query string) error {
+	if qe.federationMaxRows <= 0 || len(qe.tempTables) == 0 {
+		return nil
+	}
+	tables := qe.referencedTempTables(query)
+	if len(tables) == 0 {
+		return nil
+	}
+
+	pgconn, err := qe.conn.pglease.acquire(qe.ctx, qe.conn.pgdb)
+	if err != nil {
+		return err
+	}
+	vconn, err := qe.conn.vlease.acquire(qe.ctx, qe.conn.vdb)
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		Logger.Info("Ship temporary table to vertica", "table", table)
+		qe.conn.vlease.cleanupOnRelease("DROP TABLE IF EXISTS " + quoteIdentifier(table))
+		if err := shipTempTable(qe.ctx, pgconn, vconn, table, qe.federationMaxRows); err != nil {
+			return fmt.Errorf("ship temporary table %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// shipTempTable replaces the Vertica local temporary table with the rows of
+// the Postgres temporary table of the same name.
+func shipTempTable(ctx context.Context, pgconn, vconn *sql.Conn, table string, maxRows int) error {
+	rows, err := pgconn.QueryContext(ctx, fmt.Sprintf("SELECT * FROM pg_temp.%s LIMIT %d", quoteIdentifier(table), maxRows+1))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	cols, err := rows.ColumnTypes()
+	if err != nil {
+		return fmt.Errorf("column types: %w", err)
+	}
+	var values [][]any
+	for rows.Next() {
+		row := make([]any, len(cols))
+		pointers := make([]any, len(cols))
+		for i := range row {
+			pointers[i] = &row[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return fmt.Errorf("scan: %w", err)
+		}
+		for i, value := range row {
+			if b, ok := value.([]byte); ok {
+				row[i] = string(b)
+			}
+		}
+		values = append(values, row)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(values) > maxRows {
+		return fmt.Errorf("more than %d rows", maxRows)
+	}
+
+	definitions := make([]string, len(cols))
+	casts := make([]string, len(cols))
+	for i, col := range cols {
+		definitions[i] = quoteIdentifier(col.Name()) + " " + verticaColumnType(col)
+		casts[i] = "?::" + verticaColumnType(col)
+	}
+	if _, err := vconn.ExecContext(ctx, "DROP TABLE IF EXISTS "+quoteIdentifier(table)); err != nil {
+		return err
+	}
+	create := fmt.Sprintf("CREATE LOCAL TEMPORARY TABLE %s (%s) ON COMMIT PRESERVE ROWS", quoteIdentifier(table), strings.Join(definitions, ", "))
+	if _, err := vconn.ExecContext(ctx, create); err != nil {
+		return err
+	}
+
+	selectRow := "SELECT " + strings.Join(casts, ", ")
+	for start := 0; start < len(values); start += federationBatchSize {
+		end := start + federationBatchSize
+		if end > len(values) {
+			end = len(values)
+		}
+		batch := values[start:end]
+		selects := make([]string, len(batch))
+		var args []any
+		for i, row := range batch {
+			selects[i] = selectRow
+			args = append(args, row...)
+		}
+		insert := fmt.Sprintf("INSERT INTO %s %s", quoteIdentifier(table), strings.Join(selects, " UNION ALL "))
+		if _, err := vconn.ExecContext(ctx, insert, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verticaColumnType maps the type of a Postgres column to Vertica. Types
+// without a counterpart become VARCHAR holding their text form.
+func verticaColumnType(col *sql.ColumnType) string {
+	switch col.DatabaseTypeName() {
+	case "INT2", "INT4", "INT8":
+		return "INT"
+	case "FLOAT4", "FLOAT8":
+		return "FLOAT"
+	case "NUMERIC":
+		if precision, scale, ok := col.DecimalSize(); ok {
+			return fmt.Sprintf("NUMERIC(%d,%d)", precision, scale)
+		}
+		return "NUMERIC(37,15)"
+	case "BOOL":
+		return "BOOLEAN"
+	case "DATE", "TIME", "TIMESTAMP", "TIMESTAMPTZ":
+		return col.DatabaseTypeName()
+	default:
+		return "VARCHAR(65000)"
+	}
+}
@@ -0,0 +1,133 @@
+package pgvertica
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTempTableChanges(t *testing.T) {
+	testCases := []struct {
+		query            string
+		created, dropped []string
+	}{
+		{query: "CREATE TEMP TABLE top_customers (id int)", created: []string{"top_customers"}},
+		{query: "CREATE LOCAL TEMPORARY TABLE IF NOT EXISTS \"Filter\" AS SELECT 1", created: []string{"Filter"}},
+		{query: "CREATE TEMPORARY TABLE pg_temp.t (id int)", created: []string{"t"}},
+		{query: "SELECT id INTO TEMP TABLE top_n FROM sales.customers", created: []string{"top_n"}},
+		{query: "SELECT id INTO top_n FROM sales.customers"},
+		{query: "CREATE TABLE sales.t (id int)"},
+		{query: "DROP TABLE IF EXISTS a, sales.b, pg_temp.c CASCADE", dropped: []string{"a", "c"}},
+		{query: "DROP VIEW a"},
+	}
+	for _, tC := range testCases {
+		created, dropped := tempTableChanges(significantTokens(tokenizeSQL(tC.query)))
+		assert.Equal(t, tC.created, created, tC.query)
+		assert.Equal(t, tC.dropped, dropped, tC.query)
+	}
+}
+
+func TestTrackTempTables(t *testing.T) {
+	qe := newMockedQueryExecutor()
+	qe.trackTempTables("CREATE TEMP TABLE a (id int)")
+	qe.trackTempTables("CREATE TEMP TABLE b (id int)")
+	qe.trackTempTables("DROP TABLE a")
+	assert.Equal(t, map[string]struct{}{"b": {}}, qe.tempTables)
+
+	assert.Equal(t, []string{"b"}, qe.referencedTempTables("SELECT * FROM sales.orders o JOIN b ON b.id = o.id JOIN b b2 ON true"))
+	assert.Empty(t, qe.referencedTempTables("SELECT * FROM sales.b"))
+}
+
+func TestTrackTempTables_Transactions(t *testing.T) {
+	qe := newMockedQueryExecutor()
+	qe.trackTempTables("CREATE TEMP TABLE a (id int)")
+	qe.trackTempTables("CREATE TEMP TABLE gone (id int) ON COMMIT DROP")
+	assert.Equal(t, map[string]struct{}{"a": {}}, qe.tempTables)
+
+	// a rolled back transaction neither creates nor drops tables
+	qe.trackTempTables("BEGIN")
+	qe.inTransaction = true
+	qe.trackTempTables("CREATE TEMP TABLE b (id int)")
+	qe.trackTempTables("DROP TABLE a")
+	qe.trackTempTables("ROLLBACK")
+	qe.inTransaction = false
+	assert.Equal(t, map[string]struct{}{"a": {}}, qe.tempTables)
+
+	qe.trackTempTables("BEGIN")
+	qe.inTransaction = true
+	qe.trackTempTables("CREATE TEMP TABLE b (id int)")
+	qe.trackTempTables("CREATE TEMP TABLE c (id int) ON COMMIT DROP")
+	qe.trackTempTables("ROLLBACK TO SAVEPOINT s")
+	assert.Equal(t, map[string]struct{}{"a": {}, "b": {}, "c": {}}, qe.tempTables)
+	qe.trackTempTables("COMMIT")
+	qe.inTransaction = false
+	assert.Equal(t, map[string]struct{}{"a": {}, "b": {}}, qe.tempTables)
+
+	qe.trackTempTables("DISCARD ALL")
+	assert.Empty(t, qe.tempTables)
+}
+
+func TestExecuteQuery_FederatedJoin(t *testing.T) {
+	vdb, vmock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer vdb.Close()
+	pgdb, pgmock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer pgdb.Close()
+
+	qe := newMockedQueryExecutor()
+	qe.conn.vdb, qe.conn.pgdb = vdb, pgdb
+	qe.synchronizedSchemas = []string{"sales"}
+	qe.federationMaxRows = 10
+	qe.trackTempTables("CREATE TEMP TABLE top_customers (id int, name text)")
+
+	pgmock.ExpectQuery(`SELECT \* FROM pg_temp."top_customers" LIMIT 11`).WillReturnRows(
+		sqlmock.NewRowsWithColumnDefinition(
+			sqlmock.NewColumn("id").OfType("INT4", int64(0)),
+			sqlmock.NewColumn("name").OfType("TEXT", ""),
+		).AddRow(int64(1), []byte("acme")).AddRow(int64(2), []byte("initech")))
+	vmock.ExpectExec(`DROP TABLE IF EXISTS "top_customers"`).WillReturnResult(sqlmock.NewResult(0, 0))
+	vmock.ExpectExec(`CREATE LOCAL TEMPORARY TABLE "top_customers" \("id" INT, "name" VARCHAR\(65000\)\) ON COMMIT PRESERVE ROWS`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	vmock.ExpectExec(`INSERT INTO "top_customers" SELECT \?::INT, \?::VARCHAR\(65000\) UNION ALL SELECT \?::INT, \?::VARCHAR\(65000\)`).
+		WithArgs(int64(1), "acme", int64(2), "initech").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	vmock.ExpectQuery(`SELECT \* FROM sales.orders JOIN top_customers`).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	vmock.ExpectExec(`DROP TABLE IF EXISTS "top_customers"`).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	rows, err := qe.executeQuery("SELECT * FROM sales.orders JOIN top_customers USING (id)")
+	require.NoError(t, err)
+	rows.Close()
+	qe.releaseBackends()
+
+	assert.NotNil(t, qe.conn.pglease.conn, "the Postgres connection holding temporary tables is kept")
+	assert.Nil(t, qe.conn.vlease.conn)
+	assert.NoError(t, vmock.ExpectationsWereMet())
+	assert.NoError(t, pgmock.ExpectationsWereMet())
+}
+
+func TestExecuteQuery_FederatedJoinTooLarge(t *testing.T) {
+	vdb, vmock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer vdb.Close()
+	pgdb, pgmock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer pgdb.Close()
+
+	qe := newMockedQueryExecutor()
+	qe.conn.vdb, qe.conn.pgdb = vdb, pgdb
+	qe.synchronizedSchemas = []string{"sales"}
+	qe.federationMaxRows = 1
+	qe.trackTempTables("CREATE TEMP TABLE top_customers (id int)")
+
+	pgmock.ExpectQuery(`SELECT \* FROM pg_temp."top_customers" LIMIT 2`).WillReturnRows(
+		sqlmock.NewRows([]string{"id"}).AddRow(int64(1)).AddRow(int64(2)))
+
+	_, err = qe.executeQuery("SELECT * FROM sales.orders JOIN top_customers USING (id)")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "more than 1 rows")
+	assert.NoError(t, vmock.ExpectationsWereMet())
+	assert.NoError(t, pgmock.ExpectationsWereMet())
+}
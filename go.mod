@@ -6,10 +6,12 @@ require github.com/jackc/pgproto3/v2 v2.2.0
 
 require (
 	github.com/DATA-DOG/go-sqlmock v1.5.0
+	github.com/jackc/pgio v1.0.0
 	github.com/jackc/pgtype v1.10.0
 	github.com/lib/pq v1.10.8
 	github.com/stretchr/testify v1.7.0
 	github.com/vertica/vertica-sql-go v1.2.2
+	golang.org/x/crypto v0.8.0
 	golang.org/x/exp v0.0.0-20230321023759-10a507213a29
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
 )
@@ -17,7 +19,6 @@ require (
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/jackc/chunkreader/v2 v2.0.1 // indirect
-	github.com/jackc/pgio v1.0.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/objx v0.2.0 // indirect
 	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
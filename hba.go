@@ -0,0 +1,226 @@
+package pgvertica
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// AuthMethodReject is only valid in access rules and refuses the connection.
+const AuthMethodReject AuthMethod = "reject"
+
+type HBAConnType string
+
+const (
+	HBALocal     HBAConnType = "local"
+	HBAHost      HBAConnType = "host"
+	HBAHostSSL   HBAConnType = "hostssl"
+	HBAHostNoSSL HBAConnType = "hostnossl"
+)
+
+// HBARule is a single line of an access rules file modeled on pg_hba.conf:
+//
+//	TYPE  DATABASE  USER  [ADDRESS]  METHOD
+//
+// DATABASE and USER are "all" or comma separated lists of names, ADDRESS is
+// "all", an IP address or a CIDR range and is omitted for local rules.
+type HBARule struct {
+	ConnType  HBAConnType
+	Databases []string
+	Users     []string
+	Network   *net.IPNet
+	Method    AuthMethod
+	Line      int
+}
+
+// HBARules are evaluated in order; the first matching rule decides.
+type HBARules []HBARule
+
+func LoadHBAFile(path string) (HBARules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rules, err := ParseHBARules(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return rules, nil
+}
+
+func ParseHBARules(r io.Reader) (HBARules, error) {
+	var rules HBARules
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		rule, err := parseHBARule(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		rule.Line = lineNo
+		rules = append(rules, *rule)
+	}
+	return rules, scanner.Err()
+}
+
+func parseHBARule(fields []string) (*HBARule, error) {
+	rule := &HBARule{ConnType: HBAConnType(strings.ToLower(fields[0]))}
+
+	expectedFields := 5
+	switch rule.ConnType {
+	case HBALocal:
+		expectedFields = 4
+	case HBAHost, HBAHostSSL, HBAHostNoSSL:
+	default:
+		return nil, fmt.Errorf("unknown connection type: %s", fields[0])
+	}
+	if len(fields) != expectedFields {
+		return nil, fmt.Errorf("expected %d fields, got %d", expectedFields, len(fields))
+	}
+
+	rule.Databases = parseHBAList(fields[1])
+	rule.Users = parseHBAList(fields[2])
+
+	if rule.ConnType != HBALocal {
+		network, err := parseHBAAddress(fields[3])
+		if err != nil {
+			return nil, err
+		}
+		rule.Network = network
+	}
+
+	methodField := fields[len(fields)-1]
+	if AuthMethod(strings.ToLower(methodField)) == AuthMethodReject {
+		rule.Method = AuthMethodReject
+	} else {
+		method, err := ParseAuthMethod(methodField)
+		if err != nil {
+			return nil, err
+		}
+		rule.Method = method
+	}
+	return rule, nil
+}
+
+func parseHBAList(field string) []string {
+	if field == "all" {
+		return nil
+	}
+	return strings.Split(field, ",")
+}
+
+func parseHBAAddress(field string) (*net.IPNet, error) {
+	if field == "all" {
+		return nil, nil
+	}
+	if strings.Contains(field, "/") {
+		_, network, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address: %s", field)
+		}
+		return network, nil
+	}
+
+	ip := net.ParseIP(field)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address: %s", field)
+	}
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip, bits = ip.To4(), 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// Match returns the first rule matching the connection or nil when none does.
+func (rules HBARules) Match(database, user string, addr net.Addr, isTLS bool) *HBARule {
+	for i := range rules {
+		if rules[i].matches(database, user, addr, isTLS) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+func (rule *HBARule) matches(database, user string, addr net.Addr, isTLS bool) bool {
+	if !matchesHBAList(rule.Databases, database) || !matchesHBAList(rule.Users, user) {
+		return false
+	}
+
+	ip := addrIP(addr)
+	switch rule.ConnType {
+	case HBALocal:
+		return ip == nil
+	case HBAHostSSL:
+		if !isTLS {
+			return false
+		}
+	case HBAHostNoSSL:
+		if isTLS {
+			return false
+		}
+	}
+	return ip != nil && (rule.Network == nil || rule.Network.Contains(ip))
+}
+
+func matchesHBAList(list []string, name string) bool {
+	return list == nil || contains(list, name)
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.IPAddr:
+		return addr.IP
+	default:
+		return nil
+	}
+}
+
+// checkAccessRules returns the auth method the connection has to use or an
+// *AuthError when the rules refuse it. Without rules every connection may use
+// the globally configured method.
+func checkAccessRules(c *Conn, database, user string, config *ServerConfig) (AuthMethod, error) {
+	if config.AccessRules == nil {
+		return config.authMethod(), nil
+	}
+
+	encryption := "no encryption"
+	if c.isTLS() {
+		encryption = "SSL encryption"
+	}
+	host := "[local]"
+	if ip := addrIP(c.RemoteAddr()); ip != nil {
+		host = ip.String()
+	}
+
+	rule := config.AccessRules.Match(database, user, c.RemoteAddr(), c.isTLS())
+	if rule == nil {
+		return "", &AuthError{
+			Code:    invalidAuthSpecCode,
+			Message: fmt.Sprintf("no pg_hba.conf entry for host \"%s\", user \"%s\", database \"%s\", %s", host, user, database, encryption),
+		}
+	}
+	if rule.Method == AuthMethodReject {
+		return "", &AuthError{
+			Code:    invalidAuthSpecCode,
+			Message: fmt.Sprintf("pg_hba.conf rejects connection for host \"%s\", user \"%s\", database \"%s\", %s", host, user, database, encryption),
+		}
+	}
+	Logger.Debug("Access rule matched", "line", rule.Line, "method", rule.Method)
+	return rule.Method, nil
+}
@@ -0,0 +1,211 @@
+package pgvertica
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+const tooManyConnectionsCode = "53300"
+
+// Limits bounds the sessions and Vertica queries the proxy runs at once.
+// Zero values mean no limit.
+type Limits struct {
+	MaxConnections            int
+	MaxConnectionsPerUser     int
+	MaxConnectionsPerDatabase int
+	// MaxVerticaQueries limits the Vertica connections leased at once, by
+	// statements, transactions and cursors of all sessions.
+	MaxVerticaQueries int
+	// VerticaQueueSize is the number of statements waiting for a Vertica
+	// connection, further statements are rejected.
+	VerticaQueueSize int
+	// VerticaQueueTimeout rejects statements waiting for longer, 0 waits
+	// until the statement is canceled.
+	VerticaQueueTimeout time.Duration
+}
+
+// Usage reports the sessions and Vertica queries counted against Limits.
+type Usage struct {
+	Connections            int
+	ConnectionsPerUser     map[string]int
+	ConnectionsPerDatabase map[string]int
+	VerticaQueries         int
+	QueuedVerticaQueries   int
+}
+
+// limitError is returned when a limit rejects a session or a statement. It
+// is sent to the client with SQLSTATE 53300.
+type limitError struct {
+	message string
+}
+
+func (e *limitError) Error() string {
+	return e.message
+}
+
+func (e *limitError) errorResponse(severity string) *pgproto3.ErrorResponse {
+	return &pgproto3.ErrorResponse{Severity: severity, Code: tooManyConnectionsCode, Message: e.message}
+}
+
+type sessionLimits struct {
+	config Limits
+
+	mu        sync.Mutex
+	total     int
+	users     map[string]int
+	databases map[string]int
+	active    int
+	queued    int
+
+	// verticaSlots holds a token per leased Vertica connection, it is nil
+	// without MaxVerticaQueries.
+	verticaSlots chan struct{}
+}
+
+func newSessionLimits(config Limits) *sessionLimits {
+	l := &sessionLimits{
+		config:    config,
+		users:     make(map[string]int),
+		databases: make(map[string]int),
+	}
+	if config.MaxVerticaQueries > 0 {
+		l.verticaSlots = make(chan struct{}, config.MaxVerticaQueries)
+	}
+	return l
+}
+
+// admit counts a new session of the user on the database. The returned
+// function releases it when the session ends.
+func (l *sessionLimits) admit(user, database string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	switch {
+	case exceeds(l.total, l.config.MaxConnections):
+		return nil, &limitError{message: "sorry, too many clients already"}
+	case exceeds(l.users[user], l.config.MaxConnectionsPerUser):
+		return nil, &limitError{message: fmt.Sprintf("too many connections for role \"%s\"", user)}
+	case exceeds(l.databases[database], l.config.MaxConnectionsPerDatabase):
+		return nil, &limitError{message: fmt.Sprintf("too many connections for database \"%s\"", database)}
+	}
+	l.total++
+	l.users[user]++
+	l.databases[database]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			l.total--
+			decrement(l.users, user)
+			decrement(l.databases, database)
+		})
+	}, nil
+}
+
+func exceeds(count, limit int) bool {
+	return limit > 0 && count >= limit
+}
+
+func decrement(counts map[string]int, key string) {
+	if counts[key]--; counts[key] <= 0 {
+		delete(counts, key)
+	}
+}
+
+// enterVertica waits for a free Vertica slot, queueing behind other
+// statements. The returned function frees the slot.
+func (l *sessionLimits) enterVertica(ctx context.Context) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	if err := l.takeVerticaSlot(ctx); err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	l.active++
+	l.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			l.active--
+			l.mu.Unlock()
+			if l.verticaSlots != nil {
+				<-l.verticaSlots
+			}
+		})
+	}, nil
+}
+
+func (l *sessionLimits) takeVerticaSlot(ctx context.Context) error {
+	if l.verticaSlots == nil {
+		return nil
+	}
+	select {
+	case l.verticaSlots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	l.mu.Lock()
+	if l.queued >= l.config.VerticaQueueSize {
+		l.mu.Unlock()
+		return &limitError{message: "too many concurrent Vertica queries, the queue is full"}
+	}
+	l.queued++
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		l.queued--
+		l.mu.Unlock()
+	}()
+
+	var timeout <-chan time.Time
+	if l.config.VerticaQueueTimeout > 0 {
+		timer := time.NewTimer(l.config.VerticaQueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case l.verticaSlots <- struct{}{}:
+		return nil
+	case <-timeout:
+		return &limitError{message: fmt.Sprintf("timed out after %s waiting for a Vertica connection", l.config.VerticaQueueTimeout)}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *sessionLimits) usage() Usage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	usage := Usage{
+		Connections:            l.total,
+		ConnectionsPerUser:     make(map[string]int, len(l.users)),
+		ConnectionsPerDatabase: make(map[string]int, len(l.databases)),
+		VerticaQueries:         l.active,
+		QueuedVerticaQueries:   l.queued,
+	}
+	for user, count := range l.users {
+		usage.ConnectionsPerUser[user] = count
+	}
+	for database, count := range l.databases {
+		usage.ConnectionsPerDatabase[database] = count
+	}
+	return usage
+}
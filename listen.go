@@ -0,0 +1,101 @@
+package pgvertica
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ListenAddr is an address the server accepts client connections on.
+type ListenAddr struct {
+	// Network is "tcp" or "unix".
+	Network string
+	Address string
+	// Mode sets the permissions of a unix socket file, 0 keeps the default
+	// given by the umask.
+	Mode os.FileMode
+}
+
+func (a ListenAddr) String() string {
+	return a.Network + ":" + a.Address
+}
+
+// ParseListenAddr parses a TCP "host:port" address or a unix socket given
+// as "unix:/path" or an absolute path, e.g.
+// /var/run/postgresql/.s.PGSQL.5432. socketMode is the mode of unix sockets.
+func ParseListenAddr(addr string, socketMode os.FileMode) (ListenAddr, error) {
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		addr = strings.TrimPrefix(addr, "unix:")
+	case filepath.IsAbs(addr):
+	case addr == "":
+		return ListenAddr{}, fmt.Errorf("empty listen address")
+	default:
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return ListenAddr{}, fmt.Errorf("listen address %q: %w", addr, err)
+		}
+		return ListenAddr{Network: "tcp", Address: addr}, nil
+	}
+
+	if addr == "" {
+		return ListenAddr{}, fmt.Errorf("unix socket path is missing")
+	}
+	return ListenAddr{Network: "unix", Address: addr, Mode: socketMode}, nil
+}
+
+// listenAddrs returns Addr followed by the Listen addresses.
+func (config *ServerConfig) listenAddrs() []ListenAddr {
+	var addrs []ListenAddr
+	if config.Addr != "" {
+		addrs = append(addrs, ListenAddr{Network: "tcp", Address: config.Addr})
+	}
+	return append(addrs, config.Listen...)
+}
+
+func (s *Server) listenOn(addr ListenAddr) (Listener, error) {
+	if addr.Network == "unix" {
+		if err := removeStaleSocket(addr.Address); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := s.listen(addr.Network, addr.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	if addr.Network == "unix" && addr.Mode != 0 {
+		if err := os.Chmod(addr.Address, addr.Mode); err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("unix socket permissions: %w", err)
+		}
+	}
+	Logger.Info("listening", "address", addr)
+	return ln, nil
+}
+
+// removeStaleSocket removes a socket file left behind by a proxy that did
+// not shut down cleanly. A socket another process still accepts on is kept.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	Logger.Warn("Remove stale unix socket", "path", path)
+	return os.Remove(path)
+}
@@ -0,0 +1,78 @@
+package pgvertica
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseListenAddr(t *testing.T) {
+	testCases := []struct {
+		addr     string
+		expected ListenAddr
+		wantErr  bool
+	}{
+		{addr: ":5432", expected: ListenAddr{Network: "tcp", Address: ":5432"}},
+		{addr: "127.0.0.1:6432", expected: ListenAddr{Network: "tcp", Address: "127.0.0.1:6432"}},
+		{addr: "/var/run/postgresql/.s.PGSQL.5432", expected: ListenAddr{Network: "unix", Address: "/var/run/postgresql/.s.PGSQL.5432", Mode: 0770}},
+		{addr: "unix:pgvertica.sock", expected: ListenAddr{Network: "unix", Address: "pgvertica.sock", Mode: 0770}},
+		{addr: "unix:", wantErr: true},
+		{addr: "localhost", wantErr: true},
+		{addr: "", wantErr: true},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.addr, func(t *testing.T) {
+			addr, err := ParseListenAddr(tC.addr, 0770)
+			if tC.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tC.expected, addr)
+		})
+	}
+}
+
+func TestServerOpen_UnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".s.PGSQL.5432")
+	s := NewServer(&ServerConfig{
+		Addr:   "127.0.0.1:0",
+		Listen: []ListenAddr{{Network: "unix", Address: path, Mode: 0660}},
+	})
+	require.NoError(t, s.Open())
+	defer s.Close()
+
+	assert.Len(t, s.lns, 2)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0660), info.Mode().Perm())
+
+	conn, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	conn.Close()
+
+	inUse := NewServer(&ServerConfig{Listen: []ListenAddr{{Network: "unix", Address: path}}})
+	err = inUse.Open()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "in use by another process")
+}
+
+func TestServerOpen_StaleUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".s.PGSQL.5432")
+	ln, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+
+	s := NewServer(&ServerConfig{Listen: []ListenAddr{{Network: "unix", Address: path}}})
+	require.NoError(t, s.Open())
+	require.NoError(t, s.Close())
+
+	_, err = os.Stat(path)
+	assert.ErrorIs(t, err, os.ErrNotExist, "the socket is removed on close")
+}
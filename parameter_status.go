@@ -0,0 +1,163 @@
+package pgvertica
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+const defaultTimeZone = "UTC"
+
+// reportedParameters are the settings Postgres reports with ParameterStatus
+// at startup and whenever they change. Drivers such as JDBC and Npgsql read
+// them to decide how to format dates, escape strings and so on.
+var reportedParameters = []string{
+	"application_name",
+	"client_encoding",
+	"DateStyle",
+	"integer_datetimes",
+	"IntervalStyle",
+	"is_superuser",
+	"server_encoding",
+	"server_version",
+	"session_authorization",
+	"standard_conforming_strings",
+	"TimeZone",
+}
+
+// clientReportedParameters are the reported parameters a client may set in
+// its startup parameters, the others describe the server.
+var clientReportedParameters = []string{"application_name", "DateStyle", "IntervalStyle", "TimeZone"}
+
+// ParameterStatus holds ParameterStatus values sent at startup, overriding or
+// extending the defaults. Names are matched case-insensitively.
+type ParameterStatus map[string]string
+
+// ParseParameterStatus parses "name=value" pairs.
+func ParseParameterStatus(pairs []string) (ParameterStatus, error) {
+	status := make(ParameterStatus, len(pairs))
+	for _, pair := range pairs {
+		name, value, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid parameter status %q, expected name=value", pair)
+		}
+		status[canonicalParameterName(name)] = strings.TrimSpace(value)
+	}
+	return status, nil
+}
+
+// canonicalParameterName returns the spelling Postgres reports a parameter
+// with, e.g. DateStyle for datestyle.
+func canonicalParameterName(name string) string {
+	if strings.EqualFold(name, "TIME ZONE") {
+		return "TimeZone"
+	}
+	for _, reported := range reportedParameters {
+		if strings.EqualFold(reported, name) {
+			return reported
+		}
+	}
+	return name
+}
+
+func isReportedParameter(name string) bool {
+	return contains(reportedParameters, canonicalParameterName(name))
+}
+
+// startupParameterStatus returns the ParameterStatus values of a new session.
+// settings are the session settings requested by the client, user is the
+// proxy user and timeZone the time zone of the Vertica session.
+func startupParameterStatus(config *ServerConfig, settings map[string]string, user string, timeZone string) map[string]string {
+	status := map[string]string{
+		"application_name":            "",
+		"client_encoding":             "UTF8",
+		"DateStyle":                   "ISO, MDY",
+		"integer_datetimes":           "on",
+		"IntervalStyle":               "postgres",
+		"is_superuser":                "off",
+		"server_encoding":             "UTF8",
+		"server_version":              ServerVersion,
+		"session_authorization":       user,
+		"standard_conforming_strings": "on",
+		"TimeZone":                    timeZone,
+		// kept for clients relying on earlier proxy versions
+		"ApplicationName": ApplicationName,
+	}
+	for name, value := range config.ParameterStatus {
+		status[canonicalParameterName(name)] = value
+	}
+	for name, value := range settings {
+		if name = canonicalParameterName(name); contains(clientReportedParameters, name) {
+			status[name] = value
+		}
+	}
+	return status
+}
+
+func parameterStatusMessages(status map[string]string) []pgproto3.Message {
+	names := make([]string, 0, len(status))
+	for name := range status {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	messages := make([]pgproto3.Message, 0, len(names))
+	for _, name := range names {
+		messages = append(messages, &pgproto3.ParameterStatus{Name: name, Value: status[name]})
+	}
+	return messages
+}
+
+// rowQueryer is implemented by *sql.DB and *sql.Conn.
+type rowQueryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// verticaTimeZone returns the time zone of the Vertica session, falling back
+// to UTC when it can't be read.
+func verticaTimeZone(ctx context.Context, vconn rowQueryer) string {
+	var name, setting string
+	if err := vconn.QueryRowContext(ctx, "SHOW TIMEZONE").Scan(&name, &setting); err != nil || setting == "" {
+		Logger.Warn("Can't read Vertica time zone, report the default", "timezone", defaultTimeZone, "error", err)
+		return defaultTimeZone
+	}
+	return setting
+}
+
+var setTimeZoneRegexp = regexp.MustCompile(`(?is)^SET\s+(?:SESSION\s+|LOCAL\s+)?TIME\s+ZONE\s+(.+?)\s*;?$`)
+
+// setQueryParameterStatus returns the ParameterStatus to report after a
+// successful SET query, or nil when the parameter is not reported. DEFAULT
+// resets the value sent at startup.
+func setQueryParameterStatus(query string, startupStatus map[string]string) *pgproto3.ParameterStatus {
+	param, value, err := parseSetStatement(query)
+	if err != nil {
+		Logger.Warn("Error parsing set query", "query", query, "error", err)
+		return nil
+	}
+
+	if !isReportedParameter(param) {
+		return nil
+	}
+	param = canonicalParameterName(param)
+	if strings.EqualFold(value, "DEFAULT") || strings.EqualFold(value, "LOCAL") {
+		value = startupStatus[param]
+	}
+	return &pgproto3.ParameterStatus{Name: param, Value: value}
+}
+
+// parseSetStatement returns the parameter and the value of a SET query,
+// including the SET TIME ZONE form.
+func parseSetStatement(query string) (string, string, error) {
+	query = strings.TrimSpace(query)
+	if matches := setTimeZoneRegexp.FindStringSubmatch(query); matches != nil {
+		return "TimeZone", strings.Trim(matches[1], " '\""), nil
+	}
+	return parseSetQuery(query)
+}
@@ -0,0 +1,120 @@
+package pgvertica
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writtenParameterStatus decodes the ParameterStatus messages written to a
+// connection, in order.
+func writtenParameterStatus(written []byte) [][2]string {
+	frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(bytes.NewReader(written)), nil)
+	var status [][2]string
+	for {
+		msg, err := frontend.Receive()
+		if err != nil {
+			return status
+		}
+		if msg, ok := msg.(*pgproto3.ParameterStatus); ok {
+			status = append(status, [2]string{msg.Name, msg.Value})
+		}
+	}
+}
+
+func TestParseParameterStatus(t *testing.T) {
+	status, err := ParseParameterStatus([]string{"datestyle=ISO, DMY", "is_superuser = on", "custom=1"})
+	require.NoError(t, err)
+	assert.Equal(t, ParameterStatus{"DateStyle": "ISO, DMY", "is_superuser": "on", "custom": "1"}, status)
+
+	_, err = ParseParameterStatus([]string{"DateStyle"})
+	assert.Error(t, err)
+}
+
+func TestStartupParameterStatus(t *testing.T) {
+	config := &ServerConfig{ParameterStatus: ParameterStatus{"DateStyle": "ISO, DMY", "timezone": "ignored"}}
+
+	status := startupParameterStatus(config, map[string]string{"application_name": "PowerBI"}, "alice", "Europe/Warsaw")
+
+	assert.Equal(t, "PowerBI", status["application_name"])
+	assert.Equal(t, "ISO, DMY", status["DateStyle"])
+	assert.Equal(t, "ignored", status["TimeZone"], "configured values win over the Vertica time zone")
+	assert.Equal(t, "alice", status["session_authorization"])
+	assert.Equal(t, "on", status["standard_conforming_strings"])
+	for _, name := range reportedParameters {
+		assert.Contains(t, status, name)
+	}
+}
+
+func TestVerticaTimeZone(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectQuery("SHOW TIMEZONE").WillReturnRows(sqlmock.NewRows([]string{"name", "setting"}).AddRow("timezone", "America/New_York"))
+	assert.Equal(t, "America/New_York", verticaTimeZone(context.Background(), db))
+
+	mock.ExpectQuery("SHOW TIMEZONE").WillReturnError(assert.AnError)
+	assert.Equal(t, defaultTimeZone, verticaTimeZone(context.Background(), db))
+}
+
+func TestSetQueryParameterStatus(t *testing.T) {
+	startupStatus := map[string]string{"TimeZone": "UTC", "DateStyle": "ISO, MDY"}
+	testCases := []struct {
+		query    string
+		expected *pgproto3.ParameterStatus
+	}{
+		{query: "SET datestyle TO 'ISO, DMY'", expected: &pgproto3.ParameterStatus{Name: "DateStyle", Value: "ISO, DMY"}},
+		{query: "set application_name = 'Tableau';", expected: &pgproto3.ParameterStatus{Name: "application_name", Value: "Tableau"}},
+		{query: "SET SESSION TIME ZONE 'Europe/Warsaw'", expected: &pgproto3.ParameterStatus{Name: "TimeZone", Value: "Europe/Warsaw"}},
+		{query: "SET TimeZone TO DEFAULT", expected: &pgproto3.ParameterStatus{Name: "TimeZone", Value: "UTC"}},
+		{query: "SET extra_float_digits = 3", expected: nil},
+		{query: "SET garbage", expected: nil},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.query, func(t *testing.T) {
+			assert.Equal(t, tC.expected, setQueryParameterStatus(tC.query, startupStatus))
+		})
+	}
+}
+
+func TestHandleQueryMessage_SetReportsParameterStatus(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	mockConn := &MockConn{}
+	qe := newMockedQueryExecutor()
+	qe.conn.pgdb = db
+	qe.conn.vdb = db
+	qe.mb = newMessagesBuffer(mockConn)
+
+	mock.ExpectQuery("SET application_name").WillReturnRows(sqlmock.NewRows(nil))
+	require.NoError(t, qe.handleQueryMessage(&pgproto3.Query{String: "SET application_name = 'Superset'"}))
+
+	assert.Equal(t, [][2]string{{"application_name", "Superset"}}, writtenParameterStatus(mockConn.buf.Bytes()))
+}
+
+func TestHandleExecute_SetReportsParameterStatus(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	mockConn := &MockConn{}
+	qe := newMockedQueryExecutor()
+	qe.conn.pgdb = db
+	qe.conn.vdb = db
+	qe.mb = newMessagesBuffer(mockConn)
+
+	mock.ExpectPrepare("SET DateStyle").ExpectQuery().WillReturnRows(sqlmock.NewRows(nil))
+	require.NoError(t, qe.handleExecute(&Portal{statement: &PreparedStatement{query: "SET DateStyle = 'ISO, DMY'"}}, 0))
+	require.NoError(t, qe.mb.sendQueuedMessages())
+
+	assert.Equal(t, [][2]string{{"DateStyle", "ISO, DMY"}}, writtenParameterStatus(mockConn.buf.Bytes()))
+}
@@ -0,0 +1,309 @@
+package pgvertica
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resetTimeout bounds the statements cleaning up a connection returned to its pool.
+const resetTimeout = 5 * time.Second
+
+// PoolConfig configures the Vertica and Postgres pools shared by client sessions.
+type PoolConfig struct {
+	// MaxOpen limits the connections of a pool, 0 means no limit.
+	MaxOpen int
+	// MaxIdle is the number of idle connections a pool keeps.
+	MaxIdle int
+	// IdleTimeout closes connections idle for longer, 0 keeps them open.
+	IdleTimeout time.Duration
+}
+
+type poolKey struct {
+	driverName      string
+	user            string
+	database        string
+	credentialsHash string
+}
+
+func newPoolKey(driverName, dataSourceName string) poolKey {
+	key := poolKey{driverName: driverName}
+	if parsedConn, err := parseConnectionString(dataSourceName); err == nil {
+		key.user = parsedConn.url.User.Username()
+		key.database = strings.ReplaceAll(parsedConn.url.Path, "/", "")
+	}
+	// the whole connection string is hashed so its password is not kept around
+	sum := sha256.Sum256([]byte(dataSourceName))
+	key.credentialsHash = hex.EncodeToString(sum[:])
+	return key
+}
+
+// BackendPools is a DBOpener sharing one *sql.DB between all sessions that
+// connect with the same user, database and credentials. Sessions must not
+// close the databases it opens, Close does it when the server stops.
+type BackendPools struct {
+	mu     sync.Mutex
+	config PoolConfig
+	opener DBOpener
+	pools  map[poolKey]*sql.DB
+}
+
+func NewBackendPools(config PoolConfig) *BackendPools {
+	return &BackendPools{
+		config: config,
+		opener: RealDBOpener{},
+		pools:  make(map[poolKey]*sql.DB),
+	}
+}
+
+// Open returns the pool of the connection string, opening it on first use.
+// A new pool is only kept once it connected, so wrong credentials never
+// leave a pool behind.
+func (p *BackendPools) Open(driverName, dataSourceName string) (*sql.DB, error) {
+	key := newPoolKey(driverName, dataSourceName)
+
+	p.mu.Lock()
+	db, ok := p.pools[key]
+	p.mu.Unlock()
+	if ok {
+		return db, nil
+	}
+
+	db, err := p.opener.Open(driverName, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(p.config.MaxOpen)
+	db.SetMaxIdleConns(p.config.MaxIdle)
+	db.SetConnMaxIdleTime(p.config.IdleTimeout)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// another session may have opened the same pool meanwhile
+	if existing, ok := p.pools[key]; ok {
+		db.Close()
+		return existing, nil
+	}
+	p.pools[key] = db
+	Logger.Info("Opened backend pool", "driver", driverName, "user", key.user, "database", key.database)
+	return db, nil
+}
+
+// Close closes every pool.
+func (p *BackendPools) Close() (err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key, db := range p.pools {
+		if e := db.Close(); err == nil {
+			err = e
+		}
+		delete(p.pools, key)
+	}
+	return err
+}
+
+// backendLease is the connection a session holds from a pool. Statements
+// lease a connection that goes back to the pool once they complete, unless
+// a transaction or a cursor keeps it.
+type backendLease struct {
+	// setup restores the session state on a leased connection and reset
+	// clears the state other sessions left on it. Both only run when the
+	// lease lands on a connection it did not set up last.
+	setup []string
+	reset []string
+	// limits queues the lease behind other sessions, nil means no limit.
+	limits *sessionLimits
+
+	owner *leaseOwner
+	conn  *sql.Conn
+	stmts []*sql.Stmt
+	leave func()
+	// cleanup undoes what the session left on the leased connection, like
+	// temporary tables, before it is returned.
+	cleanup []string
+}
+
+func (l *backendLease) acquire(ctx context.Context, db *sql.DB) (*sql.Conn, error) {
+	if l.conn != nil {
+		return l.conn, nil
+	}
+
+	leave, err := l.limits.enterVertica(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		leave()
+		return nil, err
+	}
+	if err := l.setupConn(ctx, conn); err != nil {
+		discardConn(conn)
+		leave()
+		return nil, err
+	}
+	l.conn, l.leave = conn, leave
+	return conn, nil
+}
+
+// setupConn brings a connection leased from the pool to the session state,
+// unless it still has the state this lease left on it. Connections of
+// databases not opened with openStateDB may carry any state.
+func (l *backendLease) setupConn(ctx context.Context, conn *sql.Conn) error {
+	if l.owner == nil {
+		l.owner = new(leaseOwner)
+	}
+	setup := strings.Join(l.setup, ";\n")
+	var state connState
+	known := false
+	if tracked := leasedConnState(conn); tracked != nil {
+		state, known = tracked.state, tracked.known
+	}
+	if known && state.setup == setup && (state.owner == l.owner || setup == "") {
+		return nil
+	}
+
+	if !known || state.setup != "" {
+		for _, statement := range l.reset {
+			Logger.Debug("Reset pooled connection", "statement", statement)
+			if _, err := conn.ExecContext(ctx, statement); err != nil {
+				return fmt.Errorf("session reset %s: %w", statement, err)
+			}
+		}
+	}
+	for _, statement := range l.setup {
+		Logger.Debug("Apply session setting", "statement", statement)
+		if _, err := conn.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("session setting %s: %w", statement, err)
+		}
+	}
+	return nil
+}
+
+func (l *backendLease) query(ctx context.Context, db *sql.DB, query string) (*sql.Rows, error) {
+	conn, err := l.acquire(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	return conn.QueryContext(ctx, query)
+}
+
+// prepare prepares a statement on the leased connection, it is closed when
+// the lease ends.
+func (l *backendLease) prepare(ctx context.Context, db *sql.DB, query string) (*sql.Stmt, error) {
+	conn, err := l.acquire(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	stmt, err := conn.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	l.stmts = append(l.stmts, stmt)
+	return stmt, nil
+}
+
+// remember adds a statement to the setup, so connections leased later get
+// the state it changed. Earlier statements setting the same parameter are
+// dropped.
+func (l *backendLease) remember(statement string, reset []string) {
+	key := setStatementKey(statement)
+	setup := l.setup[:0:0]
+	for _, s := range l.setup {
+		if key == "" || setStatementKey(s) != key {
+			setup = append(setup, s)
+		}
+	}
+	l.setup = append(setup, statement)
+	if len(l.reset) == 0 {
+		l.reset = reset
+	}
+}
+
+// forget drops the setup statements setting the parameter.
+func (l *backendLease) forget(param string) {
+	setup := l.setup[:0:0]
+	for _, s := range l.setup {
+		if setStatementKey(s) != param {
+			setup = append(setup, s)
+		}
+	}
+	l.setup = setup
+}
+
+// cleanupOnRelease runs the statement on the leased connection once,
+// before it goes back to the pool.
+func (l *backendLease) cleanupOnRelease(statement string) {
+	if !contains(l.cleanup, statement) {
+		l.cleanup = append(l.cleanup, statement)
+	}
+}
+
+// release returns the leased connection to the pool with the session state
+// left on it, so the next statement of the session landing on it needs no
+// setup. A connection that can't be cleaned up is discarded.
+func (l *backendLease) release() {
+	if l.conn == nil {
+		return
+	}
+	l.closeStatements()
+
+	ctx, cancel := context.WithTimeout(context.Background(), resetTimeout)
+	defer cancel()
+	cleanup := l.cleanup
+	l.cleanup = nil
+	for _, statement := range cleanup {
+		if _, err := l.conn.ExecContext(ctx, statement); err != nil {
+			Logger.Warn("Can't clean up pooled connection, discard it", "statement", statement, "error", err)
+			l.discard()
+			return
+		}
+	}
+
+	if tracked := leasedConnState(l.conn); tracked != nil {
+		tracked.state, tracked.known = connState{owner: l.owner, setup: strings.Join(l.setup, ";\n")}, true
+	}
+	if err := l.conn.Close(); err != nil {
+		Logger.Warn("Can't return connection to pool", "error", err)
+	}
+	l.conn = nil
+	l.leave()
+}
+
+// discard closes the leased connection instead of returning it, e.g. when
+// the session ends in the middle of a transaction.
+func (l *backendLease) discard() {
+	if l.conn == nil {
+		return
+	}
+	l.closeStatements()
+	l.cleanup = nil
+	discardConn(l.conn)
+	l.conn = nil
+	l.leave()
+}
+
+func (l *backendLease) closeStatements() {
+	for _, stmt := range l.stmts {
+		stmt.Close()
+	}
+	l.stmts = nil
+}
+
+// discardConn closes the driver connection of conn, so the pool does not
+// reuse it.
+func discardConn(conn *sql.Conn) {
+	conn.Raw(func(any) error { return driver.ErrBadConn })
+	conn.Close()
+}
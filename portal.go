@@ -0,0 +1,61 @@
+package pgvertica
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+const (
+	invalidSQLStatementNameCode    = "26000"
+	invalidCursorNameCode          = "34000"
+	duplicatePreparedStatementCode = "42P05"
+	duplicateCursorCode            = "42P03"
+)
+
+// Portal is a prepared statement bound to parameter values by a Bind
+// message, ready to be executed.
+type Portal struct {
+	name      string
+	statement *PreparedStatement
+	binds     []interface{}
+	// rows and cols are set while the portal is suspended, after an
+	// Execute sent the number of rows it asked for.
+	rows *sql.Rows
+	cols []*sql.ColumnType
+	// done is set once the portal ran to completion, like Postgres it is
+	// not run again by a later Execute.
+	done bool
+}
+
+func newPortal(name string, statement *PreparedStatement, msg *pgproto3.Bind) (*Portal, error) {
+	binds, err := statement.bindParameters(*msg)
+	if err != nil {
+		return nil, &extendedQueryError{code: invalidParameterValueCode, message: fmt.Sprintf("invalid parameter value: %v", err)}
+	}
+	return &Portal{name: name, statement: statement, binds: binds}, nil
+}
+
+// close closes the rows of a suspended portal.
+func (p *Portal) close() {
+	if p.rows != nil {
+		p.rows.Close()
+		p.rows, p.cols = nil, nil
+	}
+}
+
+// extendedQueryError is returned for a message of the extended query
+// protocol referring to a statement or portal it can't use.
+type extendedQueryError struct {
+	code    string
+	message string
+}
+
+func (e *extendedQueryError) Error() string {
+	return e.message
+}
+
+func (e *extendedQueryError) errorResponse() *pgproto3.ErrorResponse {
+	return &pgproto3.ErrorResponse{Severity: "ERROR", Code: e.code, Message: e.message}
+}
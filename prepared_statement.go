@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"math"
+	"strconv"
 	"strings"
 
 	"github.com/jackc/pgproto3/v2"
@@ -14,42 +15,53 @@ type PreparedStatement struct {
 	name          string
 	query         string
 	parameterOIDs []uint32
-	parameters    *[]string
-	binds         *[]interface{}
 }
 
-func (ps *PreparedStatement) getBinds() *[]interface{} {
-	if ps.binds == nil {
-		binds := make([]interface{}, len(ps.parameterOIDs))
-		return &binds
-	} else {
-		return ps.binds
+// nullBinds are the values a statement described before it is bound runs
+// with.
+func (ps *PreparedStatement) nullBinds() []interface{} {
+	return make([]interface{}, len(ps.parameterOIDs))
+}
+
+// positionalPlaceholders converts the $n placeholders of a query to the
+// positional ? Vertica uses. order holds the index of the $n parameter each
+// ? stands for, so a repeated $1 is bound once per occurrence. Placeholders
+// inside string literals, quoted identifiers and comments are kept.
+func positionalPlaceholders(query string) (converted string, order []int) {
+	order = []int{}
+	var b strings.Builder
+	last := 0
+	for _, token := range tokenizeSQL(query) {
+		if token.kind != sqlParameter {
+			continue
+		}
+		n, err := strconv.Atoi(token.text[1:])
+		if err != nil || n < 1 {
+			continue
+		}
+		b.WriteString(query[last:token.pos])
+		b.WriteByte('?')
+		last = token.pos + len(token.text)
+		order = append(order, n-1)
 	}
+	b.WriteString(query[last:])
+	return b.String(), order
 }
 
-func (ps *PreparedStatement) getQuery() string {
-	if len(ps.parameterOIDs) == 0 {
-		return ps.query
-	} else {
-		if ps.parameters == nil || len(*ps.parameters) != len(ps.parameterOIDs) {
-			Logger.Warn("inproper prepared statement parameters! will use nulls for format", "ps", ps)
-			parametrisedQuery := ps.query
-			for i := 0; i < len(ps.parameterOIDs); i++ {
-				parametrisedQuery = strings.Replace(parametrisedQuery, fmt.Sprintf("$%d", i+1), "null", 1)
-			}
-			for i := 0; i < len(ps.parameterOIDs); i++ {
-				parametrisedQuery = strings.Replace(parametrisedQuery, "?", "null", 1)
-			}
-			return parametrisedQuery
-		} else {
-			parametrisedQuery := ps.query
-			for i, arg := range *ps.parameters {
-				parametrisedQuery = strings.Replace(parametrisedQuery, "?", arg, 1)
-				parametrisedQuery = strings.Replace(parametrisedQuery, fmt.Sprintf("$%d", i+1), "null", 1)
-			}
-			return parametrisedQuery
+// placeholderArgs returns the values bound to a query converted by
+// positionalPlaceholders in the order of its placeholders. With a nil order
+// the values are returned as they are, in the order of $n.
+func placeholderArgs(binds []interface{}, order []int) []interface{} {
+	if order == nil {
+		return binds
+	}
+	args := make([]interface{}, len(order))
+	for i, n := range order {
+		if n < len(binds) {
+			args[i] = binds[n]
 		}
 	}
+	return args
 }
 
 func parseParameter(format_code int16, parameterOID uint32, param []byte) (string, error) {
@@ -93,18 +105,37 @@ func parseParameter(format_code int16, parameterOID uint32, param []byte) (strin
 	return "", fmt.Errorf("unsupported format code or data type OID: format_code=%d, dataTypeOID=%d", format_code, parameterOID)
 }
 
-func (ps *PreparedStatement) addParameters(msg pgproto3.Bind) error {
+// bindParameters parses the parameter values of a Bind message.
+func (ps *PreparedStatement) bindParameters(msg pgproto3.Bind) ([]interface{}, error) {
 	binds := make([]interface{}, len(msg.Parameters))
-	params := []string{}
 	for i := range msg.Parameters {
-		parsed, err := parseParameter(msg.ParameterFormatCodes[i], ps.parameterOIDs[i], msg.Parameters[i])
+		// a nil parameter is NULL
+		if msg.Parameters[i] == nil {
+			continue
+		}
+		// parameters without a declared type are unspecified
+		var parameterOID uint32
+		if i < len(ps.parameterOIDs) {
+			parameterOID = ps.parameterOIDs[i]
+		}
+		parsed, err := parseParameter(parameterFormatCode(msg.ParameterFormatCodes, i), parameterOID, msg.Parameters[i])
 		if err != nil {
-			return err
+			return nil, err
 		}
 		binds[i] = parsed
-		params = append(params, parsed)
 	}
-	ps.parameters = &params
-	ps.binds = &binds
-	return nil
+	return binds, nil
+}
+
+// parameterFormatCode returns the format of the i-th parameter: no codes
+// mean text for all parameters and a single one applies to all of them.
+func parameterFormatCode(formatCodes []int16, i int) int16 {
+	switch len(formatCodes) {
+	case 0:
+		return 0
+	case 1:
+		return formatCodes[0]
+	default:
+		return formatCodes[i]
+	}
 }
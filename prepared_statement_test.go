@@ -7,40 +7,46 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-func TestPreparedStatement_getBinds(t *testing.T) {
+func TestPreparedStatement_nullBinds(t *testing.T) {
 	ps := &PreparedStatement{
 		name:          "test_name",
 		query:         "test_query",
 		parameterOIDs: []uint32{1, 2, 3},
-		parameters:    nil,
-		binds:         nil,
 	}
-	binds := ps.getBinds()
-	assert.Equal(t, len(*binds), 3)
-	assert.Equal(t, *binds, make([]interface{}, len(ps.parameterOIDs)))
+	binds := ps.nullBinds()
+	assert.Equal(t, len(binds), 3)
+	assert.Equal(t, binds, make([]interface{}, len(ps.parameterOIDs)))
 }
 
-func TestGetQuery(t *testing.T) {
-	ps := &PreparedStatement{
-		name:          "test_name",
-		query:         "test_query",
-		parameterOIDs: []uint32{},
-		parameters:    nil,
-		binds:         nil,
+func TestPositionalPlaceholders(t *testing.T) {
+	testCases := []struct {
+		query, expected string
+		order           []int
+	}{
+		{"SELECT 1", "SELECT 1", []int{}},
+		{"SELECT * FROM t WHERE a = $1 AND b = $2", "SELECT * FROM t WHERE a = ? AND b = ?", []int{0, 1}},
+		{"SELECT * FROM t WHERE a = $2 OR b = $1 OR c = $2", "SELECT * FROM t WHERE a = ? OR b = ? OR c = ?", []int{1, 0, 1}},
+		{"SELECT $10::int, $1", "SELECT ?::int, ?", []int{9, 0}},
+		{"SELECT '$1', \"$2\", $$ $3 $$, $1 -- $4\n/* $5 */", "SELECT '$1', \"$2\", $$ $3 $$, ? -- $4\n/* $5 */", []int{0}},
 	}
-
-	if query := ps.getQuery(); query != "test_query" {
-		t.Errorf("Expected 'test_query' but got '%v'", query)
+	for _, tC := range testCases {
+		converted, order := positionalPlaceholders(tC.query)
+		assert.Equal(t, tC.expected, converted, tC.query)
+		assert.Equal(t, tC.order, order, tC.query)
 	}
 }
 
-func TestAddParameters_CorrectParameters(t *testing.T) {
+func TestPlaceholderArgs(t *testing.T) {
+	binds := []interface{}{"a", "b"}
+	assert.Equal(t, binds, placeholderArgs(binds, nil))
+	assert.Equal(t, []interface{}{"b", "a", "b", nil}, placeholderArgs(binds, []int{1, 0, 1, 2}))
+}
+
+func TestBindParameters_CorrectParameters(t *testing.T) {
 	ps := &PreparedStatement{
 		name:          "test_name",
-		query:         "SELECT * FROM test WHERE a = ? AND b = ?",
+		query:         "SELECT * FROM test WHERE a = $1 AND b = $2",
 		parameterOIDs: []uint32{1, 1},
-		parameters:    nil,
-		binds:         nil,
 	}
 
 	bindMsg := pgproto3.Bind{
@@ -51,20 +57,19 @@ func TestAddParameters_CorrectParameters(t *testing.T) {
 		},
 	}
 
-	if err := ps.addParameters(bindMsg); err != nil {
+	binds, err := ps.bindParameters(bindMsg)
+	if err != nil {
 		t.Errorf("Unexpected error: %v", err)
 	}
 
-	assert.Equal(t, "SELECT * FROM test WHERE a = p1 AND b = p2", ps.getQuery())
+	assert.Equal(t, []interface{}{"p1", "p2"}, binds)
 }
 
-func TestAddParameters_WrongParameters(t *testing.T) {
+func TestBindParameters_WrongParameters(t *testing.T) {
 	ps := &PreparedStatement{
 		name:          "test_name",
-		query:         "SELECT * FROM test WHERE a = ? AND b = ?",
+		query:         "SELECT * FROM test WHERE a = $1 AND b = $2",
 		parameterOIDs: []uint32{1, 1},
-		parameters:    nil,
-		binds:         nil,
 	}
 
 	bindMsg := pgproto3.Bind{
@@ -74,9 +79,28 @@ func TestAddParameters_WrongParameters(t *testing.T) {
 		},
 	}
 
-	if err := ps.addParameters(bindMsg); err != nil {
+	binds, err := ps.bindParameters(bindMsg)
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	assert.Equal(t, []interface{}{"p1"}, binds)
+}
+
+func TestBindParameters_NullAndUntyped(t *testing.T) {
+	ps := &PreparedStatement{
+		name:  "test_name",
+		query: "SELECT * FROM test WHERE a = $1 AND b = $2",
+	}
+
+	bindMsg := pgproto3.Bind{
+		Parameters: [][]byte{nil, []byte("'; DROP TABLE test; --")},
+	}
+
+	binds, err := ps.bindParameters(bindMsg)
+	if err != nil {
 		t.Errorf("Unexpected error: %v", err)
 	}
 
-	assert.Equal(t, "SELECT * FROM test WHERE a = null AND b = null", ps.getQuery())
+	assert.Equal(t, []interface{}{nil, "'; DROP TABLE test; --"}, binds)
 }
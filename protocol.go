@@ -0,0 +1,148 @@
+package pgvertica
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgio"
+	"github.com/jackc/pgproto3/v2"
+)
+
+// Startup packet codes, see
+// https://www.postgresql.org/docs/current/protocol-message-formats.html
+const (
+	cancelRequestCode = 80877102
+	sslRequestCode    = 80877103
+	gssEncRequestCode = 80877104
+
+	protocolMajorVersion = 3
+	protocolMinorVersion = 0
+
+	// protocolOptionPrefix marks protocol extensions requested in the
+	// startup parameters, none of which is supported.
+	protocolOptionPrefix = "_pq_."
+
+	minStartupPacketLen = 4
+	maxStartupPacketLen = 10000
+)
+
+// receiveStartupMessage reads a startup packet like
+// pgproto3.Backend.ReceiveStartupMessage, but accepts every 3.x protocol
+// version so newer clients can be answered with NegotiateProtocolVersion.
+func receiveStartupMessage(cr pgproto3.ChunkReader) (pgproto3.FrontendMessage, error) {
+	header, err := cr.Next(4)
+	if err != nil {
+		return nil, err
+	}
+	msgSize := int(binary.BigEndian.Uint32(header)) - 4
+	if msgSize < minStartupPacketLen || msgSize > maxStartupPacketLen {
+		return nil, fmt.Errorf("invalid length of startup packet: %d", msgSize)
+	}
+
+	buf, err := cr.Next(msgSize)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	var msg pgproto3.FrontendMessage
+	code := binary.BigEndian.Uint32(buf)
+	switch {
+	case code == cancelRequestCode:
+		msg = &pgproto3.CancelRequest{}
+	case code == sslRequestCode:
+		msg = &pgproto3.SSLRequest{}
+	case code == gssEncRequestCode:
+		msg = &pgproto3.GSSEncRequest{}
+	case code>>16 == protocolMajorVersion:
+		// pgproto3 only decodes protocol 3.0, the parameters are the same in 3.x
+		startupBuf := append([]byte(nil), buf...)
+		binary.BigEndian.PutUint32(startupBuf, pgproto3.ProtocolVersionNumber)
+		startup := &pgproto3.StartupMessage{}
+		if err := startup.Decode(startupBuf); err != nil {
+			return nil, err
+		}
+		startup.ProtocolVersion = code
+		return startup, nil
+	default:
+		return nil, fmt.Errorf("unsupported frontend protocol %d.%d", code>>16, code&0xffff)
+	}
+	if err := msg.Decode(buf); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// NegotiateProtocolVersion tells the client which protocol minor version and
+// options the server supports. pgproto3 v2 does not implement it.
+type NegotiateProtocolVersion struct {
+	NewestMinorProtocol uint32
+	UnrecognizedOptions []string
+}
+
+// Backend identifies this message as sendable by the PostgreSQL backend.
+func (*NegotiateProtocolVersion) Backend() {}
+
+func (dst *NegotiateProtocolVersion) Decode(src []byte) error {
+	if len(src) < 8 {
+		return errors.New("negotiate protocol version message too short")
+	}
+	dst.NewestMinorProtocol = binary.BigEndian.Uint32(src)
+	count := int(binary.BigEndian.Uint32(src[4:]))
+
+	dst.UnrecognizedOptions = make([]string, 0, count)
+	rest := src[8:]
+	for i := 0; i < count; i++ {
+		idx := bytes.IndexByte(rest, 0)
+		if idx < 0 {
+			return errors.New("invalid negotiate protocol version message")
+		}
+		dst.UnrecognizedOptions = append(dst.UnrecognizedOptions, string(rest[:idx]))
+		rest = rest[idx+1:]
+	}
+	return nil
+}
+
+func (src *NegotiateProtocolVersion) Encode(dst []byte) []byte {
+	dst = append(dst, 'v')
+	sp := len(dst)
+	dst = append(dst, 0, 0, 0, 0)
+
+	dst = pgio.AppendUint32(dst, src.NewestMinorProtocol)
+	dst = pgio.AppendUint32(dst, uint32(len(src.UnrecognizedOptions)))
+	for _, option := range src.UnrecognizedOptions {
+		dst = append(dst, option...)
+		dst = append(dst, 0)
+	}
+
+	pgio.SetInt32(dst[sp:], int32(len(dst[sp:])))
+	return dst
+}
+
+// negotiateProtocolVersion removes the unsupported protocol options from the
+// startup parameters and returns the message to send, or nil when the client
+// asked for nothing this server does not support.
+func negotiateProtocolVersion(msg *pgproto3.StartupMessage) *NegotiateProtocolVersion {
+	var options []string
+	for name := range msg.Parameters {
+		if strings.HasPrefix(name, protocolOptionPrefix) {
+			options = append(options, name)
+			delete(msg.Parameters, name)
+		}
+	}
+	if msg.ProtocolVersion&0xffff <= protocolMinorVersion && len(options) == 0 {
+		return nil
+	}
+	sort.Strings(options)
+	return &NegotiateProtocolVersion{
+		NewestMinorProtocol: protocolMinorVersion,
+		UnrecognizedOptions: options,
+	}
+}
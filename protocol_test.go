@@ -0,0 +1,122 @@
+package pgvertica
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startupPacket(code uint32, params ...string) []byte {
+	body := make([]byte, 4)
+	binary.BigEndian.PutUint32(body, code)
+	for _, param := range params {
+		body = append(body, param...)
+		body = append(body, 0)
+	}
+	if len(params) > 0 {
+		body = append(body, 0)
+	}
+	packet := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint32(packet, uint32(4+len(body)))
+	return append(packet, body...)
+}
+
+func TestReceiveStartupMessage(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		packet   []byte
+		expected pgproto3.FrontendMessage
+	}{
+		{
+			desc:   "protocol 3.0",
+			packet: startupPacket(pgproto3.ProtocolVersionNumber, "user", "alice", "database", "test"),
+			expected: &pgproto3.StartupMessage{
+				ProtocolVersion: pgproto3.ProtocolVersionNumber,
+				Parameters:      map[string]string{"user": "alice", "database": "test"},
+			},
+		},
+		{
+			desc:   "protocol 3.2",
+			packet: startupPacket(3<<16|2, "user", "alice", "_pq_.compression", "on"),
+			expected: &pgproto3.StartupMessage{
+				ProtocolVersion: 3<<16 | 2,
+				Parameters:      map[string]string{"user": "alice", "_pq_.compression": "on"},
+			},
+		},
+		{
+			desc:     "gssenc request",
+			packet:   startupPacket(gssEncRequestCode),
+			expected: &pgproto3.GSSEncRequest{},
+		},
+		{
+			desc:     "ssl request",
+			packet:   startupPacket(sslRequestCode),
+			expected: &pgproto3.SSLRequest{},
+		},
+		{
+			desc:     "cancel request",
+			packet:   []byte{0, 0, 0, 16, 0x04, 0xd2, 0x16, 0x2e, 0, 0, 0, 7, 0, 0, 0, 42},
+			expected: &pgproto3.CancelRequest{ProcessID: 7, SecretKey: 42},
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			msg, err := receiveStartupMessage(pgproto3.NewChunkReader(bytes.NewReader(tC.packet)))
+			require.NoError(t, err)
+			assert.Equal(t, tC.expected, msg)
+		})
+	}
+}
+
+func TestReceiveStartupMessage_UnsupportedProtocol(t *testing.T) {
+	_, err := receiveStartupMessage(pgproto3.NewChunkReader(bytes.NewReader(startupPacket(2 << 16))))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unsupported frontend protocol 2.0")
+}
+
+func TestNegotiateProtocolVersion(t *testing.T) {
+	msg := &pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "alice"},
+	}
+	assert.Nil(t, negotiateProtocolVersion(msg))
+
+	msg = &pgproto3.StartupMessage{
+		ProtocolVersion: 3<<16 | 2,
+		Parameters:      map[string]string{"user": "alice", "_pq_.b": "1", "_pq_.a": "1"},
+	}
+	negotiate := negotiateProtocolVersion(msg)
+	assert.Equal(t, &NegotiateProtocolVersion{NewestMinorProtocol: 0, UnrecognizedOptions: []string{"_pq_.a", "_pq_.b"}}, negotiate)
+	assert.Equal(t, map[string]string{"user": "alice"}, msg.Parameters)
+
+	encoded := negotiate.Encode(nil)
+	assert.Equal(t, byte('v'), encoded[0])
+	assert.Equal(t, uint32(len(encoded)-1), binary.BigEndian.Uint32(encoded[1:]))
+	decoded := &NegotiateProtocolVersion{}
+	require.NoError(t, decoded.Decode(encoded[5:]))
+	assert.Equal(t, negotiate, decoded)
+}
+
+func TestServeConnStartup_GSSEncRequest(t *testing.T) {
+	mockConn := &MockConn{}
+	mockReceiver := new(MockReceiver)
+	mockReceiver.On("ReceiveStartupMessage").Return(&pgproto3.GSSEncRequest{}, nil).Once()
+	mockReceiver.On("ReceiveStartupMessage").Return(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "alice"},
+	}, nil).Once()
+	c := &Conn{Conn: mockConn, receiver: mockReceiver}
+
+	_, err := serveConnStartup(context.Background(), c, &ServerConfig{})
+
+	assert.Error(t, err)
+	mockReceiver.AssertExpectations(t)
+	assert.Equal(t, byte('N'), mockConn.buf.Bytes()[0])
+	assert.Equal(t, "database required", lastWrittenMessage(t, mockConn.buf.Bytes()[1:]).(*pgproto3.ErrorResponse).Message)
+}
@@ -3,8 +3,9 @@ package pgvertica
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"reflect"
+	"strings"
 
 	"github.com/jackc/pgproto3/v2"
 	"github.com/lib/pq"
@@ -12,16 +13,37 @@ import (
 )
 
 type QueryExecutor struct {
-	ctx                   context.Context
-	mb                    MessageBufferInterface
-	queryUtil             *QueryUtil
-	conn                  *Conn
-	preparedStatements    map[string]*PreparedStatement
-	cursors               map[string]*Cursor
-	inTransaction         bool
-	maxBufferSize         int
-	currPreparedStatement *PreparedStatement
-	synchronizedSchemas   []string
+	ctx                context.Context
+	mb                 MessageBufferInterface
+	queryUtil          *QueryUtil
+	conn               *Conn
+	preparedStatements map[string]*PreparedStatement
+	portals            map[string]*Portal
+	cursors            map[string]*Cursor
+	inTransaction      bool
+	maxBufferSize      int
+	// skipUntilSync is set when an extended query message failed.
+	skipUntilSync bool
+	// awaitingSync is set from the first extended query message until the
+	// Sync answered with ReadyForQuery.
+	awaitingSync        bool
+	synchronizedSchemas []string
+	routingRules        RoutingRules
+	rewriteRules        RewriteRules
+	// applicationName follows SET application_name, routing rules match it.
+	applicationName string
+	// searchPath follows SET search_path, unqualified names are routed as
+	// names of its first schema.
+	searchPath string
+	// tempTables are the temporary tables the session created on Postgres,
+	// shipped to Vertica when a Vertica query joins them.
+	tempTables map[string]struct{}
+	// tempTablesAtBegin are the temporary tables when the transaction
+	// began, restored when it rolls back. onCommitDrop are the tables it
+	// created ON COMMIT DROP.
+	tempTablesAtBegin map[string]struct{}
+	onCommitDrop      []string
+	federationMaxRows int
 }
 
 func newQueryExecutor(ctx context.Context, conn *Conn, config *ServerConfig) *QueryExecutor {
@@ -30,16 +52,22 @@ func newQueryExecutor(ctx context.Context, conn *Conn, config *ServerConfig) *Qu
 		panic(err)
 	}
 	return &QueryExecutor{
-		ctx:                   ctx,
-		mb:                    newMessagesBuffer(conn.Conn),
-		conn:                  conn,
-		queryUtil:             newQueryUtil(pgdb_name),
-		preparedStatements:    make(map[string]*PreparedStatement),
-		cursors:               make(map[string]*Cursor),
-		inTransaction:         false,
-		maxBufferSize:         16,
-		currPreparedStatement: nil,
-		synchronizedSchemas:   config.SynchronizedSchemas,
+		ctx:                 ctx,
+		mb:                  newMessagesBuffer(conn.Conn),
+		conn:                conn,
+		queryUtil:           newQueryUtil(pgdb_name),
+		preparedStatements:  make(map[string]*PreparedStatement),
+		portals:             make(map[string]*Portal),
+		cursors:             make(map[string]*Cursor),
+		inTransaction:       false,
+		maxBufferSize:       16,
+		synchronizedSchemas: config.SynchronizedSchemas,
+		routingRules:        config.RoutingRules,
+		rewriteRules:        config.RewriteRules,
+		applicationName:     conn.parameterStatus["application_name"],
+		searchPath:          conn.settings["search_path"],
+		tempTables:          make(map[string]struct{}),
+		federationMaxRows:   config.FederationMaxRows,
 	}
 }
 
@@ -52,6 +80,13 @@ func (qe *QueryExecutor) getTransactionStatus() byte {
 }
 
 func (qe *QueryExecutor) getErrorResponse(err error) *pgproto3.ErrorResponse {
+	if errors.Is(err, context.Canceled) {
+		return &pgproto3.ErrorResponse{
+			Severity: "ERROR",
+			Code:     queryCanceledCode,
+			Message:  "canceling statement due to user request",
+		}
+	}
 	if pqerr, ok := err.(*pq.Error); ok {
 		return &pgproto3.ErrorResponse{
 			Severity:       pqerr.Severity,
@@ -69,10 +104,23 @@ func (qe *QueryExecutor) getErrorResponse(err error) *pgproto3.ErrorResponse {
 			File:           pqerr.File,
 			Routine:        pqerr.Routine,
 		}
+	} else if lerr, ok := err.(*limitError); ok {
+		return lerr.errorResponse("ERROR")
+	} else if rerr, ok := err.(*routingError); ok {
+		return rerr.errorResponse()
+	} else if derr, ok := err.(*dialectError); ok {
+		return derr.errorResponse()
+	} else if eerr, ok := err.(*extendedQueryError); ok {
+		return eerr.errorResponse()
 	} else if verr, ok := err.(*vertigo.VError); ok {
+		// ErrorCode is Vertica's own error number, clients expect the SQLSTATE
+		code := verr.SQLState
+		if code == "" {
+			code = verr.ErrorCode
+		}
 		return &pgproto3.ErrorResponse{
 			Severity: verr.Severity,
-			Code:     verr.ErrorCode,
+			Code:     code,
 			Message:  verr.Message,
 			Detail:   verr.Detail,
 			Hint:     verr.Hint,
@@ -80,84 +128,101 @@ func (qe *QueryExecutor) getErrorResponse(err error) *pgproto3.ErrorResponse {
 	} else {
 		return &pgproto3.ErrorResponse{
 			Severity: "ERROR",
-			Code:     "0A000",
+			Code:     featureNotSupportedCode,
 			Message:  err.Error(),
 		}
 	}
 
 }
 
-func (qe *QueryExecutor) handleQueryMessage(msg *pgproto3.Query) (err error) {
+// handleQueryMessage runs the statements of a simple Query one after the
+// other. Each statement gets its own CommandComplete, the first failing one
+// ends the message and a single ReadyForQuery follows.
+func (qe *QueryExecutor) handleQueryMessage(msg *pgproto3.Query) error {
 	Logger.Info("received query", "query", msg.String)
-	query := msg.String
-	commandTag := getCommandTag(query)
-
-	if qe.queryUtil.isDeallocateQuery(msg.String) {
+	statements := splitStatements(msg.String)
+	if len(statements) == 0 {
 		qe.mb.queueMessages(
-			&pgproto3.CommandComplete{CommandTag: []byte(commandTag)},
+			&pgproto3.EmptyQueryResponse{},
 			&pgproto3.ReadyForQuery{TxStatus: qe.getTransactionStatus()},
 		)
 		return qe.mb.sendQueuedMessages()
 	}
 
+	for _, statement := range statements {
+		if err := qe.executeStatement(statement); err != nil {
+			Logger.Error("Query error", "query", statement, "error", err)
+
+			qe.mb.queueMessages(
+				qe.getErrorResponse(err),
+				&pgproto3.ReadyForQuery{TxStatus: qe.getTransactionStatus()},
+			)
+			if serr := qe.mb.sendQueuedMessages(); serr != nil {
+				return serr
+			}
+			return err
+		}
+	}
+
+	qe.mb.queueMessages(&pgproto3.ReadyForQuery{TxStatus: qe.getTransactionStatus()})
+	return qe.mb.sendQueuedMessages()
+}
+
+// executeStatement runs a single statement of a simple Query and queues its
+// results up to the CommandComplete.
+func (qe *QueryExecutor) executeStatement(query string) error {
+	commandTag := getCommandTag(query)
+
+	if qe.queryUtil.isDeallocateQuery(query) {
+		qe.mb.queueMessages(&pgproto3.CommandComplete{CommandTag: []byte(commandTag)})
+		return nil
+	}
+
 	if qe.queryUtil.isCloseQuery(query) {
 		qe.closeCursor(query)
-		qe.mb.queueMessages(
-			&pgproto3.CommandComplete{CommandTag: []byte(commandTag)},
-			&pgproto3.ReadyForQuery{TxStatus: qe.getTransactionStatus()},
-		)
-		return qe.mb.sendQueuedMessages()
+		qe.mb.queueMessages(&pgproto3.CommandComplete{CommandTag: []byte(commandTag)})
+		return nil
 	}
 
 	if qe.queryUtil.isDeclareCursorQuery(query) {
-		qe.declareCursor(query)
-		return qe.mb.sendQueuedMessages()
+		return qe.declareCursor(query, nil)
 	}
 
 	if qe.queryUtil.isFetchQuery(query) {
-		qe.fetchFromCursor(query)
-		return qe.mb.sendQueuedMessages()
+		return qe.fetchFromCursor(query)
 	}
 
-	rows, dberr := qe.executeQuery(query)
-
-	if dberr != nil {
-		Logger.Error("Query error", "query", query, "error", dberr)
-
-		qe.mb.queueMessages(
-			qe.getErrorResponse(dberr),
-			&pgproto3.ReadyForQuery{TxStatus: qe.getTransactionStatus()},
-		)
-		if err := qe.mb.sendQueuedMessages(); err != nil {
-			return err
-		}
-		return dberr
+	query = qe.rewriteRules.Rewrite(query)
+	rows, err := qe.executeQuery(query)
+	if err != nil {
+		return err
 	}
 
 	defer rows.Close()
+	qe.queueParameterStatus(query)
+	qe.rememberSetQuery(query)
+	qe.followVerticaSettings(query)
+	qe.trackTempTables(query)
 	if qe.queryUtil.isBeginQuery(query) {
 		qe.inTransaction = true
 	}
 
 	if qe.queryUtil.queryDiscardsTransaction(query) {
 		qe.inTransaction = false
+		qe.closePortals()
 	}
 
 	if qe.queryUtil.queryReturnsNoRows(query) {
-		qe.mb.queueMessages(
-			&pgproto3.CommandComplete{CommandTag: []byte(commandTag)},
-			&pgproto3.ReadyForQuery{TxStatus: qe.getTransactionStatus()},
-		)
-		return qe.mb.sendQueuedMessages()
+		qe.mb.queueMessages(&pgproto3.CommandComplete{CommandTag: []byte(commandTag)})
+		return nil
 	}
 
 	if qe.queryUtil.queryShouldReturnEmptyResponse(query) {
 		qe.mb.queueMessages(
 			&pgproto3.EmptyQueryResponse{},
 			&pgproto3.CommandComplete{CommandTag: []byte(commandTag)},
-			&pgproto3.ReadyForQuery{TxStatus: qe.getTransactionStatus()},
 		)
-		return qe.mb.sendQueuedMessages()
+		return nil
 	}
 
 	cols, err := rows.ColumnTypes()
@@ -167,75 +232,79 @@ func (qe *QueryExecutor) handleQueryMessage(msg *pgproto3.Query) (err error) {
 
 	qe.mb.queueMessages(toRowDescription(cols))
 
-	if err := qe.writeRowsInChunks(rows, cols); err != nil {
+	if _, err := qe.writeRowsInChunks(rows, cols, 0); err != nil {
 		return err
 	}
 
-	qe.mb.queueMessages(
-		&pgproto3.CommandComplete{CommandTag: []byte(commandTag)},
-		&pgproto3.ReadyForQuery{TxStatus: qe.getTransactionStatus()},
-	)
-	return qe.mb.sendQueuedMessages()
+	qe.mb.queueMessages(&pgproto3.CommandComplete{CommandTag: []byte(commandTag)})
+	return nil
 }
 
-func (qe *QueryExecutor) declareCursor(declareQuery string) {
+// declareCursor opens a cursor on the backend its query is routed to, binds
+// are the values of the $n placeholders of a cursor declared by a prepared
+// statement. The cursor keeps the connection until it is closed.
+func (qe *QueryExecutor) declareCursor(declareQuery string, binds []interface{}) error {
 	commandTag := getCommandTag(declareQuery)
 	parsedQuery, err := qe.queryUtil.parseDeclareCursorQuery(declareQuery)
-	query := qe.queryUtil.rewriteQuery(parsedQuery.query)
 	if err != nil {
-		qe.mb.queueMessages(
-			qe.getErrorResponse(err),
-			&pgproto3.ReadyForQuery{TxStatus: qe.getTransactionStatus()},
-		)
+		return err
 	}
-
-	cursor := newCursor(parsedQuery.name, query, CursorType(parsedQuery.cursorType))
-	err = cursor.open(qe.conn.vdb)
+	query := qe.rewriteRules.Rewrite(parsedQuery.query)
+
+	var cursor *Cursor
+	err = qe.runRouted(query, func(route Route) error {
+		if route == RouteVertica {
+			Logger.Info("Route cursor query to vertica", "query", query)
+			rewrittenQuery, err := qe.queryUtil.rewriteQuery(query)
+			if err != nil {
+				return err
+			}
+			rewrittenQuery, order := positionalPlaceholders(rewrittenQuery)
+			if err := qe.shipTempTables(query); err != nil {
+				return err
+			}
+			vconn, err := qe.conn.vlease.acquire(qe.ctx, qe.conn.vdb)
+			if err != nil {
+				return err
+			}
+			cursor = newCursor(parsedQuery.name, rewrittenQuery, CursorType(parsedQuery.cursorType))
+			return cursor.open(vconn, placeholderArgs(binds, order)...)
+		}
+		Logger.Info("Route cursor query to postgres", "query", query)
+		pgconn, err := qe.conn.pglease.acquire(qe.ctx, qe.conn.pgdb)
+		if err != nil {
+			return err
+		}
+		cursor = newCursor(parsedQuery.name, query, CursorType(parsedQuery.cursorType))
+		return cursor.open(pgconn, binds...)
+	})
 	if err != nil {
-		qe.mb.queueMessages(
-			qe.getErrorResponse(err),
-			&pgproto3.ReadyForQuery{TxStatus: qe.getTransactionStatus()},
-		)
+		return err
 	}
 
 	qe.cursors[cursor.name] = cursor
-	Logger.Info("declare and open cursor", "cursor", cursor.name, "query", query)
-	qe.mb.queueMessages(
-		&pgproto3.CommandComplete{CommandTag: []byte(commandTag)},
-		&pgproto3.ReadyForQuery{TxStatus: qe.getTransactionStatus()},
-	)
+	Logger.Info("declare and open cursor", "cursor", cursor.name, "query", cursor.query)
+	qe.mb.queueMessages(&pgproto3.CommandComplete{CommandTag: []byte(commandTag)})
+	return nil
 }
 
-func (qe *QueryExecutor) fetchFromCursor(fetchQueryStr string) {
+func (qe *QueryExecutor) fetchFromCursor(fetchQueryStr string) error {
 	commandTag := getCommandTag(fetchQueryStr)
 	fetchQuery, err := qe.queryUtil.parseFetchQuery(fetchQueryStr)
 	if err != nil {
-		qe.mb.queueMessages(
-			qe.getErrorResponse(err),
-			&pgproto3.ReadyForQuery{TxStatus: qe.getTransactionStatus()},
-		)
+		return err
 	}
 	cursor, ok := qe.cursors[fetchQuery.CursorName]
 	if !ok {
-		qe.mb.queueMessages(
-			qe.getErrorResponse(fmt.Errorf("cursor %s does not exist", fetchQuery.CursorName)),
-			&pgproto3.ReadyForQuery{TxStatus: qe.getTransactionStatus()},
-		)
+		return fmt.Errorf("cursor %s does not exist", fetchQuery.CursorName)
 	}
 	messages, err := cursor.fetch(fetchQuery.Count)
 	if err != nil {
-		qe.mb.queueMessages(
-			qe.getErrorResponse(err),
-			&pgproto3.ReadyForQuery{TxStatus: qe.getTransactionStatus()},
-		)
+		return err
 	}
-	qe.mb.queueMessages(
-		messages...,
-	)
-	qe.mb.queueMessages(
-		&pgproto3.CommandComplete{CommandTag: []byte(commandTag)},
-		&pgproto3.ReadyForQuery{TxStatus: qe.getTransactionStatus()},
-	)
+	qe.mb.queueMessages(messages...)
+	qe.mb.queueMessages(&pgproto3.CommandComplete{CommandTag: []byte(commandTag)})
+	return nil
 }
 
 func (qe *QueryExecutor) closeCursor(closeQuery string) {
@@ -250,158 +319,221 @@ func (qe *QueryExecutor) closeCursor(closeQuery string) {
 		return
 	}
 	cursor.close()
+	delete(qe.cursors, cursorName)
 }
 
-func (qe *QueryExecutor) handleBindMessage(bmsg *pgproto3.Bind) error {
-	stmt, ok := qe.preparedStatements[bmsg.PreparedStatement]
-	if !ok {
-		qe.mb.queueMessages(
-			&pgproto3.ErrorResponse{
-				Severity: "ERROR",
-				Code:     "26000",
-				Message:  "prepared statement \"" + bmsg.PreparedStatement + "\" does not exist",
-			},
-		)
-		return fmt.Errorf("prepared statement \"%s\" does not exist", bmsg.PreparedStatement)
+// handleExtendedMessage processes a Parse, Bind, Describe, Execute or Close
+// message. The first failing one queues its error and the messages up to
+// the next Sync are skipped, as Postgres does.
+func (qe *QueryExecutor) handleExtendedMessage(msg pgproto3.FrontendMessage) error {
+	qe.awaitingSync = true
+	if qe.skipUntilSync {
+		return nil
 	}
 
-	if err := stmt.addParameters(*bmsg); err != nil {
-		qe.mb.queueMessages(
-			&pgproto3.ErrorResponse{
-				Severity: "ERROR",
-				Code:     "22023",
-				Message:  "invalid parameter value",
-			},
-		)
-		return fmt.Errorf("add parameters: %w", err)
+	var err error
+	switch msg := msg.(type) {
+	case *pgproto3.Parse:
+		err = qe.handleParse(msg)
+	case *pgproto3.Bind:
+		err = qe.handleBind(msg)
+	case *pgproto3.Describe:
+		err = qe.handleDescribe(msg)
+	case *pgproto3.Execute:
+		err = qe.handleExecuteMessage(msg)
+	case *pgproto3.Close:
+		qe.handleClose(msg)
+	default:
+		err = fmt.Errorf("unexpected extended query message: %#v", msg)
 	}
-
-	qe.preparedStatements[bmsg.PreparedStatement] = stmt
-	qe.mb.queueMessages(&pgproto3.BindComplete{})
-	return qe.handlePreparedStatement(stmt)
+	if err != nil {
+		qe.mb.queueMessages(qe.getErrorResponse(err))
+		qe.skipUntilSync = true
+	}
+	return err
 }
 
-func (qe *QueryExecutor) handleParseMessage(pmsg *pgproto3.Parse) error {
-	query := pmsg.Query
-	preparedStatement := PreparedStatement{
-		name:          pmsg.Name,
-		query:         query,
-		parameterOIDs: pmsg.ParameterOIDs,
+// handleSync ends a sequence of extended query messages. Outside a
+// transaction it ends the implicit one, with its portals.
+func (qe *QueryExecutor) handleSync() error {
+	qe.skipUntilSync = false
+	qe.awaitingSync = false
+	if !qe.inTransaction {
+		qe.closePortals()
 	}
-	// cache named prepared statements
-	if preparedStatement.name != "" {
-		qe.preparedStatements[preparedStatement.name] = &preparedStatement
+	qe.mb.queueMessages(&pgproto3.ReadyForQuery{TxStatus: qe.getTransactionStatus()})
+	return qe.mb.sendQueuedMessages()
+}
+
+// handleParse creates a prepared statement. The unnamed one is replaced by
+// the next Parse, a named one lives until it is closed.
+func (qe *QueryExecutor) handleParse(msg *pgproto3.Parse) error {
+	if _, ok := qe.preparedStatements[msg.Name]; ok && msg.Name != "" {
+		return &extendedQueryError{code: duplicatePreparedStatementCode, message: fmt.Sprintf("prepared statement \"%s\" already exists", msg.Name)}
 	}
 
+	query := msg.Query
+	// cursors rewrite the query they declare
+	if !qe.queryUtil.isDeclareCursorQuery(query) {
+		query = qe.rewriteRules.Rewrite(query)
+	}
+	qe.preparedStatements[msg.Name] = &PreparedStatement{
+		name:          msg.Name,
+		query:         query,
+		parameterOIDs: msg.ParameterOIDs,
+	}
 	qe.mb.queueMessages(&pgproto3.ParseComplete{})
-	return qe.handlePreparedStatement(&preparedStatement)
+	return nil
 }
 
-func (qe *QueryExecutor) handlePreparedStatement(preparedStatement *PreparedStatement) error {
-	qe.currPreparedStatement = preparedStatement
-	for {
-		msg, err := qe.conn.receiver.Receive()
-		if err != nil {
-			return fmt.Errorf("receive message during parse: %w", err)
-		}
-		Logger.Debug("[recv][qe]", "type", reflect.TypeOf(msg), "msg", msg)
-
-		switch msg := msg.(type) {
-		case *pgproto3.Bind:
-			if err := qe.handleBind(msg, preparedStatement); err != nil {
-				Logger.Error("Error handling bind", "error", err)
-			}
-		case *pgproto3.Describe:
-			if err := qe.handleDescribe(msg); err != nil {
-				Logger.Error("Error handling describe", "error", err)
-			}
-
-		case *pgproto3.Execute:
-			qe.currPreparedStatement = nil
-			return qe.handleExecute(preparedStatement)
+// handleBind creates a portal binding a prepared statement to parameter
+// values. The unnamed portal is replaced by the next Bind.
+func (qe *QueryExecutor) handleBind(msg *pgproto3.Bind) error {
+	stmt, ok := qe.preparedStatements[msg.PreparedStatement]
+	if !ok {
+		return &extendedQueryError{code: invalidSQLStatementNameCode, message: fmt.Sprintf("prepared statement \"%s\" does not exist", msg.PreparedStatement)}
+	}
+	if _, ok := qe.portals[msg.DestinationPortal]; ok && msg.DestinationPortal != "" {
+		return &extendedQueryError{code: duplicateCursorCode, message: fmt.Sprintf("portal \"%s\" already exists", msg.DestinationPortal)}
+	}
 
-		case *pgproto3.Sync:
-			qe.currPreparedStatement = nil
-			qe.mb.queueMessages(&pgproto3.ReadyForQuery{TxStatus: qe.getTransactionStatus()})
-			return qe.mb.sendQueuedMessages()
+	portal, err := newPortal(msg.DestinationPortal, stmt, msg)
+	if err != nil {
+		return err
+	}
+	qe.portals[portal.name] = portal
+	qe.mb.queueMessages(&pgproto3.BindComplete{})
+	return nil
+}
 
-		case *pgproto3.Close:
-			qe.currPreparedStatement = nil
-			qe.mb.queueMessages(&pgproto3.CloseComplete{})
-			return nil
+func (qe *QueryExecutor) handleExecuteMessage(msg *pgproto3.Execute) error {
+	portal, ok := qe.portals[msg.Portal]
+	if !ok {
+		return &extendedQueryError{code: invalidCursorNameCode, message: fmt.Sprintf("portal \"%s\" does not exist", msg.Portal)}
+	}
+	return qe.handleExecute(portal, int(msg.MaxRows))
+}
 
-		default:
-			return fmt.Errorf("unexpected message type during parse: %#v", msg)
+// handleClose drops a prepared statement, with the portals bound to it, or
+// a portal. Closing one that doesn't exist is not an error.
+func (qe *QueryExecutor) handleClose(msg *pgproto3.Close) {
+	switch msg.ObjectType {
+	case 'S':
+		if stmt, ok := qe.preparedStatements[msg.Name]; ok {
+			for name, portal := range qe.portals {
+				if portal.statement == stmt {
+					portal.close()
+					delete(qe.portals, name)
+				}
+			}
+			delete(qe.preparedStatements, msg.Name)
+		}
+	case 'P':
+		if portal, ok := qe.portals[msg.Name]; ok {
+			portal.close()
+			delete(qe.portals, msg.Name)
 		}
 	}
+	qe.mb.queueMessages(&pgproto3.CloseComplete{})
 }
 
-func (qe *QueryExecutor) handleBind(msg *pgproto3.Bind, preparedStatement *PreparedStatement) error {
-	if err := preparedStatement.addParameters(*msg); err != nil {
-		return err
+// route decides whether the query goes to Vertica or Postgres. With the
+// fallback enabled, a read-only query routed by the heuristic may be retried
+// on the other backend and goes to the one remembered for it, if any.
+func (qe *QueryExecutor) route(query string) (routeDecision, error) {
+	tokens := tokenizeSQL(query)
+	significant := significantTokens(tokens)
+	schema := searchPathSchema(qe.searchPath, qe.conn.user, qe.synchronizedSchemas)
+	relations := qualifyRelations(significant, referencedRelations(significant), schema, func(name string) bool {
+		_, ok := qe.tempTables[name]
+		return ok
+	})
+	route, explicit, err := routeQuery(routedQuery{
+		text:            query,
+		relations:       relations,
+		user:            qe.conn.user,
+		applicationName: qe.applicationName,
+	}, tokens, qe.routingRules, qe.synchronizedSchemas)
+	decision := routeDecision{route: route}
+	if err != nil || explicit || qe.conn.routeCache == nil || !isReadOnlyQuery(significant) {
+		return decision, err
 	}
-	qe.mb.queueMessages(&pgproto3.BindComplete{})
-	return nil
+
+	decision.cacheKey = routeCacheKey{user: qe.conn.user, searchPath: qe.searchPath, fingerprint: queryFingerprint(significant)}
+	if cached, ok := qe.conn.routeCache.get(decision.cacheKey); ok {
+		Logger.Debug("Use remembered fallback route", "route", cached, "fingerprint", decision.cacheKey.fingerprint)
+		decision.route = cached
+	}
+	decision.fallback = fallbackHasRelations(decision.route.other(), relations, qe.synchronizedSchemas)
+	return decision, nil
 }
 
 func (qe *QueryExecutor) executeQuery(query string) (rows *sql.Rows, err error) {
-	isData := qe.queryUtil.isDataQuery(query, qe.synchronizedSchemas)
-	if isData {
-		Logger.Info("Route query to vertica", "query", query)
-		rewrittenQuery := qe.queryUtil.rewriteQuery(query)
-		if rewrittenQuery != query {
-			Logger.Info("Rewritten query", "query", rewrittenQuery)
+	err = qe.runRouted(query, func(route Route) error {
+		if route == RouteVertica {
+			Logger.Info("Route query to vertica", "query", query)
+			rewrittenQuery, err := qe.queryUtil.rewriteQuery(query)
+			if err != nil {
+				return err
+			}
+			if rewrittenQuery != query {
+				Logger.Info("Rewritten query", "query", rewrittenQuery)
+			}
+			if err := qe.shipTempTables(query); err != nil {
+				return err
+			}
+			rows, err = qe.conn.vlease.query(qe.ctx, qe.conn.vdb, rewrittenQuery)
+			return err
 		}
-		rows, err = qe.conn.vdb.QueryContext(qe.ctx, rewrittenQuery)
-	} else {
 		Logger.Info("Route query to postgres", "query", query)
-		rows, err = qe.conn.pgdb.QueryContext(qe.ctx, query)
-	}
+		rows, err = qe.conn.pglease.query(qe.ctx, qe.conn.pgdb, query)
+		return err
+	})
 	return rows, err
 }
 
-func (qe *QueryExecutor) prepareStatement(preparedStatement *PreparedStatement, describe bool) (*sql.Stmt, error) {
-	isData := qe.queryUtil.isDataQuery(preparedStatement.getQuery(), qe.synchronizedSchemas)
-	var stmt *sql.Stmt
-	var dberr error
-	if isData {
-		statementCp := PreparedStatement{
-			name:          preparedStatement.name,
-			query:         preparedStatement.query,
-			parameterOIDs: preparedStatement.parameterOIDs,
-			parameters:    preparedStatement.parameters,
-			binds:         preparedStatement.binds,
-		}
-		if describe {
-			statementCp.query = qe.queryUtil.limitQuery(statementCp.query, 1)
-		}
-
-		query := statementCp.query
-		Logger.Info("Route query to vertica", "query", query)
-
-		rewrittenQuery := qe.queryUtil.rewriteQuery(query)
-		if rewrittenQuery != query {
-			Logger.Info("Rewritten query", "query", rewrittenQuery)
+// prepareStatement prepares the statement on the backend it is routed to.
+// Queries sent to Vertica get positional placeholders, order tells how the
+// bound values map to them.
+func (qe *QueryExecutor) prepareStatement(preparedStatement *PreparedStatement) (stmt *sql.Stmt, order []int, err error) {
+	query := preparedStatement.query
+	err = qe.runRouted(query, func(route Route) error {
+		if route == RouteVertica {
+			Logger.Info("Route query to vertica", "query", query)
+
+			rewrittenQuery, err := qe.queryUtil.rewriteQuery(query)
+			if err != nil {
+				return err
+			}
+			if rewrittenQuery != query {
+				Logger.Info("Rewritten query", "query", rewrittenQuery)
+			}
+			rewrittenQuery, order = positionalPlaceholders(rewrittenQuery)
+			if err := qe.shipTempTables(query); err != nil {
+				return err
+			}
+			stmt, err = qe.conn.vlease.prepare(qe.ctx, qe.conn.vdb, rewrittenQuery)
+			return err
 		}
-		stmt, dberr = qe.conn.vdb.PrepareContext(qe.ctx, rewrittenQuery)
-	} else {
-		query := preparedStatement.query
 		Logger.Info("Route query to postgres", "query", query)
-		stmt, dberr = qe.conn.pgdb.PrepareContext(qe.ctx, query)
-	}
+		order = nil
+		var err error
+		stmt, err = qe.conn.pglease.prepare(qe.ctx, qe.conn.pgdb, query)
+		return err
+	})
 
-	return stmt, dberr
+	return stmt, order, err
 }
 
-func (qe *QueryExecutor) queryStatement(stmt *sql.Stmt, preparedStatement *PreparedStatement) (*sql.Rows, []*sql.ColumnType, error) {
+func (qe *QueryExecutor) queryStatement(stmt *sql.Stmt, preparedStatement *PreparedStatement, binds []interface{}, order []int) (*sql.Rows, []*sql.ColumnType, error) {
 	var rows *sql.Rows
 	var cols []*sql.ColumnType
 	var dberr error
-	binds := preparedStatement.getBinds()
+	args := placeholderArgs(binds, order)
 
-	Logger.Info("Query statement", "query", preparedStatement.query, "binds", binds)
+	Logger.Info("Query statement", "query", preparedStatement.query, "args", args)
 
-	if rows, dberr = stmt.QueryContext(qe.ctx, *binds...); dberr != nil {
+	if rows, dberr = stmt.QueryContext(qe.ctx, args...); dberr != nil {
 		return nil, nil, dberr
 	}
 	if cols, dberr = rows.ColumnTypes(); dberr != nil {
@@ -411,13 +543,13 @@ func (qe *QueryExecutor) queryStatement(stmt *sql.Stmt, preparedStatement *Prepa
 	return rows, cols, nil
 }
 
-func (qe *QueryExecutor) executePreparedStatement(preparedStatement *PreparedStatement, describe bool) (*sql.Rows, []*sql.ColumnType, error) {
-	stmt, err := qe.prepareStatement(preparedStatement, describe)
+func (qe *QueryExecutor) executePreparedStatement(preparedStatement *PreparedStatement, binds []interface{}) (*sql.Rows, []*sql.ColumnType, error) {
+	stmt, order, err := qe.prepareStatement(preparedStatement)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	rows, cols, err := qe.queryStatement(stmt, preparedStatement)
+	rows, cols, err := qe.queryStatement(stmt, preparedStatement, binds, order)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -425,175 +557,486 @@ func (qe *QueryExecutor) executePreparedStatement(preparedStatement *PreparedSta
 	return rows, cols, nil
 }
 
+// handleDescribe describes a prepared statement, with its parameters, or a
+// portal, without running the statement: the columns of a query are those
+// of the query wrapped into a subquery returning no rows, and those of an
+// INSERT, UPDATE or DELETE with RETURNING are those of its RETURNING list
+// selected from the table, again without rows. SHOW is run, other
+// statements have no columns.
 func (qe *QueryExecutor) handleDescribe(msg *pgproto3.Describe) error {
 	var preparedStatement *PreparedStatement
-	if qe.currPreparedStatement == nil {
-		if ps, ok := qe.preparedStatements[msg.Name]; ok {
-			preparedStatement = ps
+	var binds []interface{}
+	switch msg.ObjectType {
+	case 'S':
+		ps, ok := qe.preparedStatements[msg.Name]
+		if !ok {
+			return &extendedQueryError{code: invalidSQLStatementNameCode, message: fmt.Sprintf("prepared statement \"%s\" does not exist", msg.Name)}
+		}
+		preparedStatement, binds = ps, ps.nullBinds()
+		qe.mb.queueMessages(&pgproto3.ParameterDescription{ParameterOIDs: preparedStatement.parameterOIDs})
+	case 'P':
+		portal, ok := qe.portals[msg.Name]
+		if !ok {
+			return &extendedQueryError{code: invalidCursorNameCode, message: fmt.Sprintf("portal \"%s\" does not exist", msg.Name)}
+		}
+		preparedStatement, binds = portal.statement, portal.binds
+	default:
+		return fmt.Errorf("unexpected object type: %c", msg.ObjectType)
+	}
+
+	query := preparedStatement.query
+	if qe.queryUtil.queryReturnsNoRows(query) || qe.queryUtil.queryShouldReturnEmptyResponse(query) || qe.queryUtil.isDeclareCursorQuery(query) ||
+		qe.queryUtil.isDeallocateQuery(query) || qe.queryUtil.isCloseQuery(query) || qe.queryUtil.isFetchQuery(query) {
+		qe.mb.queueMessages(&pgproto3.NoData{})
+		return nil
+	}
+
+	tokens := significantTokens(tokenizeSQL(query))
+	var described string
+	switch {
+	case isReadOnlyQuery(tokens) || len(tokens) > 0 && (tokens[0].isKeyword("VALUES") || tokens[0].isKeyword("TABLE")):
+		described = describeQuery(query)
+	case len(tokens) > 0 && tokens[0].isKeyword("SHOW"):
+		described = query
+	default:
+		described = describeReturningQuery(query, tokens)
+	}
+	if described == "" {
+		qe.mb.queueMessages(&pgproto3.NoData{})
+		return nil
+	}
+
+	cols, err := qe.describeColumns(query, described, binds)
+	if err != nil {
+		return err
+	}
+	if len(cols) == 0 {
+		qe.mb.queueMessages(&pgproto3.NoData{})
+		return nil
+	}
+	qe.mb.queueMessages(toRowDescription(cols))
+	return nil
+}
+
+// describeColumns runs the describing query on the backend the query is
+// routed to. Temporary tables are not shipped to Vertica for it, a query
+// referencing them is described by Postgres, which has them and the tables
+// of the synchronized schemas.
+func (qe *QueryExecutor) describeColumns(query, described string, binds []interface{}) (cols []*sql.ColumnType, err error) {
+	err = qe.runRouted(query, func(route Route) error {
+		var stmt *sql.Stmt
+		var order []int
+		var err error
+		if route == RouteVertica && len(qe.referencedTempTables(query)) == 0 {
+			rewrittenQuery, err := qe.queryUtil.rewriteQuery(described)
+			if err != nil {
+				return err
+			}
+			rewrittenQuery, order = positionalPlaceholders(rewrittenQuery)
+			Logger.Info("Describe query on vertica", "query", rewrittenQuery)
+			stmt, err = qe.conn.vlease.prepare(qe.ctx, qe.conn.vdb, rewrittenQuery)
+			if err != nil {
+				return err
+			}
 		} else {
-			return fmt.Errorf("unknown prepared statement: %s", msg.Name)
+			Logger.Info("Describe query on postgres", "query", described)
+			stmt, err = qe.conn.pglease.prepare(qe.ctx, qe.conn.pgdb, described)
+			if err != nil {
+				return err
+			}
 		}
-	} else {
-		preparedStatement = qe.currPreparedStatement
+
+		rows, err := stmt.QueryContext(qe.ctx, placeholderArgs(binds, order)...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		cols, err = rows.ColumnTypes()
+		return err
+	})
+	return cols, err
+}
+
+// describeQuery wraps a query into one returning its columns and no rows,
+// both backends plan it without running the query.
+func describeQuery(query string) string {
+	query = strings.TrimRight(strings.TrimSpace(query), ";")
+	return fmt.Sprintf("SELECT * FROM (%s) AS pgvertica_describe LIMIT 0", query)
+}
+
+// describeReturningQuery turns an INSERT, UPDATE or DELETE with RETURNING
+// into a query selecting the RETURNING list from its table, and the FROM or
+// USING relations, without rows. It is empty for other statements. tokens
+// must not contain comments.
+func describeReturningQuery(query string, tokens []sqlToken) string {
+	var i int
+	switch {
+	case len(tokens) > 2 && tokens[0].isKeyword("INSERT") && tokens[1].isKeyword("INTO"):
+		i = 2
+	case len(tokens) > 1 && tokens[0].isKeyword("UPDATE"):
+		i = skipKeywords(tokens, 1, "ONLY")
+	case len(tokens) > 2 && tokens[0].isKeyword("DELETE") && tokens[1].isKeyword("FROM"):
+		i = skipKeywords(tokens, 2, "ONLY")
+	default:
+		return ""
 	}
 
-	query := preparedStatement.getQuery()
-	if qe.queryUtil.queryReturnsNoRows(query) || qe.queryUtil.queryShouldReturnEmptyResponse(query) || qe.queryUtil.isDeclareCursorQuery(query) {
-		switch msg.ObjectType {
-		case 'S':
-			qe.mb.queueMessages(&pgproto3.ParameterDescription{}, &pgproto3.NoData{})
-			return nil
-		case 'P':
-			qe.mb.queueMessages(&pgproto3.NoData{})
+	// the table, its schema and its alias
+	if i >= len(tokens) || !tokens[i].isName() {
+		return ""
+	}
+	start := i
+	for i++; i+1 < len(tokens) && tokens[i].isOperator(".") && tokens[i+1].isName(); i += 2 {
+	}
+	table := tokenSpan(query, tokens[start], tokens[i-1])
+	if i < len(tokens) && tokens[i].isOperator("*") {
+		i++
+	}
+	alias := ""
+	if i+1 < len(tokens) && tokens[i].isKeyword("AS") && tokens[i+1].isName() {
+		alias, i = tokens[i+1].text, i+2
+	} else if !tokens[0].isKeyword("INSERT") && i < len(tokens) && tokens[i].isName() && !isAliasStopKeyword(tokens[i]) {
+		alias, i = tokens[i].text, i+1
+	}
+
+	// the FROM or USING list and the RETURNING list, outside parentheses
+	from, fromEnd, returning := -1, -1, -1
+	for depth, j := 0, i; j < len(tokens); j++ {
+		switch {
+		case tokens[j].isOperator("("):
+			depth++
+		case tokens[j].isOperator(")"):
+			depth--
+		case depth > 0 || returning >= 0:
+		case tokens[j].isKeyword("WHERE"), tokens[j].isKeyword("RETURNING"):
+			if from >= 0 && fromEnd < 0 {
+				fromEnd = j
+			}
+			if tokens[j].isKeyword("RETURNING") {
+				returning = j
+			}
+		case from < 0 && (tokens[0].isKeyword("UPDATE") && tokens[j].isKeyword("FROM") || tokens[0].isKeyword("DELETE") && tokens[j].isKeyword("USING")):
+			from = j + 1
+		}
+	}
+	if returning < 0 || returning+1 >= len(tokens) {
+		return ""
+	}
+
+	relations := table
+	if alias != "" {
+		relations += " AS " + alias
+	}
+	if from >= 0 && fromEnd > from {
+		relations += ", " + tokenSpan(query, tokens[from], tokens[fromEnd-1])
+	}
+	list := strings.TrimRight(strings.TrimSpace(query[tokens[returning+1].pos:]), ";")
+	return fmt.Sprintf("SELECT %s FROM %s LIMIT 0", list, relations)
+}
+
+// tokenSpan returns the query text from the first token to the last one.
+func tokenSpan(query string, first, last sqlToken) string {
+	return query[first.pos : last.pos+len(last.text)]
+}
+
+// hasKeyword reports whether one of the tokens is the keyword.
+func hasKeyword(tokens []sqlToken, keyword string) bool {
+	for _, token := range tokens {
+		if token.isKeyword(keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleExecute runs a portal. With maxRows, at most that many rows are
+// sent followed by PortalSuspended, the portal keeps its rows open and the
+// next Execute continues from there. Executing a completed portal only
+// sends CommandComplete.
+func (qe *QueryExecutor) handleExecute(portal *Portal, maxRows int) error {
+	if portal.done {
+		qe.mb.queueMessages(&pgproto3.CommandComplete{CommandTag: []byte(getCommandTag(portal.statement.query))})
+		return nil
+	}
+	if portal.rows == nil {
+		done, err := qe.runPortal(portal)
+		if err != nil {
+			return err
+		}
+		if done {
+			portal.done = true
 			return nil
-		default:
-			return fmt.Errorf("unexpected object type: %c", msg.ObjectType)
 		}
 	}
 
-	rows, cols, err := qe.executePreparedStatement(preparedStatement, true)
+	suspended, err := qe.writeRowsInChunks(portal.rows, portal.cols, maxRows)
 	if err != nil {
-		qe.mb.queueMessages(
-			qe.getErrorResponse(err),
-		)
-		qe.mb.sendQueuedMessages()
-		return fmt.Errorf("exec: %w", err)
+		portal.close()
+		return err
 	}
-
-	defer rows.Close()
-	switch msg.ObjectType {
-	case 'S':
-		qe.mb.queueMessages(
-			&pgproto3.ParameterDescription{ParameterOIDs: preparedStatement.parameterOIDs},
-			toRowDescription(cols),
-		)
-	case 'P':
-		qe.mb.queueMessages(
-			toRowDescription(cols),
-		)
-	default:
-		return fmt.Errorf("unexpected object type: %c", msg.ObjectType)
+	if suspended {
+		qe.mb.queueMessages(&pgproto3.PortalSuspended{})
+		return nil
 	}
+	portal.close()
+	portal.done = true
+	qe.mb.queueMessages(
+		&pgproto3.CommandComplete{CommandTag: []byte(getCommandTag(portal.statement.query))},
+	)
 	return nil
 }
 
-func (qe *QueryExecutor) handleExecute(preparedStatement *PreparedStatement) error {
-	query := preparedStatement.getQuery()
+// runPortal runs the statement of a portal. It is done when the statement
+// returns no rows, otherwise the portal holds them.
+func (qe *QueryExecutor) runPortal(portal *Portal) (done bool, err error) {
+	preparedStatement := portal.statement
+	query := preparedStatement.query
 	commandTag := getCommandTag(query)
 
 	if qe.queryUtil.isDeallocateQuery(query) {
-		qe.mb.queueMessages(
-			&pgproto3.CommandComplete{CommandTag: []byte(commandTag)},
-			&pgproto3.ReadyForQuery{TxStatus: qe.getTransactionStatus()},
-		)
-		return nil
+		qe.mb.queueMessages(&pgproto3.CommandComplete{CommandTag: []byte(commandTag)})
+		return true, nil
 	}
 
 	if qe.queryUtil.isCloseQuery(query) {
 		qe.closeCursor(query)
-		qe.mb.queueMessages(
-			&pgproto3.CommandComplete{CommandTag: []byte(commandTag)},
-			&pgproto3.ReadyForQuery{TxStatus: qe.getTransactionStatus()},
-		)
-		return nil
+		qe.mb.queueMessages(&pgproto3.CommandComplete{CommandTag: []byte(commandTag)})
+		return true, nil
 	}
 
 	if qe.queryUtil.isDeclareCursorQuery(query) {
-		qe.declareCursor(query)
-		return nil
+		return true, qe.declareCursor(query, portal.binds)
 	}
 
 	if qe.queryUtil.isFetchQuery(query) {
-		qe.fetchFromCursor(query)
-		return nil
+		return true, qe.fetchFromCursor(query)
 	}
 
-	rows, cols, err := qe.executePreparedStatement(preparedStatement, false)
-
+	rows, cols, err := qe.executePreparedStatement(preparedStatement, portal.binds)
 	if err != nil {
-		qe.mb.queueMessages(
-			qe.getErrorResponse(err),
-		)
-
-		qe.mb.sendQueuedMessages()
-		return err
+		return true, err
 	}
 
-	defer rows.Close()
-
+	qe.followVerticaSettings(query)
+	qe.trackTempTables(query)
 	if qe.queryUtil.isBeginQuery(query) {
 		qe.inTransaction = true
 	}
 
 	if qe.queryUtil.queryDiscardsTransaction(query) {
 		qe.inTransaction = false
+		qe.closePortals()
 	}
 
-	if qe.queryUtil.isSetQuery(query) {
-		param, value, parseErr := parseSetQuery(query)
-		if parseErr != nil {
-			Logger.Error("Error parsing set query", "query", query, "error", parseErr)
-			qe.mb.queueMessages(&pgproto3.CommandComplete{CommandTag: []byte(commandTag)})
-			return nil
-		} else {
-			qe.mb.queueMessages(
-				&pgproto3.ParameterStatus{Name: param, Value: value},
-				&pgproto3.CommandComplete{CommandTag: []byte(commandTag)},
-			)
-			return nil
-		}
-	}
-
-	if qe.queryUtil.queryReturnsNoRows(query) {
+	switch {
+	case qe.queryUtil.isSetQuery(query):
+		qe.queueParameterStatus(query)
+		qe.rememberSetQuery(query)
+		qe.mb.queueMessages(&pgproto3.CommandComplete{CommandTag: []byte(commandTag)})
+	case qe.queryUtil.queryReturnsNoRows(query):
 		qe.mb.queueMessages(
 			&pgproto3.CommandComplete{CommandTag: []byte(commandTag)},
 		)
-		return nil
-	}
-
-	if qe.queryUtil.queryShouldReturnEmptyResponse(query) {
+	case qe.queryUtil.queryShouldReturnEmptyResponse(query):
 		qe.mb.queueMessages(
 			&pgproto3.EmptyQueryResponse{},
 			&pgproto3.CommandComplete{CommandTag: []byte(commandTag)},
 		)
-		return nil
+	default:
+		portal.rows, portal.cols = rows, cols
+		return false, nil
 	}
+	rows.Close()
+	return true, nil
+}
 
-	err = qe.writeRowsInChunks(rows, cols)
-	if err != nil {
-		return err
+// closePortals drops the portals at the end of a transaction, closing the
+// rows of suspended ones.
+func (qe *QueryExecutor) closePortals() {
+	for name, portal := range qe.portals {
+		portal.close()
+		delete(qe.portals, name)
 	}
+}
 
-	qe.mb.queueMessages(
-		&pgproto3.CommandComplete{CommandTag: []byte(commandTag)},
-	)
-	return err
+// hasSuspendedPortal reports whether a portal holds rows of a backend
+// connection.
+func (qe *QueryExecutor) hasSuspendedPortal() bool {
+	for _, portal := range qe.portals {
+		if portal.rows != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// queueParameterStatus reports the new value of a parameter changed by a
+// successful SET query, like Postgres does for its reported parameters.
+func (qe *QueryExecutor) queueParameterStatus(query string) {
+	if !qe.queryUtil.isSetQuery(query) {
+		return
+	}
+	if status := setQueryParameterStatus(query, qe.conn.parameterStatus); status != nil {
+		if status.Name == "application_name" {
+			qe.applicationName = status.Value
+		}
+		qe.mb.queueMessages(status)
+	}
+}
+
+// rememberSetQuery keeps a setting changed by the client, so it follows
+// the session to the Postgres connections it leases later.
+func (qe *QueryExecutor) rememberSetQuery(query string) {
+	if !qe.queryUtil.isSetQuery(query) || isSetLocalQuery(query) {
+		return
+	}
+	qe.conn.pglease.remember(query, postgresSessionReset)
+}
+
+// followVerticaSettings applies to Vertica the session settings a
+// successful SET, RESET or DISCARD ALL changed on Postgres, translated like
+// the startup ones. They are added to the setup of the Vertica lease and
+// run on the Vertica connection the session holds, if any.
+func (qe *QueryExecutor) followVerticaSettings(query string) {
+	tokens := significantTokens(tokenizeSQL(query))
+	switch {
+	case len(tokens) < 2:
+	case tokens[0].isKeyword("SET") && !isSetLocalQuery(query):
+		param, value, err := parseSetStatement(query)
+		if err != nil {
+			return
+		}
+		if strings.EqualFold(value, "DEFAULT") {
+			qe.restoreVerticaSetting(strings.ToLower(param))
+		} else {
+			qe.changeVerticaSetting(strings.ToLower(param), value)
+		}
+	case tokens[0].isKeyword("RESET") && tokens[1].isKeyword("ALL"), tokens[0].isKeyword("DISCARD") && tokens[1].isKeyword("ALL"):
+		for _, name := range verticaRuntimeSettings {
+			qe.restoreVerticaSetting(name)
+		}
+	case tokens[0].isKeyword("RESET"):
+		qe.restoreVerticaSetting(strings.ToLower(tokens[1].value))
+	}
+}
+
+// changeVerticaSetting sets a session setting on Vertica.
+func (qe *QueryExecutor) changeVerticaSetting(name, value string) {
+	if !contains(verticaRuntimeSettings, name) {
+		return
+	}
+	if name == "search_path" {
+		qe.searchPath = value
+	}
+	for _, statement := range verticaSessionStatements(map[string]string{name: value}) {
+		qe.conn.vlease.remember(statement, verticaSessionReset)
+		qe.applyVerticaSetting(statement)
+	}
+}
+
+// restoreVerticaSetting brings a session setting back to the value
+// requested at startup, or to the Vertica default.
+func (qe *QueryExecutor) restoreVerticaSetting(name string) {
+	if !contains(verticaRuntimeSettings, name) {
+		return
+	}
+	if value, ok := qe.conn.settings[name]; ok {
+		qe.changeVerticaSetting(name, value)
+		return
+	}
+	if name == "search_path" {
+		qe.searchPath = ""
+	}
+	qe.conn.vlease.forget(name)
+	if statement := verticaSettingReset(name); statement != "" {
+		qe.applyVerticaSetting(statement)
+	}
+}
+
+// applyVerticaSetting runs a setting statement on the held Vertica
+// connection, connections leased later get it from the setup.
+func (qe *QueryExecutor) applyVerticaSetting(statement string) {
+	if qe.conn.vlease.conn == nil {
+		return
+	}
+	if _, err := qe.conn.vlease.conn.ExecContext(qe.ctx, statement); err != nil {
+		Logger.Warn("Can't apply session setting to Vertica", "statement", statement, "error", err)
+	}
+}
+
+// idle reports whether the session sent ReadyForQuery and holds nothing
+// a following message could still use: no transaction, cursor or portal.
+func (qe *QueryExecutor) idle() bool {
+	return !qe.awaitingSync && !qe.inTransaction && len(qe.cursors) == 0 && len(qe.portals) == 0
+}
+
+// releaseBackends returns the leased connections to their pools, unless a
+// transaction, a cursor or a suspended portal still needs them. The Postgres
+// connection holding the temporary tables of the session is kept until they
+// are dropped.
+func (qe *QueryExecutor) releaseBackends() {
+	if qe.inTransaction || len(qe.cursors) > 0 || qe.hasSuspendedPortal() {
+		return
+	}
+	qe.conn.vlease.release()
+	if len(qe.tempTables) == 0 {
+		qe.conn.pglease.release()
+	}
+}
+
+// close ends the session. Connections left in a transaction are discarded,
+// the pool must not hand them out with the transaction still open, and so
+// is the Postgres connection holding temporary tables.
+func (qe *QueryExecutor) close() {
+	for name, cursor := range qe.cursors {
+		cursor.close()
+		delete(qe.cursors, name)
+	}
+	qe.closePortals()
+	if qe.inTransaction {
+		qe.conn.vlease.discard()
+		qe.conn.pglease.discard()
+		return
+	}
+	qe.releaseBackends()
+	if len(qe.tempTables) > 0 {
+		qe.conn.pglease.discard()
+	}
 }
 
-func (qe *QueryExecutor) writeRowsInChunks(rows *sql.Rows, cols []*sql.ColumnType) error {
+// writeRowsInChunks sends the rows, at most maxRows of them unless it is 0.
+// suspended reports it stopped after maxRows rows.
+func (qe *QueryExecutor) writeRowsInChunks(rows *sql.Rows, cols []*sql.ColumnType, maxRows int) (suspended bool, err error) {
 	if err := qe.mb.sendQueuedMessages(); err != nil {
-		return err
+		return false, err
 	}
 
 	if err := rows.Err(); err != nil {
-		return fmt.Errorf("rows: %w", err)
+		return false, fmt.Errorf("rows: %w", err)
 	}
 
-	for rows.Next() {
+	sent := 0
+	for (maxRows <= 0 || sent < maxRows) && rows.Next() {
 		row, err := scanRowToText(rows, cols)
 		if err != nil {
-			return fmt.Errorf("scan: %w", err)
+			return false, fmt.Errorf("scan: %w", err)
 		}
 
 		qe.mb.queueMessages(row)
+		sent++
 		if qe.mb.buffSize() >= qe.maxBufferSize {
 			if err := qe.mb.sendQueuedMessages(); err != nil {
-				return err
+				return false, err
 			}
 		}
 	}
+	// rows stop early when the query is canceled
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	suspended = maxRows > 0 && sent == maxRows
 	if qe.mb.buffSize() > 0 {
-		return qe.mb.sendQueuedMessages()
+		return suspended, qe.mb.sendQueuedMessages()
 	}
-	return nil
+	return suspended, nil
 }
@@ -4,13 +4,20 @@ import (
 	"bytes"
 	"context"
 	"net"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 type MockConn struct {
@@ -60,6 +67,10 @@ func (m *MockReceiver) ReceiveStartupMessage() (pgproto3.FrontendMessage, error)
 	return args.Get(0).(pgproto3.FrontendMessage), args.Error(1)
 }
 
+func (m *MockReceiver) SetAuthType(authType uint32) error {
+	return nil
+}
+
 type MockMessageBuffer struct {
 }
 
@@ -79,6 +90,7 @@ func newMockedQueryExecutor() QueryExecutor {
 		ctx:                context.Background(),
 		conn:               &Conn{Conn: &MockConn{}, receiver: nil, vdb: nil, pgdb: nil},
 		preparedStatements: make(map[string]*PreparedStatement),
+		portals:            make(map[string]*Portal),
 		queryUtil:          mockedQueryUtil(),
 		mb:                 &MockMessageBuffer{},
 		inTransaction:      false,
@@ -110,45 +122,37 @@ func TestGetTransactionStatus(t *testing.T) {
 	})
 }
 
-func TestHandleBindMessage(t *testing.T) {
+func TestHandleBind(t *testing.T) {
 	t.Run("PreparedStatement does not exist", func(t *testing.T) {
 		qe := newMockedQueryExecutor()
 
-		bmsg := &pgproto3.Bind{
-			PreparedStatement: "does_not_exist",
-		}
-
-		err := qe.handleBindMessage(bmsg)
-		assert.NotNil(t, err)
+		err := qe.handleBind(&pgproto3.Bind{PreparedStatement: "does_not_exist"})
+		require.Error(t, err)
+		assert.Equal(t, invalidSQLStatementNameCode, qe.getErrorResponse(err).Code)
 	})
 
 	t.Run("PreparedStatement exists", func(t *testing.T) {
 		qe := newMockedQueryExecutor()
-		mockReceiver := new(MockReceiver)
-		mockReceiver.On("Receive").Return(&pgproto3.Sync{}, nil).Once()
-
-		c := &Conn{
-			pgdb:     nil,
-			vdb:      nil,
-			Conn:     &MockConn{},
-			receiver: mockReceiver,
-		}
-		qe.conn = c
 		qe.preparedStatements = map[string]*PreparedStatement{
 			"exists": {
 				name:          "exists",
-				query:         "SELECT * FROM users WHERE id = ?",
-				parameterOIDs: []uint32{0},
+				query:         "SELECT * FROM users WHERE id = $1",
+				parameterOIDs: []uint32{pgtype.Int4OID},
 			},
 		}
 		bmsg := &pgproto3.Bind{
+			DestinationPortal:    "p1",
 			PreparedStatement:    "exists",
-			Parameters:           [][]byte{[]byte("1111")},
+			Parameters:           [][]byte{{0, 0, 4, 87}},
 			ParameterFormatCodes: []int16{1},
 		}
 
-		err := qe.handleBindMessage(bmsg)
-		assert.Nil(t, err)
+		require.NoError(t, qe.handleBind(bmsg))
+		assert.Equal(t, &Portal{name: "p1", statement: qe.preparedStatements["exists"], binds: []interface{}{"1111"}}, qe.portals["p1"])
+
+		err := qe.handleBind(bmsg)
+		require.Error(t, err)
+		assert.Equal(t, duplicateCursorCode, qe.getErrorResponse(err).Code)
 	})
 }
 
@@ -174,159 +178,567 @@ func TestHandleQueryMessage(t *testing.T) {
 	assert.NoError(t, err)
 }
 
-func TestHandlePreparedStatement__HandleBind(t *testing.T) {
+func TestHandleExtendedMessage_Pipeline(t *testing.T) {
 	db, mock, err := sqlmock.New()
-	assert.NoError(t, err)
+	require.NoError(t, err)
+	defer db.Close()
 
+	mockConn := &MockConn{}
 	qe := newMockedQueryExecutor()
+	qe.conn.pgdb = db
+	qe.conn.vdb = db
+	qe.mb = newMessagesBuffer(mockConn)
+
+	mock.ExpectPrepare(`SELECT \$1::int`).ExpectQuery().WithArgs("7").WillReturnRows(sqlmock.NewRows([]string{"n"}).AddRow("7"))
+	mock.ExpectPrepare(`SELECT \$1::int`).ExpectQuery().WithArgs("7").WillReturnRows(sqlmock.NewRows([]string{"n"}).AddRow("7"))
+	mock.ExpectPrepare("SELECT 2").ExpectQuery().WillReturnRows(sqlmock.NewRows([]string{"n"}).AddRow("2"))
+
+	for _, msg := range []pgproto3.FrontendMessage{
+		&pgproto3.Parse{Name: "s1", Query: "SELECT $1::int", ParameterOIDs: []uint32{pgtype.Int4OID}},
+		&pgproto3.Parse{Query: "SELECT 2"},
+		&pgproto3.Bind{DestinationPortal: "p1", PreparedStatement: "s1", Parameters: [][]byte{[]byte("7")}},
+		&pgproto3.Bind{},
+		&pgproto3.Describe{ObjectType: 'P', Name: "p1"},
+		&pgproto3.Execute{Portal: "p1"},
+		&pgproto3.Execute{},
+		&pgproto3.Close{ObjectType: 'P', Name: "p1"},
+	} {
+		require.NoError(t, qe.handleExtendedMessage(msg))
+	}
+	require.NoError(t, qe.handleSync())
+	assert.NoError(t, mock.ExpectationsWereMet())
 
-	mockReceiver := new(MockReceiver)
-	mockReceiver.On("Receive").Return(&pgproto3.Bind{}, nil).Once().On("Receive").Return(&pgproto3.Sync{}, nil).Once()
-
-	c := &Conn{
-		pgdb:     db,
-		vdb:      db,
-		Conn:     &MockConn{},
-		receiver: mockReceiver,
+	messages := writtenMessages(mockConn.buf.Bytes())
+	expected := []pgproto3.BackendMessage{
+		&pgproto3.ParseComplete{}, &pgproto3.ParseComplete{}, &pgproto3.BindComplete{}, &pgproto3.BindComplete{},
+		&pgproto3.RowDescription{}, &pgproto3.DataRow{}, &pgproto3.CommandComplete{}, &pgproto3.DataRow{},
+		&pgproto3.CommandComplete{}, &pgproto3.CloseComplete{}, &pgproto3.ReadyForQuery{},
+	}
+	if assert.Len(t, messages, len(expected)) {
+		for i := range expected {
+			assert.IsType(t, expected[i], messages[i], i)
+		}
+		assert.Equal(t, "SELECT 1", string(messages[6].(*pgproto3.CommandComplete).CommandTag))
 	}
-	qe.conn = c
+	assert.Contains(t, qe.preparedStatements, "s1")
+	// Sync ends the implicit transaction and its portals
+	assert.Empty(t, qe.portals)
+}
 
-	ps := &PreparedStatement{
-		name:          "test_name",
-		query:         "SELECT 1",
-		parameterOIDs: []uint32{},
-		parameters:    nil,
-		binds:         nil,
+func TestHandleExtendedMessage_SkipUntilSync(t *testing.T) {
+	mockConn := &MockConn{}
+	qe := newMockedQueryExecutor()
+	qe.mb = newMessagesBuffer(mockConn)
+
+	assert.Error(t, qe.handleExtendedMessage(&pgproto3.Bind{PreparedStatement: "missing"}))
+	// skipped, the unnamed portal doesn't exist either
+	assert.NoError(t, qe.handleExtendedMessage(&pgproto3.Execute{}))
+	require.NoError(t, qe.handleSync())
+	assert.NoError(t, qe.handleExtendedMessage(&pgproto3.Parse{Name: "s1", Query: "SELECT 1"}))
+	assert.Error(t, qe.handleExtendedMessage(&pgproto3.Parse{Name: "s1", Query: "SELECT 1"}))
+	require.NoError(t, qe.handleSync())
+
+	messages := writtenMessages(mockConn.buf.Bytes())
+	if assert.Len(t, messages, 5) {
+		assert.Equal(t, invalidSQLStatementNameCode, messages[0].(*pgproto3.ErrorResponse).Code)
+		assert.IsType(t, &pgproto3.ReadyForQuery{}, messages[1])
+		assert.IsType(t, &pgproto3.ParseComplete{}, messages[2])
+		assert.Equal(t, duplicatePreparedStatementCode, messages[3].(*pgproto3.ErrorResponse).Code)
+		assert.IsType(t, &pgproto3.ReadyForQuery{}, messages[4])
 	}
+}
 
-	err = qe.handlePreparedStatement(ps)
-	assert.NoError(t, err)
+func TestHandleExecuteMessage_UnknownPortal(t *testing.T) {
+	qe := newMockedQueryExecutor()
 
-	assert.NoError(t, mock.ExpectationsWereMet())
+	err := qe.handleExecuteMessage(&pgproto3.Execute{Portal: "p1"})
+	require.Error(t, err)
+	assert.Equal(t, invalidCursorNameCode, qe.getErrorResponse(err).Code)
 }
 
-func TestHandlePreparedStatement__HandleDescribe(t *testing.T) {
+func TestHandleDescribe_Statement(t *testing.T) {
 	db, mock, err := sqlmock.New()
-	assert.NoError(t, err)
+	require.NoError(t, err)
+	defer db.Close()
 
-	mockReceiver := new(MockReceiver)
-	mockReceiver.On("Receive").Return(&pgproto3.Describe{ObjectType: 'S'}, nil).Once().On("Receive").Return(&pgproto3.Sync{}, nil).Once()
+	mockConn := &MockConn{}
+	qe := newMockedQueryExecutor()
+	qe.conn.pgdb = db
+	qe.mb = newMessagesBuffer(mockConn)
+	qe.preparedStatements["s1"] = &PreparedStatement{name: "s1", query: "SELECT * FROM users WHERE id = $1", parameterOIDs: []uint32{pgtype.Int4OID}}
+	qe.preparedStatements["s2"] = &PreparedStatement{name: "s2", query: "BEGIN"}
+
+	mock.ExpectPrepare(regexp.QuoteMeta("SELECT * FROM (SELECT * FROM users WHERE id = $1) AS pgvertica_describe LIMIT 0")).
+		ExpectQuery().WithArgs(nil).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	require.NoError(t, qe.handleDescribe(&pgproto3.Describe{ObjectType: 'S', Name: "s1"}))
+	require.NoError(t, qe.handleDescribe(&pgproto3.Describe{ObjectType: 'S', Name: "s2"}))
+	require.NoError(t, qe.mb.sendQueuedMessages())
+	assert.NoError(t, mock.ExpectationsWereMet())
 
-	c := &Conn{
-		pgdb:     db,
-		vdb:      db,
-		Conn:     &MockConn{},
-		receiver: mockReceiver,
+	messages := writtenMessages(mockConn.buf.Bytes())
+	if assert.Len(t, messages, 4) {
+		assert.IsType(t, &pgproto3.ParameterDescription{}, messages[0])
+		assert.IsType(t, &pgproto3.RowDescription{}, messages[1])
+		assert.IsType(t, &pgproto3.ParameterDescription{}, messages[2])
+		assert.IsType(t, &pgproto3.NoData{}, messages[3])
 	}
+}
+
+func TestHandleDescribe_WithoutSideEffects(t *testing.T) {
+	vdb, vmock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	require.NoError(t, err)
+	defer vdb.Close()
+	pgdb, pgmock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	require.NoError(t, err)
+	defer pgdb.Close()
 
+	mockConn := &MockConn{}
 	qe := newMockedQueryExecutor()
-	qe.conn = c
+	qe.conn.vdb, qe.conn.pgdb = vdb, pgdb
+	qe.mb = newMessagesBuffer(mockConn)
+	qe.synchronizedSchemas = []string{"sales"}
+	qe.federationMaxRows = 100
+	qe.tempTables = map[string]struct{}{"top_customers": {}}
+	require.NoError(t, qe.handleParse(&pgproto3.Parse{Name: "ins", Query: "INSERT INTO users (name) VALUES ('a')"}))
+	require.NoError(t, qe.handleParse(&pgproto3.Parse{Name: "ret", Query: "INSERT INTO users (name) VALUES ('b') RETURNING id"}))
+	require.NoError(t, qe.handleParse(&pgproto3.Parse{Name: "fed", Query: "SELECT * FROM sales.orders JOIN top_customers USING (customer_id)"}))
+	require.NoError(t, qe.handleBind(&pgproto3.Bind{DestinationPortal: "p1", PreparedStatement: "ins"}))
+	require.NoError(t, qe.handleBind(&pgproto3.Bind{DestinationPortal: "p2", PreparedStatement: "ret"}))
+	require.NoError(t, qe.handleBind(&pgproto3.Bind{DestinationPortal: "p3", PreparedStatement: "fed"}))
+
+	// without RETURNING the statement has no columns and is not run
+	require.NoError(t, qe.handleDescribe(&pgproto3.Describe{ObjectType: 'P', Name: "p1"}))
+
+	// with RETURNING its columns are selected from the table, the Execute
+	// runs the statement once
+	pgmock.ExpectPrepare("SELECT id FROM users LIMIT 0").ExpectQuery().WillReturnRows(
+		sqlmock.NewRowsWithColumnDefinition(sqlmock.NewColumn("id").OfType("INT4", int64(0))))
+	pgmock.ExpectPrepare("INSERT INTO users (name) VALUES ('b') RETURNING id").ExpectQuery().WillReturnRows(
+		sqlmock.NewRowsWithColumnDefinition(sqlmock.NewColumn("id").OfType("INT4", int64(0))).AddRow(int64(7)))
+	require.NoError(t, qe.handleDescribe(&pgproto3.Describe{ObjectType: 'P', Name: "p2"}))
+	require.NoError(t, qe.handleExecute(qe.portals["p2"], 0))
+
+	// a federated query is described by Postgres, no temporary table is
+	// shipped to Vertica
+	pgmock.ExpectPrepare("SELECT * FROM (SELECT * FROM sales.orders JOIN top_customers USING (customer_id)) AS pgvertica_describe LIMIT 0").
+		ExpectQuery().WillReturnRows(sqlmock.NewRows([]string{"customer_id"}))
+	require.NoError(t, qe.handleDescribe(&pgproto3.Describe{ObjectType: 'P', Name: "p3"}))
+
+	require.NoError(t, qe.mb.sendQueuedMessages())
+	assert.NoError(t, pgmock.ExpectationsWereMet())
+	assert.NoError(t, vmock.ExpectationsWereMet())
+	assert.Nil(t, qe.conn.vlease.conn)
+
+	assert.Equal(t, []string{"ParseComplete", "ParseComplete", "ParseComplete", "BindComplete", "BindComplete", "BindComplete",
+		"NoData", "RowDescription", "DataRow", "CommandComplete", "RowDescription"}, writtenMessageTypes(mockConn.buf.Bytes()))
+}
 
-	ps := &PreparedStatement{
-		name:          "test_name",
-		query:         "SELECT 1",
-		parameterOIDs: []uint32{},
-		parameters:    nil,
-		binds:         nil,
+func TestDescribeReturningQuery(t *testing.T) {
+	testCases := []struct {
+		desc, query, expected string
+	}{
+		{desc: "insert", query: "INSERT INTO public.users AS u (name) VALUES ($1) ON CONFLICT (name) DO UPDATE SET name = 'x' RETURNING u.id, name;",
+			expected: "SELECT u.id, name FROM public.users AS u LIMIT 0"},
+		{desc: "update with FROM", query: "UPDATE ONLY users u SET name = o.name FROM (SELECT 1) AS s, orders o WHERE o.user_id = u.id RETURNING u.id, o.total",
+			expected: "SELECT u.id, o.total FROM users AS u, (SELECT 1) AS s, orders o LIMIT 0"},
+		{desc: "delete with USING", query: `DELETE FROM "Users" USING orders WHERE orders.user_id = "Users".id RETURNING *`,
+			expected: `SELECT * FROM "Users", orders LIMIT 0`},
+		{desc: "delete without RETURNING", query: "DELETE FROM users WHERE id IN (SELECT id FROM old RETURNING id)"},
+		{desc: "select", query: "SELECT 1"},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			assert.Equal(t, tC.expected, describeReturningQuery(tC.query, significantTokens(tokenizeSQL(tC.query))))
+		})
 	}
-	mock.ExpectPrepare("SELECT 1").WillReturnError(nil)
-	mock.ExpectQuery("SELECT 1").WillReturnRows(sqlmock.NewRows([]string{"column"}).AddRow(1))
+}
 
-	err = qe.handlePreparedStatement(ps)
-	assert.NoError(t, err)
+func TestHandleClose(t *testing.T) {
+	qe := newMockedQueryExecutor()
+	require.NoError(t, qe.handleParse(&pgproto3.Parse{Name: "s1", Query: "SELECT 1"}))
+	require.NoError(t, qe.handleParse(&pgproto3.Parse{Name: "s2", Query: "SELECT 2"}))
+	require.NoError(t, qe.handleBind(&pgproto3.Bind{DestinationPortal: "p1", PreparedStatement: "s1"}))
+	require.NoError(t, qe.handleBind(&pgproto3.Bind{DestinationPortal: "p2", PreparedStatement: "s2"}))
+	require.NoError(t, qe.handleBind(&pgproto3.Bind{DestinationPortal: "p3", PreparedStatement: "s2"}))
+
+	qe.handleClose(&pgproto3.Close{ObjectType: 'P', Name: "p2"})
+	assert.Len(t, qe.portals, 2)
+	assert.Len(t, qe.preparedStatements, 2)
+
+	// closing a statement drops the portals bound to it
+	qe.handleClose(&pgproto3.Close{ObjectType: 'S', Name: "s1"})
+	assert.Equal(t, []string{"s2"}, mapKeys(qe.preparedStatements))
+	assert.Equal(t, []string{"p3"}, mapKeys(qe.portals))
+
+	qe.handleClose(&pgproto3.Close{ObjectType: 'S', Name: "missing"})
+	assert.Len(t, qe.preparedStatements, 1)
+}
 
-	assert.NoError(t, mock.ExpectationsWereMet())
+func mapKeys[V any](m map[string]V) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
-func TestHandlePreparedStatement__HandleExecute(t *testing.T) {
-	db, mock, err := sqlmock.New()
-	assert.NoError(t, err)
+func newMaxRowsQueryExecutor(t *testing.T) (*QueryExecutor, sqlmock.Sqlmock, *MockConn) {
+	vdb, vmock, err := sqlmock.New()
+	require.NoError(t, err)
+	t.Cleanup(func() { vdb.Close() })
+
+	mockConn := &MockConn{}
+	qe := newMockedQueryExecutor()
+	qe.conn.vdb = vdb
+	qe.mb = newMessagesBuffer(mockConn)
+	qe.synchronizedSchemas = []string{"sales"}
+	require.NoError(t, qe.handleParse(&pgproto3.Parse{Query: "SELECT id FROM sales.orders"}))
+	require.NoError(t, qe.handleBind(&pgproto3.Bind{}))
+	return &qe, vmock, mockConn
+}
+
+func writtenMessageTypes(written []byte) []string {
+	var types []string
+	for _, msg := range writtenMessages(written) {
+		types = append(types, reflect.TypeOf(msg).Elem().Name())
+	}
+	return types
+}
+
+func TestHandleExecute_MaxRows(t *testing.T) {
+	qe, vmock, mockConn := newMaxRowsQueryExecutor(t)
+	vmock.ExpectPrepare("SELECT id FROM sales.orders").ExpectQuery().
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1").AddRow("2").AddRow("3")).RowsWillBeClosed()
+
+	require.NoError(t, qe.handleExtendedMessage(&pgproto3.Execute{MaxRows: 2}))
+	qe.releaseBackends()
+	assert.NotNil(t, qe.conn.vlease.conn, "the suspended portal keeps its Vertica connection")
+	assert.NotNil(t, qe.portals[""].rows)
+
+	require.NoError(t, qe.handleExtendedMessage(&pgproto3.Execute{MaxRows: 2}))
+	assert.Nil(t, qe.portals[""].rows)
+	qe.releaseBackends()
+	assert.Nil(t, qe.conn.vlease.conn)
+	require.NoError(t, qe.handleSync())
+
+	assert.Equal(t, []string{"ParseComplete", "BindComplete", "DataRow", "DataRow", "PortalSuspended", "DataRow", "CommandComplete", "ReadyForQuery"},
+		writtenMessageTypes(mockConn.buf.Bytes()))
+	assert.NoError(t, vmock.ExpectationsWereMet())
+}
+
+func TestHandleExecute_MaxRowsExactly(t *testing.T) {
+	qe, vmock, mockConn := newMaxRowsQueryExecutor(t)
+	vmock.ExpectPrepare("SELECT id FROM sales.orders").ExpectQuery().
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
+
+	require.NoError(t, qe.handleExtendedMessage(&pgproto3.Execute{MaxRows: 1}))
+	require.NoError(t, qe.handleExtendedMessage(&pgproto3.Execute{MaxRows: 1}))
+	require.NoError(t, qe.handleSync())
+
+	assert.Equal(t, []string{"ParseComplete", "BindComplete", "DataRow", "PortalSuspended", "CommandComplete", "ReadyForQuery"},
+		writtenMessageTypes(mockConn.buf.Bytes()))
+	assert.NoError(t, vmock.ExpectationsWereMet())
+}
 
-	mockReceiver := new(MockReceiver)
-	mockReceiver.On("Receive").Return(&pgproto3.Execute{}, nil)
+func TestHandleExecute_CompletedPortal(t *testing.T) {
+	qe, vmock, mockConn := newMaxRowsQueryExecutor(t)
+	qe.inTransaction = true
+	vmock.ExpectPrepare("SELECT id FROM sales.orders").ExpectQuery().
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
+
+	require.NoError(t, qe.handleExtendedMessage(&pgproto3.Execute{}))
+	require.NoError(t, qe.handleSync())
+	// the portal of a transaction outlives the Sync, executing it again
+	// doesn't run the query
+	require.NoError(t, qe.handleExtendedMessage(&pgproto3.Execute{}))
+	require.NoError(t, qe.handleExtendedMessage(&pgproto3.Execute{}))
+	require.NoError(t, qe.handleSync())
+
+	assert.Equal(t, []string{"ParseComplete", "BindComplete", "DataRow", "CommandComplete", "ReadyForQuery", "CommandComplete", "CommandComplete", "ReadyForQuery"},
+		writtenMessageTypes(mockConn.buf.Bytes()))
+	assert.NoError(t, vmock.ExpectationsWereMet())
+}
 
-	c := &Conn{
-		pgdb:     db,
-		vdb:      db,
-		Conn:     &MockConn{},
-		receiver: mockReceiver,
+func TestHandleExecute_SuspendedPortalClosed(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		inTransaction bool
+		commit        bool
+		close         func(qe *QueryExecutor)
+	}{
+		{desc: "by Sync", close: func(qe *QueryExecutor) { require.NoError(t, qe.handleSync()) }},
+		{desc: "by Close", inTransaction: true, close: func(qe *QueryExecutor) {
+			require.NoError(t, qe.handleExtendedMessage(&pgproto3.Close{ObjectType: 'P'}))
+		}},
+		{desc: "at transaction end", inTransaction: true, commit: true, close: func(qe *QueryExecutor) {
+			require.NoError(t, qe.handleSync())
+			assert.NotEmpty(t, qe.portals, "Sync keeps the portals of a transaction")
+			require.NoError(t, qe.executeStatement("COMMIT"))
+		}},
 	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			qe, vmock, _ := newMaxRowsQueryExecutor(t)
+			qe.inTransaction = tC.inTransaction
+			vmock.ExpectPrepare("SELECT id FROM sales.orders").ExpectQuery().
+				WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1").AddRow("2")).RowsWillBeClosed()
+			if tC.commit {
+				qe.conn.pgdb = qe.conn.vdb
+				vmock.ExpectQuery("COMMIT").WillReturnRows(sqlmock.NewRows(nil))
+			}
+
+			require.NoError(t, qe.handleExtendedMessage(&pgproto3.Execute{MaxRows: 1}))
+			tC.close(qe)
+			assert.Empty(t, qe.portals)
+			assert.NoError(t, vmock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestExecutePreparedStatement_VerticaPlaceholders(t *testing.T) {
+	vdb, vmock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer vdb.Close()
 
 	qe := newMockedQueryExecutor()
-	qe.conn = c
+	qe.conn.vdb = vdb
+	qe.synchronizedSchemas = []string{"sales"}
 	ps := &PreparedStatement{
-		name:          "test_name",
-		query:         "SELECT 1",
-		parameterOIDs: []uint32{},
-		parameters:    nil,
-		binds:         nil,
+		query:         "SELECT * FROM sales.orders WHERE (customer = $2 OR seller = $2) AND note <> '$1' AND id > $1",
+		parameterOIDs: []uint32{pgtype.Int8OID, pgtype.TextOID},
 	}
-	mock.ExpectPrepare("SELECT 1").WillReturnError(nil)
-	mock.ExpectQuery("SELECT 1").WillReturnRows(sqlmock.NewRows([]string{"column"}).AddRow("1"))
+	binds, err := ps.bindParameters(pgproto3.Bind{Parameters: [][]byte{[]byte("10"), []byte("o'brien")}})
+	require.NoError(t, err)
 
-	err = qe.handlePreparedStatement(ps)
-	assert.NoError(t, err)
+	vmock.ExpectPrepare(regexp.QuoteMeta("SELECT * FROM sales.orders WHERE (customer = ? OR seller = ?) AND note <> '$1' AND id > ?"))
+	vmock.ExpectQuery("SELECT").WithArgs("o'brien", "o'brien", "10").WillReturnRows(sqlmock.NewRows([]string{"id"}))
 
-	assert.NoError(t, mock.ExpectationsWereMet())
+	rows, _, err := qe.executePreparedStatement(ps, binds)
+	require.NoError(t, err)
+	rows.Close()
+	assert.NoError(t, vmock.ExpectationsWereMet())
 }
 
-func TestHandlePreparedStatement__HandleSync(t *testing.T) {
-	db, mock, err := sqlmock.New()
-	assert.NoError(t, err)
+func TestExecutePreparedStatement_PostgresPlaceholders(t *testing.T) {
+	pgdb, pgmock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer pgdb.Close()
 
-	mockReceiver := new(MockReceiver)
-	mockReceiver.On("Receive").Return(&pgproto3.Sync{}, nil)
-
-	c := &Conn{
-		pgdb:     db,
-		vdb:      db,
-		Conn:     &MockConn{},
-		receiver: mockReceiver,
+	qe := newMockedQueryExecutor()
+	qe.conn.pgdb = pgdb
+	ps := &PreparedStatement{
+		query:         "SELECT * FROM public.users WHERE name = $2 AND id = $1",
+		parameterOIDs: []uint32{pgtype.Int8OID, pgtype.TextOID},
 	}
+	binds, err := ps.bindParameters(pgproto3.Bind{Parameters: [][]byte{[]byte("10"), []byte("alice")}})
+	require.NoError(t, err)
+
+	pgmock.ExpectPrepare(regexp.QuoteMeta("SELECT * FROM public.users WHERE name = $2 AND id = $1"))
+	pgmock.ExpectQuery("SELECT").WithArgs("10", "alice").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	rows, _, err := qe.executePreparedStatement(ps, binds)
+	require.NoError(t, err)
+	rows.Close()
+	assert.NoError(t, pgmock.ExpectationsWereMet())
+}
+
+func TestDeclareCursor_Placeholders(t *testing.T) {
+	vdb, vmock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer vdb.Close()
+
 	qe := newMockedQueryExecutor()
-	qe.conn = c
+	qe.conn.vdb = vdb
+	qe.synchronizedSchemas = []string{"sales"}
+	qe.cursors = make(map[string]*Cursor)
 
-	ps := &PreparedStatement{
-		name:          "test_name",
-		query:         "SELECT 1",
-		parameterOIDs: []uint32{},
-		parameters:    nil,
-		binds:         nil,
+	vmock.ExpectPrepare(regexp.QuoteMeta("SELECT id FROM sales.orders WHERE customer = ?"))
+	vmock.ExpectQuery("SELECT").WithArgs("acme").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	require.NoError(t, qe.declareCursor("DECLARE c BINARY CURSOR WITH HOLD FOR SELECT id FROM sales.orders WHERE customer = $1", []interface{}{"acme"}))
+	assert.NoError(t, vmock.ExpectationsWereMet())
+}
+
+func TestDeclareCursor_Routed(t *testing.T) {
+	vdb, vmock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer vdb.Close()
+	pgdb, pgmock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer pgdb.Close()
+
+	qe := newMockedQueryExecutor()
+	qe.conn.vdb, qe.conn.pgdb = vdb, pgdb
+	qe.synchronizedSchemas = []string{"sales"}
+	qe.cursors = make(map[string]*Cursor)
+	qe.routingRules, err = ParseRoutingRules(strings.NewReader("reject table=sales.salaries"))
+	require.NoError(t, err)
+
+	// a cursor on a Postgres table runs on Postgres with its placeholders
+	pgmock.ExpectPrepare(regexp.QuoteMeta("SELECT name FROM public.users WHERE id = $1"))
+	pgmock.ExpectQuery("SELECT").WithArgs(int64(7)).WillReturnRows(sqlmock.NewRows([]string{"name"}))
+	require.NoError(t, qe.declareCursor("DECLARE u BINARY CURSOR WITH HOLD FOR SELECT name FROM public.users WHERE id = $1", []interface{}{int64(7)}))
+	assert.Contains(t, qe.cursors, "u")
+
+	// so does one with a routing hint
+	pgmock.ExpectPrepare(regexp.QuoteMeta("/* pgvertica:route=postgres */ SELECT id FROM sales.orders"))
+	pgmock.ExpectQuery("SELECT").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	require.NoError(t, qe.declareCursor("DECLARE o BINARY CURSOR WITH HOLD FOR /* pgvertica:route=postgres */ SELECT id FROM sales.orders", nil))
+
+	// a rejected query opens no cursor
+	err = qe.declareCursor("DECLARE s BINARY CURSOR WITH HOLD FOR SELECT * FROM sales.salaries", nil)
+	var routingErr *routingError
+	assert.ErrorAs(t, err, &routingErr)
+	assert.NotContains(t, qe.cursors, "s")
+
+	assert.Nil(t, qe.conn.vlease.conn)
+	assert.NoError(t, vmock.ExpectationsWereMet())
+	assert.NoError(t, pgmock.ExpectationsWereMet())
+}
+
+func TestCursorKeywordsInQueries(t *testing.T) {
+	vdb, vmock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	require.NoError(t, err)
+	defer vdb.Close()
+
+	mockConn := &MockConn{}
+	qe := newMockedQueryExecutor()
+	qe.conn.vdb = vdb
+	qe.mb = newMessagesBuffer(mockConn)
+	qe.synchronizedSchemas = []string{"sales"}
+	qe.cursors = make(map[string]*Cursor)
+
+	// simple queries run as queries, not as cursor statements
+	vmock.ExpectQuery("SELECT id FROM sales.orders LIMIT 10").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
+	vmock.ExpectQuery("SELECT open, close FROM sales.prices").WillReturnRows(sqlmock.NewRows([]string{"open", "close"}).AddRow("1", "2"))
+	require.NoError(t, qe.handleQueryMessage(&pgproto3.Query{String: "SELECT id FROM sales.orders FETCH FIRST 10 ROWS ONLY; SELECT open, close FROM sales.prices"}))
+	assert.Equal(t, []string{"RowDescription", "DataRow", "CommandComplete", "RowDescription", "DataRow", "CommandComplete", "ReadyForQuery"},
+		writtenMessageTypes(mockConn.buf.Bytes()))
+
+	// and so do the statements of the extended protocol
+	mockConn.buf.Reset()
+	vmock.ExpectPrepare("SELECT id FROM sales.orders LIMIT 10").ExpectQuery().WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
+	require.NoError(t, qe.handleExtendedMessage(&pgproto3.Parse{Query: "SELECT id FROM sales.orders FETCH FIRST 10 ROWS ONLY"}))
+	require.NoError(t, qe.handleExtendedMessage(&pgproto3.Bind{}))
+	require.NoError(t, qe.handleExtendedMessage(&pgproto3.Execute{}))
+	require.NoError(t, qe.handleSync())
+	assert.Equal(t, []string{"ParseComplete", "BindComplete", "DataRow", "CommandComplete", "ReadyForQuery"},
+		writtenMessageTypes(mockConn.buf.Bytes()))
+
+	assert.Empty(t, qe.cursors)
+	assert.NoError(t, vmock.ExpectationsWereMet())
+}
+
+// writtenMessages decodes the backend messages written to a connection.
+func writtenMessages(written []byte) []pgproto3.BackendMessage {
+	frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(bytes.NewReader(written)), nil)
+	var messages []pgproto3.BackendMessage
+	for {
+		msg, err := frontend.Receive()
+		if err != nil {
+			return messages
+		}
+		// the frontend reuses its messages, keep a description of each
+		switch msg := msg.(type) {
+		case *pgproto3.CommandComplete:
+			messages = append(messages, &pgproto3.CommandComplete{CommandTag: append([]byte(nil), msg.CommandTag...)})
+		case *pgproto3.ErrorResponse:
+			messages = append(messages, &pgproto3.ErrorResponse{Code: msg.Code})
+		default:
+			messages = append(messages, msg)
+		}
 	}
+}
 
-	err = qe.handlePreparedStatement(ps)
+func TestHandleQueryMessage_MultipleStatements(t *testing.T) {
+	db, mock, err := sqlmock.New()
 	assert.NoError(t, err)
+	defer db.Close()
 
+	mockConn := &MockConn{}
+	qe := newMockedQueryExecutor()
+	qe.conn.pgdb = db
+	qe.conn.vdb = db
+	qe.mb = newMessagesBuffer(mockConn)
+
+	mock.ExpectQuery("SET search_path = 'a;b'").WillReturnRows(sqlmock.NewRows(nil))
+	mock.ExpectQuery("SELECT 1").WillReturnRows(sqlmock.NewRows([]string{"one"}).AddRow("1"))
+	err = qe.handleQueryMessage(&pgproto3.Query{String: "SET search_path = 'a;b'; -- done\nSELECT 1; /* ; */"})
+	assert.NoError(t, err)
 	assert.NoError(t, mock.ExpectationsWereMet())
+
+	messages := writtenMessages(mockConn.buf.Bytes())
+	if assert.Len(t, messages, 5) {
+		assert.Equal(t, "SET", string(messages[0].(*pgproto3.CommandComplete).CommandTag))
+		assert.IsType(t, &pgproto3.RowDescription{}, messages[1])
+		assert.IsType(t, &pgproto3.DataRow{}, messages[2])
+		assert.Equal(t, "SELECT 1", string(messages[3].(*pgproto3.CommandComplete).CommandTag))
+		assert.IsType(t, &pgproto3.ReadyForQuery{}, messages[4])
+	}
 }
 
-func TestHandlePreparedStatement__HandleClose(t *testing.T) {
+func TestHandleQueryMessage_StopsAtFirstError(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	assert.NoError(t, err)
+	defer db.Close()
 
-	mockReceiver := new(MockReceiver)
-	mockReceiver.On("Receive").Return(&pgproto3.Sync{}, nil)
-
-	c := &Conn{
-		pgdb:     db,
-		vdb:      db,
-		Conn:     &MockConn{},
-		receiver: mockReceiver,
+	mockConn := &MockConn{}
+	qe := newMockedQueryExecutor()
+	qe.conn.pgdb = db
+	qe.conn.vdb = db
+	qe.mb = newMessagesBuffer(mockConn)
+
+	mock.ExpectQuery("SET a").WillReturnRows(sqlmock.NewRows(nil))
+	mock.ExpectQuery("SET b").WillReturnError(&pq.Error{Code: "42704", Message: "unrecognized configuration parameter"})
+	err = qe.handleQueryMessage(&pgproto3.Query{String: "SET a = 1; SET b = 2; SET c = 3"})
+	assert.Error(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet(), "SET c is not executed")
+
+	messages := writtenMessages(mockConn.buf.Bytes())
+	if assert.Len(t, messages, 3) {
+		assert.IsType(t, &pgproto3.CommandComplete{}, messages[0])
+		assert.Equal(t, "42704", messages[1].(*pgproto3.ErrorResponse).Code)
+		assert.IsType(t, &pgproto3.ReadyForQuery{}, messages[2])
 	}
+}
 
+func TestHandleQueryMessage_Empty(t *testing.T) {
+	mockConn := &MockConn{}
 	qe := newMockedQueryExecutor()
-	qe.conn = c
+	qe.mb = newMessagesBuffer(mockConn)
 
-	ps := &PreparedStatement{
-		name:          "test_name",
-		query:         "SELECT 1",
-		parameterOIDs: []uint32{},
-		parameters:    nil,
-		binds:         nil,
+	assert.NoError(t, qe.handleQueryMessage(&pgproto3.Query{String: " ; -- nothing"}))
+	messages := writtenMessages(mockConn.buf.Bytes())
+	if assert.Len(t, messages, 2) {
+		assert.IsType(t, &pgproto3.EmptyQueryResponse{}, messages[0])
+		assert.IsType(t, &pgproto3.ReadyForQuery{}, messages[1])
 	}
+}
 
-	err = qe.handlePreparedStatement(ps)
-	assert.NoError(t, err)
-
-	assert.NoError(t, mock.ExpectationsWereMet())
+func TestRoute_SearchPath(t *testing.T) {
+	qe := newMockedQueryExecutor()
+	qe.synchronizedSchemas = []string{"sales"}
+	qe.conn.settings = map[string]string{"search_path": "public"}
+	qe.searchPath = "public"
+
+	decision, err := qe.route("SELECT * FROM orders")
+	require.NoError(t, err)
+	assert.Equal(t, RoutePostgres, decision.route)
+
+	qe.followVerticaSettings("SET search_path TO sales, public")
+	decision, err = qe.route("SELECT * FROM orders")
+	require.NoError(t, err)
+	assert.Equal(t, RouteVertica, decision.route)
+
+	qe.tempTables = map[string]struct{}{"orders": {}}
+	decision, err = qe.route("SELECT * FROM orders")
+	require.NoError(t, err)
+	assert.Equal(t, RoutePostgres, decision.route)
+
+	qe.tempTables = nil
+	qe.followVerticaSettings("SET search_path TO DEFAULT")
+	decision, err = qe.route("SELECT * FROM orders")
+	require.NoError(t, err)
+	assert.Equal(t, RoutePostgres, decision.route)
 }
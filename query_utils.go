@@ -113,7 +113,7 @@ func newQueryUtil(pgDBName string) *QueryUtil {
 }
 
 func (q *QueryUtil) normalizeQuery(query string) string {
-	normalizedQuery := strings.TrimSpace(strings.ToUpper(query))
+	normalizedQuery := strings.TrimSpace(strings.ToUpper(stripLeadingComments(query)))
 	lines := strings.Split(normalizedQuery, "\n")
 	var filteredLines []string
 	for _, line := range lines {
@@ -140,11 +140,11 @@ func (q *QueryUtil) isDeallocateQuery(query string) bool {
 }
 
 func (q *QueryUtil) isCloseQuery(query string) bool {
-	return closeQueryRegexp.MatchString(query)
+	return closeQueryRegexp.MatchString(statementText(query))
 }
 
 func (q *QueryUtil) parseCloseQuery(query string) (string, error) {
-	matches := closeQueryRegexp.FindStringSubmatch(query)
+	matches := closeQueryRegexp.FindStringSubmatch(statementText(query))
 	if len(matches) != 2 {
 		return "", fmt.Errorf("unable to parse close query: %s", query)
 	}
@@ -195,26 +195,269 @@ func (q *QueryUtil) queryShouldReturnEmptyResponse(query string) bool {
 
 }
 
+// isDataQuery reports whether the query selects rows from the Vertica data
+// tables and should be routed to Vertica.
 func (q *QueryUtil) isDataQuery(query string, synchronizedSchemas []string) bool {
-	// data query is a query which selects rows from the Vertica data table and should be routed to Vertica
-	normalizedQuery := strings.TrimSpace(strings.ToUpper(query))
-	for _, tableName := range postgresTechnicalTables {
-		if strings.Contains(normalizedQuery, tableName) {
+	tokens := significantTokens(tokenizeSQL(query))
+	return isDataStatement(tokens, referencedRelations(tokens), synchronizedSchemas)
+}
+
+// isDataStatement reports whether a SELECT reads a relation of a
+// synchronized schema and neither a Postgres catalog nor a pg_* function.
+// tokens must not contain comments.
+func isDataStatement(tokens []sqlToken, relations []sqlRelation, synchronizedSchemas []string) bool {
+	if len(tokens) == 0 || !tokens[0].isKeyword("SELECT") && !tokens[0].isKeyword("WITH") {
+		return false
+	}
+	if callsPostgresFunction(tokens) {
+		return false
+	}
+
+	var containsSynchronizedSchema bool
+	for _, relation := range relations {
+		if relation.isPostgresCatalog() {
 			return false
 		}
+		if relation.schema != "" && containsFold(synchronizedSchemas, relation.schema) {
+			containsSynchronizedSchema = true
+		}
+	}
+	return containsSynchronizedSchema
+}
+
+// sqlRelation is a table or view referenced by a query, schema is empty
+// when the name is not qualified.
+type sqlRelation struct {
+	schema string
+	name   string
+}
+
+func (r sqlRelation) isPostgresCatalog() bool {
+	for _, name := range postgresTechnicalTables {
+		if strings.EqualFold(r.schema, name) || strings.EqualFold(r.name, name) {
+			return true
+		}
+	}
+	return strings.EqualFold(r.schema, "pg_catalog")
+}
+
+// searchPathSchema returns the schema Postgres resolves unqualified names
+// to with the search_path setting: its first schema, "$user" counting only
+// when a synchronized schema is named after the user. It is empty when the
+// setting names no such schema.
+func searchPathSchema(searchPath, user string, synchronizedSchemas []string) string {
+	for _, schema := range strings.Split(searchPath, ",") {
+		schema = strings.Trim(strings.TrimSpace(schema), `'"`)
+		switch {
+		case schema == "" || strings.EqualFold(schema, "pg_temp") || strings.EqualFold(schema, "pg_catalog"):
+		case schema == "$user":
+			if containsFold(synchronizedSchemas, user) {
+				return user
+			}
+		default:
+			return schema
+		}
+	}
+	return ""
+}
+
+// qualifyRelations sets the schema of the unqualified relations to schema,
+// except for the common table expressions of the query and the names local
+// reports, e.g. temporary tables.
+func qualifyRelations(tokens []sqlToken, relations []sqlRelation, schema string, local func(name string) bool) []sqlRelation {
+	if schema == "" {
+		return relations
+	}
+	ctes := commonTableNames(tokens)
+	qualified := make([]sqlRelation, len(relations))
+	for i, relation := range relations {
+		if relation.schema == "" && !contains(ctes, relation.name) && !local(relation.name) {
+			relation.schema = schema
+		}
+		qualified[i] = relation
+	}
+	return qualified
+}
+
+// commonTableNames returns the names defined by the WITH clauses of a query.
+func commonTableNames(tokens []sqlToken) []string {
+	var names []string
+	for i := 0; i < len(tokens); i++ {
+		if !tokens[i].isKeyword("WITH") {
+			continue
+		}
+		i = skipKeywords(tokens, i+1, "RECURSIVE")
+		for i < len(tokens) && tokens[i].isName() {
+			name := tokens[i].value
+			i++
+			if i < len(tokens) && tokens[i].isOperator("(") {
+				i = skipParentheses(tokens, i) // column names
+			}
+			if i >= len(tokens) || !tokens[i].isKeyword("AS") {
+				break
+			}
+			names = append(names, name)
+			i = skipKeywords(tokens, i+1, "NOT", "MATERIALIZED")
+			if i < len(tokens) && tokens[i].isOperator("(") {
+				end := skipParentheses(tokens, i)
+				names = append(names, commonTableNames(tokens[i+1:end])...)
+				i = end
+			}
+			if i >= len(tokens) || !tokens[i].isOperator(",") {
+				break
+			}
+			i++
+		}
+	}
+	return names
+}
+
+// relationKeywords are followed by the relations a statement reads or writes.
+var relationKeywords = []string{"FROM", "JOIN", "INTO", "UPDATE"}
+
+// aliasStopKeywords end a relation in a FROM list, they can't be aliases.
+var aliasStopKeywords = []string{
+	"WHERE", "JOIN", "INNER", "LEFT", "RIGHT", "FULL", "CROSS", "NATURAL", "ON", "USING", "GROUP", "ORDER",
+	"LIMIT", "OFFSET", "HAVING", "WINDOW", "UNION", "INTERSECT", "EXCEPT", "FETCH", "FOR", "TABLESAMPLE",
+	"RETURNING", "SET", "VALUES", "SELECT", "DEFAULT", "WHEN",
+}
+
+// referencedRelations returns the relations following FROM, JOIN, INTO and
+// UPDATE, including the ones of subqueries. FROM inside function calls, e.g.
+// EXTRACT(YEAR FROM ts), does not name a relation.
+func referencedRelations(tokens []sqlToken) []sqlRelation {
+	var relations []sqlRelation
+	// inQuery tells for each open parenthesis whether it holds a subquery
+	inQuery := []bool{true}
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+		switch {
+		case token.isOperator("("):
+			subquery := i+1 < len(tokens) && (tokens[i+1].isKeyword("SELECT") || tokens[i+1].isKeyword("WITH") || tokens[i+1].isKeyword("VALUES"))
+			inQuery = append(inQuery, subquery)
+		case token.isOperator(")"):
+			if len(inQuery) > 1 {
+				inQuery = inQuery[:len(inQuery)-1]
+			}
+		case inQuery[len(inQuery)-1] && isRelationKeyword(token) && !(i > 0 && tokens[i-1].isKeyword("DISTINCT")):
+			var listed []sqlRelation
+			listed, i = parseRelationList(tokens, i+1, !token.isKeyword("FROM"))
+			relations = append(relations, listed...)
+			i-- // the token ending the list is handled by the loop
+		}
+	}
+	return relations
+}
+
+func isRelationKeyword(token sqlToken) bool {
+	for _, keyword := range relationKeywords {
+		if token.isKeyword(keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRelationList parses the comma separated relations starting at
+// tokens[i] and returns them with the index of the first token after the
+// list. single stops after the first relation, as JOIN, INTO and UPDATE
+// name one relation.
+func parseRelationList(tokens []sqlToken, i int, single bool) ([]sqlRelation, int) {
+	var relations []sqlRelation
+	for i < len(tokens) {
+		for i < len(tokens) && (tokens[i].isKeyword("ONLY") || tokens[i].isKeyword("LATERAL")) {
+			i++
+		}
+		switch {
+		case i >= len(tokens):
+			return relations, i
+		case tokens[i].isOperator("("):
+			end := skipParentheses(tokens, i)
+			inner := tokens[i+1 : end]
+			if len(inner) > 0 && inner[len(inner)-1].isOperator(")") {
+				inner = inner[:len(inner)-1]
+			}
+			if len(inner) > 0 && !inner[0].isKeyword("SELECT") && !inner[0].isKeyword("WITH") && !inner[0].isKeyword("VALUES") {
+				// a parenthesized join like (a JOIN b ON ...), no keyword
+				// precedes its first relation
+				first, j := parseRelationList(inner, 0, true)
+				relations = append(relations, first...)
+				inner = inner[j:]
+			}
+			relations = append(relations, referencedRelations(inner)...)
+			i = end
+		case tokens[i].isName():
+			parts := []string{tokens[i].value}
+			i++
+			for i+1 < len(tokens) && tokens[i].isOperator(".") && tokens[i+1].isName() {
+				parts = append(parts, tokens[i+1].value)
+				i += 2
+			}
+			if i < len(tokens) && tokens[i].isOperator("(") {
+				i = skipParentheses(tokens, i) // a function like generate_series(1, 10)
+				break
+			}
+			relation := sqlRelation{name: parts[len(parts)-1]}
+			if len(parts) > 1 {
+				relation.schema = parts[len(parts)-2]
+			}
+			relations = append(relations, relation)
+		default:
+			return relations, i
+		}
+
+		if i < len(tokens) && tokens[i].isKeyword("AS") {
+			i++
+		}
+		if i < len(tokens) && tokens[i].isName() && !isAliasStopKeyword(tokens[i]) {
+			i++
+			if i < len(tokens) && tokens[i].isOperator("(") {
+				i = skipParentheses(tokens, i) // column aliases
+			}
+		}
+		if single || i >= len(tokens) || !tokens[i].isOperator(",") {
+			return relations, i
+		}
+		i++
 	}
-	if strings.HasPrefix(normalizedQuery, "SELECT") {
-		var containsSynchronizedSchema = false
-		for _, schema := range synchronizedSchemas {
-			schemaUpper := strings.ToUpper(schema)
-			if strings.Contains(normalizedQuery, schemaUpper) {
-				containsSynchronizedSchema = true
+	return relations, i
+}
+
+// skipParentheses returns the index after the parenthesis closing the one
+// at tokens[i].
+func skipParentheses(tokens []sqlToken, i int) int {
+	depth := 0
+	for ; i < len(tokens); i++ {
+		if tokens[i].isOperator("(") {
+			depth++
+		} else if tokens[i].isOperator(")") {
+			depth--
+			if depth == 0 {
+				return i + 1
 			}
 		}
-		return containsSynchronizedSchema && strings.Contains(normalizedQuery, "FROM")
+	}
+	return i
+}
+
+func isAliasStopKeyword(token sqlToken) bool {
+	for _, keyword := range aliasStopKeywords {
+		if token.isKeyword(keyword) {
+			return true
+		}
 	}
 	return false
+}
 
+// callsPostgresFunction reports whether the query calls a pg_* function,
+// e.g. pg_get_expr, which Vertica doesn't know.
+func callsPostgresFunction(tokens []sqlToken) bool {
+	for i := 0; i+1 < len(tokens); i++ {
+		if tokens[i].kind == sqlIdentifier && strings.HasPrefix(tokens[i].value, "pg_") && tokens[i+1].isOperator("(") {
+			return true
+		}
+	}
+	return false
 }
 
 func (q *QueryUtil) mapPostgresToVerticaType(dataType string) string {
@@ -254,37 +497,34 @@ func (q *QueryUtil) replacePostgresDataTypes(query string) string {
 	return replaced
 }
 
-func (q *QueryUtil) rewriteQuery(query string) string {
+// rewriteQuery adapts a query routed to Vertica, it fails for PostgreSQL
+// constructs Vertica has no equivalent of.
+func (q *QueryUtil) rewriteQuery(query string) (string, error) {
+	query, err := translateToVertica(query)
+	if err != nil {
+		return "", err
+	}
 	query = q.replacePostgresDataTypes(query)
 	query = q.fromDBRegexp.ReplaceAllString(query, "FROM ")
-	return query
+	return query, nil
 }
 
+var setQueryRegexp = regexp.MustCompile(`(?is)^SET\s+(?:SESSION\s+|LOCAL\s+)?([\w."]+)\s*(?:=|\s+TO\s+)\s*(.*?)\s*;?$`)
+
 func parseSetQuery(expression string) (string, string, error) {
 	expression = strings.TrimSpace(expression)
 
-	if !strings.HasPrefix(expression, "SET ") {
+	if len(expression) < 4 || !strings.EqualFold(expression[:4], "SET ") {
 		return "", "", fmt.Errorf("expression must start with 'SET '")
 	}
 
-	expression = strings.TrimPrefix(expression, "SET ")
-
-	var parts []string = nil
-	for _, separator := range []string{"TO", "="} {
-		split := strings.Split(expression, separator)
-
-		if len(split) == 2 {
-			parts = split
-			break
-		}
-	}
-
-	if parts == nil {
+	matches := setQueryRegexp.FindStringSubmatch(expression)
+	if matches == nil {
 		return "", "", fmt.Errorf("can't parse expression, must contain 'TO' or '='")
 	}
 
-	paramName := strings.TrimSpace(parts[0])
-	paramValue := strings.Trim(parts[1], " '\"")
+	paramName := strings.Trim(matches[1], "\"")
+	paramValue := strings.Trim(matches[2], " '\"")
 
 	return paramName, paramValue, nil
 }
@@ -295,11 +535,11 @@ func (q *QueryUtil) isSetQuery(query string) bool {
 }
 
 func (q *QueryUtil) isDeclareCursorQuery(query string) bool {
-	return declareCursorRegexp.MatchString(query)
+	return declareCursorRegexp.MatchString(statementText(query))
 }
 
 func (q *QueryUtil) parseDeclareCursorQuery(query string) (*DeclareCursorQuery, error) {
-	matches := declareCursorRegexp.FindStringSubmatch(query)
+	matches := declareCursorRegexp.FindStringSubmatch(statementText(query))
 	if len(matches) != 4 {
 		return nil, fmt.Errorf("can't parse declare cursor query")
 	}
@@ -311,11 +551,11 @@ func (q *QueryUtil) parseDeclareCursorQuery(query string) (*DeclareCursorQuery,
 }
 
 func (q *QueryUtil) isFetchQuery(query string) bool {
-	return fetchQueryRegexp.MatchString(query)
+	return fetchQueryRegexp.MatchString(statementText(query))
 }
 
 func (q *QueryUtil) parseFetchQuery(query string) (*FetchQuery, error) {
-	match := fetchQueryRegexp.FindStringSubmatch(query)
+	match := fetchQueryRegexp.FindStringSubmatch(statementText(query))
 
 	paramsMap := make(map[string]string)
 	for i, name := range fetchQueryRegexp.SubexpNames() {
@@ -344,7 +584,7 @@ var (
 	typeRegex           = regexp.MustCompile(`(?i)::([a-zA-Z0-9]+)`)
 	typeCastRegex       = regexp.MustCompile(`(?i)AS (([a-zA-Z0-9]+))\)`)
 	limitRegexp         = regexp.MustCompile(`LIMIT (0|[1-9][0-9]*)`)
-	declareCursorRegexp = regexp.MustCompile(`(?i)DECLARE\s+(\w+)\s+(.*) CURSOR .*? FOR\s+(.*)`)
-	fetchQueryRegexp    = regexp.MustCompile(`(?i)FETCH\s+(?P<Direction>\w+)?\s*(?P<Count>\d+)?\s*(FROM|IN)?\s*(?P<CursorName>\w+)?`)
-	closeQueryRegexp    = regexp.MustCompile(`(?i)CLOSE\s+(.*)`)
+	declareCursorRegexp = regexp.MustCompile(`(?is)^DECLARE\s+(\w+)\s+(.*?) CURSOR .*? FOR\s+(.*)`)
+	fetchQueryRegexp    = regexp.MustCompile(`(?i)^FETCH\s+(?P<Direction>\w+)?\s*(?P<Count>\d+)?\s*(FROM|IN)?\s*(?P<CursorName>\w+)?`)
+	closeQueryRegexp    = regexp.MustCompile(`(?is)^CLOSE\s+(.*)`)
 )
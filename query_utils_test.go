@@ -2,6 +2,9 @@ package pgvertica
 
 import (
 	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func mockedQueryUtil() *QueryUtil {
@@ -95,6 +98,34 @@ func TestQueryReturnsNoRows(t *testing.T) {
 	}
 }
 
+func TestCursorStatements(t *testing.T) {
+	qu := mockedQueryUtil()
+	testCases := []struct {
+		desc, input            string
+		declare, fetch, closes bool
+	}{
+		{desc: "declare", input: "DECLARE c BINARY CURSOR WITH HOLD FOR SELECT 1", declare: true},
+		{desc: "declare after a comment", input: "/* report */\n  declare c BINARY CURSOR WITH HOLD FOR\nSELECT 1", declare: true},
+		{desc: "fetch", input: "FETCH FORWARD 10 FROM c", fetch: true},
+		{desc: "close", input: "  CLOSE c", closes: true},
+		{desc: "FETCH FIRST of a query", input: "SELECT id FROM sales.orders FETCH FIRST 10 ROWS ONLY"},
+		{desc: "close column", input: "SELECT open, close FROM sales.prices"},
+		{desc: "declare in a string", input: "SELECT 'DECLARE c BINARY CURSOR WITH HOLD FOR SELECT 1'"},
+		{desc: "function body", input: "CREATE FUNCTION f() RETURNS int AS $$ DECLARE x int; BEGIN RETURN 1; END $$ LANGUAGE plpgsql"},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			assert.Equal(t, tC.declare, qu.isDeclareCursorQuery(tC.input))
+			assert.Equal(t, tC.fetch, qu.isFetchQuery(tC.input))
+			assert.Equal(t, tC.closes, qu.isCloseQuery(tC.input))
+		})
+	}
+
+	declare, err := qu.parseDeclareCursorQuery("-- report\nDECLARE c BINARY CURSOR WITH HOLD FOR\nSELECT id\nFROM sales.orders")
+	require.NoError(t, err)
+	assert.Equal(t, &DeclareCursorQuery{name: "c", cursorType: "BINARY", query: "SELECT id\nFROM sales.orders"}, declare)
+}
+
 func TestRewriteQuery(t *testing.T) {
 	qu := mockedQueryUtil()
 	testCases := []struct {
@@ -129,7 +160,10 @@ func TestRewriteQuery(t *testing.T) {
 
 	for _, tC := range testCases {
 		t.Run(tC.desc, func(t *testing.T) {
-			result := qu.rewriteQuery(tC.input)
+			result, err := qu.rewriteQuery(tC.input)
+			if err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
 			if result != tC.expectedOutput {
 				t.Fatalf("Expected %s, but got %s", tC.expectedOutput, result)
 			}
@@ -156,13 +190,68 @@ func TestIsDataQuery(t *testing.T) {
 		{
 			desc:           "Test with non-technical table but wrong schema",
 			input:          "SELECT * FROM my_schema_1.users",
-			expectedOutput: true,
+			expectedOutput: false,
 		},
 		{
 			desc:           "Test with SELECT not from table",
 			input:          "SELECT 1",
 			expectedOutput: false,
 		},
+		{
+			desc:           "Test with column named like a technical table",
+			input:          "SELECT pg_type_id FROM my_schema.users",
+			expectedOutput: true,
+		},
+		{
+			desc:           "Test with schema name in a string literal",
+			input:          "SELECT * FROM public.users WHERE note = 'my_schema.users'",
+			expectedOutput: false,
+		},
+		{
+			desc:           "Test with schema name in a comment",
+			input:          "SELECT * FROM users -- FROM my_schema.users",
+			expectedOutput: false,
+		},
+		{
+			desc:           "Test with quoted identifiers",
+			input:          `SELECT "Id" FROM "my_schema"."Users" "u"`,
+			expectedOutput: true,
+		},
+		{
+			desc:           "Test with database qualified table",
+			input:          "SELECT * FROM database.my_schema.users",
+			expectedOutput: true,
+		},
+		{
+			desc:           "Test with join",
+			input:          "SELECT * FROM public.orders o JOIN my_schema.users u ON o.user_id = u.id",
+			expectedOutput: true,
+		},
+		{
+			desc:           "Test with subquery and CTE",
+			input:          "WITH recent AS (SELECT * FROM my_schema.events WHERE ts > now()) SELECT count(*) FROM recent",
+			expectedOutput: true,
+		},
+		{
+			desc:           "Test with schema as alias in EXTRACT",
+			input:          "SELECT EXTRACT(YEAR FROM my_schema.ts) FROM events my_schema",
+			expectedOutput: false,
+		},
+		{
+			desc:           "Test with catalog join",
+			input:          "SELECT * FROM my_schema.users u, pg_catalog.pg_namespace n",
+			expectedOutput: false,
+		},
+		{
+			desc:           "Test with pg function",
+			input:          "SELECT pg_typeof(id) FROM my_schema.users",
+			expectedOutput: false,
+		},
+		{
+			desc:           "Test with insert",
+			input:          "INSERT INTO my_schema.users SELECT * FROM my_schema.staging",
+			expectedOutput: false,
+		},
 	}
 	schemaNames := []string{"my_schema"}
 	for _, tC := range testCases {
@@ -174,3 +263,50 @@ func TestIsDataQuery(t *testing.T) {
 		})
 	}
 }
+
+func TestReferencedRelations(t *testing.T) {
+	query := `SELECT * FROM ONLY s1.a AS x, s2.b y (c1, c2), generate_series(1, 3) g, s5.f
+		LEFT JOIN LATERAL (SELECT * FROM c WHERE c.v IS DISTINCT FROM x.v) z ON true
+		WHERE EXISTS (SELECT 1 FROM db.s3."D") AND SUBSTRING(x.s FROM 2) = 'FROM s4.e'`
+	assert.Equal(t, []sqlRelation{
+		{schema: "s1", name: "a"},
+		{schema: "s2", name: "b"},
+		{schema: "s5", name: "f"},
+		{name: "c"},
+		{schema: "s3", name: "D"},
+	}, referencedRelations(significantTokens(tokenizeSQL(query))))
+}
+
+func TestReferencedRelations_ParenthesizedJoin(t *testing.T) {
+	query := `SELECT * FROM (s1.a JOIN (s2.b LEFT JOIN s3.c ON b.id = c.id) ON a.id = b.id) j, (SELECT 1 FROM s4.d) x`
+	assert.Equal(t, []sqlRelation{
+		{schema: "s1", name: "a"},
+		{schema: "s2", name: "b"},
+		{schema: "s3", name: "c"},
+		{schema: "s4", name: "d"},
+	}, referencedRelations(significantTokens(tokenizeSQL(query))))
+}
+
+func TestQualifyRelations(t *testing.T) {
+	query := `WITH recent (id) AS (WITH top AS (SELECT 1) SELECT id FROM orders, top) SELECT * FROM recent JOIN tmp USING (id) JOIN public.users USING (id)`
+	tokens := significantTokens(tokenizeSQL(query))
+	isTemp := func(name string) bool { return name == "tmp" }
+	assert.Equal(t, []sqlRelation{
+		{schema: "sales", name: "orders"},
+		{name: "top"},
+		{name: "recent"},
+		{name: "tmp"},
+		{schema: "public", name: "users"},
+	}, qualifyRelations(tokens, referencedRelations(tokens), "sales", isTemp))
+
+	assert.Equal(t, "sales", searchPathSchema(`"$user", sales, public`, "alice", []string{"bi"}))
+	assert.Equal(t, "bi", searchPathSchema(`"$user", sales`, "bi", []string{"bi"}))
+	assert.Equal(t, "sales", searchPathSchema(`pg_temp, 'sales'`, "alice", nil))
+	assert.Equal(t, "", searchPathSchema("", "alice", nil))
+}
+
+func TestReferencedRelations_Incomplete(t *testing.T) {
+	for _, query := range []string{"SELECT * FROM", "SELECT * FROM (", "SELECT * FROM (s.a JOIN", "SELECT * FROM (SELECT * FROM s.a", "SELECT * FROM s.", "SELECT * FROM a AS"} {
+		assert.NotPanics(t, func() { referencedRelations(significantTokens(tokenizeSQL(query))) }, query)
+	}
+}
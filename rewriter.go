@@ -0,0 +1,232 @@
+package pgvertica
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Rewriter rewrites the queries of clients before they are routed. It
+// reports whether it changed the query.
+type Rewriter interface {
+	Rewrite(query string) (string, bool)
+}
+
+// RewriterFunc adapts a function to the Rewriter interface.
+type RewriterFunc func(query string) (string, bool)
+
+func (f RewriterFunc) Rewrite(query string) (string, bool) {
+	return f(query)
+}
+
+// RewriterFactory builds the Rewriter of a plugin rule from the arguments
+// following the plugin name in the rewrite rules file.
+type RewriterFactory func(args []string) (Rewriter, error)
+
+var (
+	rewriterPluginsMu sync.Mutex
+	rewriterPlugins   = make(map[string]RewriterFactory)
+)
+
+// RegisterRewriter makes a Rewriter implemented in Go available to rewrite
+// rules files as `NAME plugin PLUGIN [ARG]...`. It is meant to be called
+// from init functions, before the rules file is loaded.
+func RegisterRewriter(plugin string, factory RewriterFactory) {
+	rewriterPluginsMu.Lock()
+	defer rewriterPluginsMu.Unlock()
+	if _, ok := rewriterPlugins[plugin]; ok {
+		panic("rewriter plugin registered twice: " + plugin)
+	}
+	rewriterPlugins[plugin] = factory
+}
+
+func lookupRewriter(plugin string) (RewriterFactory, bool) {
+	rewriterPluginsMu.Lock()
+	defer rewriterPluginsMu.Unlock()
+	factory, ok := rewriterPlugins[plugin]
+	return factory, ok
+}
+
+// RewriteRule is a single line of a rewrite rules file:
+//
+//	NAME  regex        PATTERN REPLACEMENT
+//	NAME  fingerprint  QUERY REPLACEMENT
+//	NAME  plugin       PLUGIN [ARG]...
+//
+// regex replaces every match of the Go regular expression, REPLACEMENT may
+// refer to its groups as ${1}. fingerprint replaces queries differing from
+// QUERY only in their literals, whitespace, comments and case, REPLACEMENT
+// may refer to the literals of the replaced query as ${1}. plugin uses a
+// Rewriter registered with RegisterRewriter.
+//
+// Values containing whitespace or '#' are enclosed in double quotes, \"
+// stands for a quote inside them.
+type RewriteRule struct {
+	Name     string
+	Rewriter Rewriter
+	Line     int
+}
+
+// RewriteRules are applied in order, each to the query the previous ones
+// produced.
+type RewriteRules []RewriteRule
+
+func LoadRewriteRulesFile(path string) (RewriteRules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rules, err := ParseRewriteRules(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return rules, nil
+}
+
+func ParseRewriteRules(r io.Reader) (RewriteRules, error) {
+	var rules RewriteRules
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		fields, err := splitRoutingRuleFields(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		rule, err := parseRewriteRule(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		rule.Line = lineNo
+		rules = append(rules, *rule)
+	}
+	return rules, scanner.Err()
+}
+
+func parseRewriteRule(fields []string) (*RewriteRule, error) {
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("expected a rule name and kind")
+	}
+	rule := &RewriteRule{Name: fields[0]}
+	kind, args := strings.ToLower(fields[1]), fields[2:]
+
+	var err error
+	switch kind {
+	case "regex":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("regex expects a pattern and a replacement")
+		}
+		rule.Rewriter, err = newRegexRewriter(args[0], args[1])
+	case "fingerprint":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("fingerprint expects a query and a replacement")
+		}
+		rule.Rewriter, err = newFingerprintRewriter(args[0], args[1])
+	case "plugin":
+		if len(args) == 0 {
+			return nil, fmt.Errorf("plugin expects a plugin name")
+		}
+		factory, ok := lookupRewriter(args[0])
+		if !ok {
+			return nil, fmt.Errorf("unknown rewriter plugin: %s", args[0])
+		}
+		rule.Rewriter, err = factory(args[1:])
+	default:
+		return nil, fmt.Errorf("unknown rewrite rule kind: %s", fields[1])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", kind, err)
+	}
+	return rule, nil
+}
+
+// Rewrite applies the rules to the query and logs every one that changed it.
+func (rules RewriteRules) Rewrite(query string) string {
+	for _, rule := range rules {
+		rewritten, ok := rule.Rewriter.Rewrite(query)
+		if !ok {
+			continue
+		}
+		Logger.Info("Rewrite query", "rule", rule.Name, "query", query, "rewritten", rewritten)
+		query = rewritten
+	}
+	return query
+}
+
+type regexRewriter struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+func newRegexRewriter(pattern, replacement string) (*regexRewriter, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &regexRewriter{re: re, replacement: replacement}, nil
+}
+
+func (r *regexRewriter) Rewrite(query string) (string, bool) {
+	if !r.re.MatchString(query) {
+		return query, false
+	}
+	rewritten := r.re.ReplaceAllString(query, r.replacement)
+	return rewritten, rewritten != query
+}
+
+// literalReferenceRegexp matches the ${n} references to the literals of the
+// replaced query in the replacement of a fingerprint rule.
+var literalReferenceRegexp = regexp.MustCompile(`\$\{(\d+)\}`)
+
+type fingerprintRewriter struct {
+	fingerprint string
+	replacement string
+}
+
+func newFingerprintRewriter(query, replacement string) (*fingerprintRewriter, error) {
+	tokens := significantTokens(tokenizeSQL(query))
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty query")
+	}
+	literals := len(queryLiterals(tokens))
+	for _, match := range literalReferenceRegexp.FindAllStringSubmatch(replacement, -1) {
+		if n, _ := strconv.Atoi(match[1]); n < 1 || n > literals {
+			return nil, fmt.Errorf("replacement refers to literal %s, the query has %d", match[1], literals)
+		}
+	}
+	return &fingerprintRewriter{fingerprint: queryFingerprint(tokens), replacement: replacement}, nil
+}
+
+func (r *fingerprintRewriter) Rewrite(query string) (string, bool) {
+	tokens := significantTokens(tokenizeSQL(query))
+	if queryFingerprint(tokens) != r.fingerprint {
+		return query, false
+	}
+	literals := queryLiterals(tokens)
+	return literalReferenceRegexp.ReplaceAllStringFunc(r.replacement, func(reference string) string {
+		n, _ := strconv.Atoi(reference[2 : len(reference)-1])
+		return literals[n-1]
+	}), true
+}
+
+// queryLiterals returns the literals and parameters of a query as written,
+// in the order queryFingerprint replaces them.
+func queryLiterals(tokens []sqlToken) []string {
+	var literals []string
+	for _, token := range tokens {
+		switch token.kind {
+		case sqlString, sqlNumber, sqlParameter:
+			literals = append(literals, token.text)
+		}
+	}
+	return literals
+}
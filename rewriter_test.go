@@ -0,0 +1,109 @@
+package pgvertica
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	RegisterRewriter("test-comment", func(args []string) (Rewriter, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("expected a comment")
+		}
+		return RewriterFunc(func(query string) (string, bool) {
+			return "/* " + args[0] + " */ " + query, true
+		}), nil
+	})
+}
+
+const testRewriteRules = `
+# NAME        KIND          ARGUMENTS
+orders_v2     regex         "(?i)\bsales\.orders_v1\b" sales.orders
+tuned_top     fingerprint   "SELECT id FROM sales.orders WHERE total > 100 LIMIT 10" "SELECT /*+ tuned */ id FROM sales.top_orders WHERE total > ${1} LIMIT ${2}"
+`
+
+func TestParseRewriteRules(t *testing.T) {
+	rules, err := ParseRewriteRules(strings.NewReader(testRewriteRules + "tag plugin test-comment bi\n"))
+	require.NoError(t, err)
+	require.Len(t, rules, 3)
+
+	assert.Equal(t, "orders_v2", rules[0].Name)
+	assert.Equal(t, 3, rules[0].Line)
+	assert.Equal(t, "tuned_top", rules[1].Name)
+	assert.Equal(t, "tag", rules[2].Name)
+}
+
+func TestParseRewriteRules_Invalid(t *testing.T) {
+	for _, config := range []string{
+		"orders_v2",
+		"orders_v2 replace a b",
+		"orders_v2 regex a",
+		"orders_v2 regex ( b",
+		`tuned fingerprint "" "SELECT 1"`,
+		`tuned fingerprint "SELECT 1" "SELECT ${2}"`,
+		"tag plugin",
+		"tag plugin unknown",
+		"tag plugin test-comment",
+	} {
+		_, err := ParseRewriteRules(strings.NewReader(config))
+		assert.Error(t, err, config)
+	}
+}
+
+func TestRewriteRulesRewrite(t *testing.T) {
+	rules, err := ParseRewriteRules(strings.NewReader(testRewriteRules))
+	require.NoError(t, err)
+
+	testCases := []struct {
+		query, expected string
+	}{
+		{"SELECT * FROM Sales.Orders_V1 o", "SELECT * FROM sales.orders o"},
+		{"SELECT * FROM sales.orders_v10", "SELECT * FROM sales.orders_v10"},
+		{"select id\nfrom sales.orders -- top\nwhere total > 250 limit 5", "SELECT /*+ tuned */ id FROM sales.top_orders WHERE total > 250 LIMIT 5"},
+		{"SELECT id FROM sales.orders_v1 WHERE total > $1 LIMIT 20", "SELECT /*+ tuned */ id FROM sales.top_orders WHERE total > $1 LIMIT 20"},
+		{"SELECT id FROM sales.orders WHERE total > 100", "SELECT id FROM sales.orders WHERE total > 100"},
+	}
+	for _, tC := range testCases {
+		assert.Equal(t, tC.expected, rules.Rewrite(tC.query), tC.query)
+	}
+}
+
+func TestExecuteStatement_RewriteRules(t *testing.T) {
+	vdb, vmock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer vdb.Close()
+
+	qe := newMockedQueryExecutor()
+	qe.conn.vdb = vdb
+	qe.synchronizedSchemas = []string{"sales"}
+	qe.cursors = make(map[string]*Cursor)
+	qe.rewriteRules, err = ParseRewriteRules(strings.NewReader(testRewriteRules))
+	require.NoError(t, err)
+
+	// the rewritten query is the one routed and run
+	vmock.ExpectQuery(`SELECT \* FROM sales.orders`).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	require.NoError(t, qe.executeStatement("SELECT * FROM sales.orders_v1"))
+
+	vmock.ExpectPrepare(`SELECT id FROM sales.orders`)
+	vmock.ExpectQuery(`SELECT id FROM sales.orders`).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	require.NoError(t, qe.executeStatement("DECLARE c BINARY CURSOR WITH HOLD FOR SELECT id FROM sales.orders_v1"))
+	assert.Equal(t, "SELECT id FROM sales.orders", qe.cursors["c"].query)
+
+	assert.NoError(t, vmock.ExpectationsWereMet())
+}
+
+func TestHandleParse_RewriteRules(t *testing.T) {
+	qe := newMockedQueryExecutor()
+	var err error
+	qe.rewriteRules, err = ParseRewriteRules(strings.NewReader(testRewriteRules))
+	require.NoError(t, err)
+
+	require.NoError(t, qe.handleParse(&pgproto3.Parse{Name: "s1", Query: "SELECT id FROM sales.orders_v1 WHERE id = $1"}))
+	assert.Equal(t, "SELECT id FROM sales.orders WHERE id = $1", qe.preparedStatements["s1"].query)
+}
@@ -0,0 +1,278 @@
+package pgvertica
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+const insufficientPrivilegeCode = "42501"
+
+// Route is the backend a query is sent to.
+type Route string
+
+const (
+	RouteVertica  Route = "vertica"
+	RoutePostgres Route = "postgres"
+	// RouteReject refuses the query.
+	RouteReject Route = "reject"
+)
+
+func ParseRoute(s string) (Route, error) {
+	switch route := Route(strings.ToLower(s)); route {
+	case RouteVertica, RoutePostgres, RouteReject:
+		return route, nil
+	default:
+		return "", fmt.Errorf("unknown route: %s", s)
+	}
+}
+
+// RoutingRule is a single line of a routing rules file:
+//
+//	ROUTE  [MATCH=VALUE]...
+//
+// ROUTE is vertica, postgres or reject. A rule without matches applies to
+// every query, otherwise all of its matches must hold:
+//
+//	regex=PATTERN            the query text matches the Go regular expression
+//	schema=a,b               the query reads or writes a relation of one of the schemas
+//	table=a.t,t              the query reads or writes one of the tables, with or without schema
+//	user=a,b                 the proxy user is one of the users
+//	application_name=a,b     the application_name of the session is one of the names
+//
+// Values containing whitespace or '#' are enclosed in double quotes, \"
+// stands for a quote inside them.
+type RoutingRule struct {
+	Route            Route
+	Regexp           *regexp.Regexp
+	Schemas          []string
+	Tables           []string
+	Users            []string
+	ApplicationNames []string
+	Line             int
+}
+
+// RoutingRules are evaluated in order; the first matching rule decides.
+// Queries no rule matches are routed by the default heuristic.
+type RoutingRules []RoutingRule
+
+func LoadRoutingRulesFile(path string) (RoutingRules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rules, err := ParseRoutingRules(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return rules, nil
+}
+
+func ParseRoutingRules(r io.Reader) (RoutingRules, error) {
+	var rules RoutingRules
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		fields, err := splitRoutingRuleFields(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		rule, err := parseRoutingRule(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		rule.Line = lineNo
+		rules = append(rules, *rule)
+	}
+	return rules, scanner.Err()
+}
+
+// splitRoutingRuleFields splits a line at whitespace outside double quotes
+// and drops the comment starting with '#'.
+func splitRoutingRuleFields(line string) ([]string, error) {
+	var fields []string
+	var field strings.Builder
+	var inField, quoted bool
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quoted && c == '\\' && i+1 < len(line) && line[i+1] == '"':
+			i++
+			field.WriteByte('"')
+		case c == '"':
+			quoted = !quoted
+			inField = true
+		case quoted:
+			field.WriteByte(c)
+		case c == '#':
+			i = len(line)
+		case c == ' ' || c == '\t':
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteByte(c)
+			inField = true
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields, nil
+}
+
+func parseRoutingRule(fields []string) (*RoutingRule, error) {
+	route, err := ParseRoute(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	rule := &RoutingRule{Route: route}
+
+	for _, field := range fields[1:] {
+		name, value, ok := strings.Cut(field, "=")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("invalid match %q, expected name=value", field)
+		}
+		switch strings.ToLower(name) {
+		case "regex":
+			if rule.Regexp, err = regexp.Compile(value); err != nil {
+				return nil, fmt.Errorf("regex: %w", err)
+			}
+		case "schema":
+			rule.Schemas = strings.Split(value, ",")
+		case "table":
+			rule.Tables = strings.Split(value, ",")
+		case "user":
+			rule.Users = strings.Split(value, ",")
+		case "application_name":
+			rule.ApplicationNames = strings.Split(value, ",")
+		default:
+			return nil, fmt.Errorf("unknown match: %s", name)
+		}
+	}
+	return rule, nil
+}
+
+// routedQuery is what routing rules are matched against.
+type routedQuery struct {
+	text            string
+	relations       []sqlRelation
+	user            string
+	applicationName string
+}
+
+// Match returns the first rule matching the query or nil when none does.
+func (rules RoutingRules) Match(query routedQuery) *RoutingRule {
+	for i := range rules {
+		if rules[i].matches(query) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+func (rule *RoutingRule) matches(query routedQuery) bool {
+	if rule.Regexp != nil && !rule.Regexp.MatchString(query.text) {
+		return false
+	}
+	if rule.Users != nil && !contains(rule.Users, query.user) {
+		return false
+	}
+	if rule.ApplicationNames != nil && !contains(rule.ApplicationNames, query.applicationName) {
+		return false
+	}
+	if rule.Schemas != nil && !referencesRelation(query.relations, func(r sqlRelation) bool {
+		return r.schema != "" && containsFold(rule.Schemas, r.schema)
+	}) {
+		return false
+	}
+	if rule.Tables != nil && !referencesRelation(query.relations, func(r sqlRelation) bool {
+		return containsFold(rule.Tables, r.name) || r.schema != "" && containsFold(rule.Tables, r.schema+"."+r.name)
+	}) {
+		return false
+	}
+	return true
+}
+
+func referencesRelation(relations []sqlRelation, match func(sqlRelation) bool) bool {
+	for _, relation := range relations {
+		if match(relation) {
+			return true
+		}
+	}
+	return false
+}
+
+var routingHintRegexp = regexp.MustCompile(`(?i)\bpgvertica:route\s*=\s*(\w+)`)
+
+// routingHint returns the route requested by a comment of the query, e.g.
+// /* pgvertica:route=vertica */, or "" when it has none.
+func routingHint(tokens []sqlToken) Route {
+	for _, token := range tokens {
+		if token.kind != sqlComment {
+			continue
+		}
+		matches := routingHintRegexp.FindStringSubmatch(token.text)
+		if matches == nil {
+			continue
+		}
+		route, err := ParseRoute(matches[1])
+		if err != nil || route == RouteReject {
+			Logger.Warn("Ignore invalid routing hint", "hint", matches[0])
+			continue
+		}
+		return route
+	}
+	return ""
+}
+
+// routingError is returned for a query refused by a routing rule.
+type routingError struct {
+	rule *RoutingRule
+}
+
+func (e *routingError) Error() string {
+	return fmt.Sprintf("query rejected by routing rule on line %d", e.rule.Line)
+}
+
+func (e *routingError) errorResponse() *pgproto3.ErrorResponse {
+	return &pgproto3.ErrorResponse{Severity: "ERROR", Code: insufficientPrivilegeCode, Message: e.Error()}
+}
+
+// routeQuery decides the backend of a query. A reject rule refuses it,
+// otherwise a routing hint comment takes precedence over the rules, which
+// take precedence over the default heuristic. explicit is false when the
+// heuristic decided.
+func routeQuery(query routedQuery, tokens []sqlToken, rules RoutingRules, synchronizedSchemas []string) (route Route, explicit bool, err error) {
+	rule := rules.Match(query)
+	if rule != nil && rule.Route == RouteReject {
+		return "", true, &routingError{rule: rule}
+	}
+	if hint := routingHint(tokens); hint != "" {
+		Logger.Debug("Routing hint", "route", hint)
+		return hint, true, nil
+	}
+	if rule != nil {
+		Logger.Debug("Routing rule matched", "line", rule.Line, "route", rule.Route)
+		return rule.Route, true, nil
+	}
+	if isDataStatement(significantTokens(tokens), query.relations, synchronizedSchemas) {
+		return RouteVertica, false, nil
+	}
+	return RoutePostgres, false, nil
+}
@@ -0,0 +1,172 @@
+package pgvertica
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+
+	"github.com/lib/pq"
+	vertigo "github.com/vertica/vertica-sql-go"
+)
+
+// routeCacheSize bounds the query fingerprints remembered by the fallback.
+const routeCacheSize = 10000
+
+// fallbackCodes are the SQLSTATEs of a query sent to the wrong backend:
+// undefined table, Vertica's undefined relation, undefined function and
+// invalid schema name.
+var fallbackCodes = []string{"42P01", "42V01", "42883", "3F000"}
+
+func (r Route) other() Route {
+	if r == RouteVertica {
+		return RoutePostgres
+	}
+	return RouteVertica
+}
+
+// routeCache remembers the backend a query ended up on after a fallback,
+// keyed by user, search_path and query fingerprint, so later runs go
+// straight to it. It is shared by all sessions.
+type routeCache struct {
+	mu     sync.Mutex
+	routes map[routeCacheKey]Route
+}
+
+// routeCacheKey identifies a query of a user, whose unqualified relations
+// depend on the search_path.
+type routeCacheKey struct {
+	user        string
+	searchPath  string
+	fingerprint string
+}
+
+func newRouteCache() *routeCache {
+	return &routeCache{routes: make(map[routeCacheKey]Route)}
+}
+
+func (c *routeCache) get(key routeCacheKey) (Route, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	route, ok := c.routes[key]
+	return route, ok
+}
+
+func (c *routeCache) set(key routeCacheKey, route Route) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.routes[key]; !ok && len(c.routes) >= routeCacheSize {
+		for evicted := range c.routes {
+			delete(c.routes, evicted)
+			break
+		}
+	}
+	c.routes[key] = route
+}
+
+// queryFingerprint identifies queries that differ only in their literals,
+// whitespace, comments and the case of keywords and unquoted identifiers.
+// tokens must not contain comments.
+func queryFingerprint(tokens []sqlToken) string {
+	var normalized strings.Builder
+	for _, token := range tokens {
+		switch token.kind {
+		case sqlString, sqlNumber, sqlParameter:
+			normalized.WriteString("?")
+		case sqlIdentifier:
+			normalized.WriteString(token.value)
+		case sqlQuotedIdentifier:
+			normalized.WriteString(`"` + token.value + `"`)
+		default:
+			normalized.WriteString(token.text)
+		}
+		normalized.WriteByte(' ')
+	}
+	sum := sha256.Sum256([]byte(normalized.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// isReadOnlyQuery reports whether a query only reads, so running it on
+// the other backend after it failed changes nothing. tokens must not contain
+// comments.
+func isReadOnlyQuery(tokens []sqlToken) bool {
+	if len(tokens) == 0 || !tokens[0].isKeyword("SELECT") && !tokens[0].isKeyword("WITH") {
+		return false
+	}
+	for _, token := range tokens {
+		for _, keyword := range []string{"INTO", "INSERT", "UPDATE", "DELETE", "MERGE"} {
+			if token.isKeyword(keyword) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isRoutingError reports whether err suggests the query was sent to the
+// backend that doesn't have its tables or functions.
+func isRoutingError(err error) bool {
+	var code string
+	switch err := err.(type) {
+	case *pq.Error:
+		code = string(err.Code)
+	case *vertigo.VError:
+		code = err.SQLState
+	default:
+		return false
+	}
+	return contains(fallbackCodes, code)
+}
+
+// fallbackHasRelations reports whether the backend a query falls back to
+// has the data of its relations. Postgres only has empty copies of the
+// tables of the synchronized schemas, a query reading them would return no
+// rows instead of failing, so it never falls back to Postgres.
+func fallbackHasRelations(fallback Route, relations []sqlRelation, synchronizedSchemas []string) bool {
+	if fallback != RoutePostgres {
+		return true
+	}
+	for _, relation := range relations {
+		if relation.schema != "" && containsFold(synchronizedSchemas, relation.schema) {
+			return false
+		}
+	}
+	return true
+}
+
+// routeDecision is the backend chosen for a query and whether the query
+// may fall back to the other one.
+type routeDecision struct {
+	route    Route
+	fallback bool
+	cacheKey routeCacheKey
+}
+
+// runRouted runs the query on the backend it is routed to. With the
+// fallback enabled, a read-only query failing with a routing error outside
+// a transaction is run again on the other backend, when that one has its
+// relations; when that succeeds the other backend is remembered for the
+// query. run may be called twice.
+func (qe *QueryExecutor) runRouted(query string, run func(Route) error) error {
+	decision, err := qe.route(query)
+	if err != nil {
+		return err
+	}
+
+	err = run(decision.route)
+	if err == nil || !decision.fallback || qe.inTransaction || !isRoutingError(err) {
+		return err
+	}
+
+	fallback := decision.route.other()
+	Logger.Warn("Query failed on its backend, retry on the other one", "route", decision.route, "fallback", fallback, "error", err)
+	if ferr := run(fallback); ferr != nil {
+		Logger.Warn("Fallback query failed too", "route", fallback, "error", ferr)
+		return err
+	}
+	qe.conn.routeCache.set(decision.cacheKey, fallback)
+	Logger.Info("Remember fallback route", "route", fallback, "fingerprint", decision.cacheKey.fingerprint)
+	return nil
+}
@@ -0,0 +1,156 @@
+package pgvertica
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	vertigo "github.com/vertica/vertica-sql-go"
+)
+
+func fingerprint(query string) string {
+	return queryFingerprint(significantTokens(tokenizeSQL(query)))
+}
+
+func TestQueryFingerprint(t *testing.T) {
+	base := fingerprint("SELECT * FROM sales.orders WHERE id = 1 AND note = 'a'")
+	assert.Equal(t, base, fingerprint("select *\n  from Sales.Orders -- comment\n where ID = 42 and note = 'b'"))
+	assert.Equal(t, base, fingerprint("SELECT * FROM sales.orders WHERE id = $1 AND note = $2"))
+	assert.NotEqual(t, base, fingerprint("SELECT * FROM sales.returns WHERE id = 1 AND note = 'a'"))
+	assert.NotEqual(t, base, fingerprint(`SELECT * FROM "Sales".orders WHERE id = 1 AND note = 'a'`))
+}
+
+func TestIsReadOnlyQuery(t *testing.T) {
+	testCases := []struct {
+		query    string
+		expected bool
+	}{
+		{"SELECT * FROM sales.orders", true},
+		{"WITH o AS (SELECT * FROM sales.orders) SELECT count(*) FROM o", true},
+		{"SELECT * INTO sales.copy FROM sales.orders", false},
+		{"WITH d AS (DELETE FROM sales.orders RETURNING *) SELECT * FROM d", false},
+		{"INSERT INTO sales.orders VALUES (1)", false},
+		{"", false},
+	}
+	for _, tC := range testCases {
+		assert.Equal(t, tC.expected, isReadOnlyQuery(significantTokens(tokenizeSQL(tC.query))), tC.query)
+	}
+}
+
+func TestIsRoutingError(t *testing.T) {
+	assert.True(t, isRoutingError(&pq.Error{Code: "42P01"}))
+	assert.True(t, isRoutingError(&vertigo.VError{SQLState: "42V01"}))
+	assert.False(t, isRoutingError(&pq.Error{Code: "42601"}))
+	assert.False(t, isRoutingError(assert.AnError))
+}
+
+func newFallbackQueryExecutor(t *testing.T) (*QueryExecutor, sqlmock.Sqlmock, sqlmock.Sqlmock) {
+	vdb, vmock, err := sqlmock.New()
+	require.NoError(t, err)
+	t.Cleanup(func() { vdb.Close() })
+	pgdb, pgmock, err := sqlmock.New()
+	require.NoError(t, err)
+	t.Cleanup(func() { pgdb.Close() })
+
+	qe := newMockedQueryExecutor()
+	qe.conn.vdb, qe.conn.pgdb = vdb, pgdb
+	qe.conn.routeCache = newRouteCache()
+	qe.synchronizedSchemas = []string{"sales"}
+	return &qe, vmock, pgmock
+}
+
+func TestExecuteQuery_RoutingFallback(t *testing.T) {
+	qe, vmock, pgmock := newFallbackQueryExecutor(t)
+	qe.conn.user = "alice"
+
+	pgmock.ExpectQuery("SELECT \\* FROM public.staging").WillReturnError(&pq.Error{Code: "42P01"})
+	vmock.ExpectQuery("SELECT \\* FROM public.staging").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	rows, err := qe.executeQuery("SELECT * FROM public.staging WHERE id = 1")
+	require.NoError(t, err)
+	rows.Close()
+
+	route, ok := qe.conn.routeCache.get(routeCacheKey{user: "alice", fingerprint: fingerprint("SELECT * FROM public.staging WHERE id = 2")})
+	require.True(t, ok)
+	assert.Equal(t, RouteVertica, route)
+
+	vmock.ExpectQuery("SELECT \\* FROM public.staging").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	rows, err = qe.executeQuery("SELECT * FROM public.staging WHERE id = 2")
+	require.NoError(t, err)
+	rows.Close()
+
+	// the remembered route is only used by the same user with the same
+	// search_path
+	for _, session := range []struct{ user, searchPath string }{{"bob", ""}, {"alice", "staging"}} {
+		qe.conn.user, qe.searchPath = session.user, session.searchPath
+		pgmock.ExpectQuery("SELECT \\* FROM public.staging").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+		rows, err = qe.executeQuery("SELECT * FROM public.staging WHERE id = 3")
+		require.NoError(t, err)
+		rows.Close()
+	}
+
+	assert.NoError(t, vmock.ExpectationsWereMet())
+	assert.NoError(t, pgmock.ExpectationsWereMet())
+}
+
+func TestExecuteQuery_NoRoutingFallbackToShadowTables(t *testing.T) {
+	qe, vmock, pgmock := newFallbackQueryExecutor(t)
+
+	// Postgres has empty copies of the synchronized tables, answering from
+	// them would hide the error
+	original := &vertigo.VError{SQLState: "42V01", ErrorCode: "4566", Message: `Relation "sales.staging" does not exist`}
+	vmock.ExpectQuery("SELECT \\* FROM sales.staging").WillReturnError(original)
+	_, err := qe.executeQuery("SELECT * FROM sales.staging WHERE id = 1")
+	assert.Equal(t, original, err)
+	assert.Equal(t, "42V01", qe.getErrorResponse(err).Code)
+
+	assert.NoError(t, vmock.ExpectationsWereMet())
+	assert.NoError(t, pgmock.ExpectationsWereMet())
+}
+
+func TestExecuteQuery_RoutingFallbackFails(t *testing.T) {
+	qe, vmock, pgmock := newFallbackQueryExecutor(t)
+
+	original := &pq.Error{Code: "42P01", Message: `relation "public.orders" does not exist`}
+	pgmock.ExpectQuery("SELECT \\* FROM public.orders").WillReturnError(original)
+	vmock.ExpectQuery("SELECT \\* FROM public.orders").WillReturnError(&vertigo.VError{SQLState: "42V01"})
+	_, err := qe.executeQuery("SELECT * FROM public.orders")
+	assert.Equal(t, original, err)
+
+	_, ok := qe.conn.routeCache.get(routeCacheKey{fingerprint: fingerprint("SELECT * FROM public.orders")})
+	assert.False(t, ok)
+
+	assert.NoError(t, vmock.ExpectationsWereMet())
+	assert.NoError(t, pgmock.ExpectationsWereMet())
+}
+
+func TestExecuteQuery_NoRoutingFallback(t *testing.T) {
+	testCases := []struct {
+		desc  string
+		query string
+		setup func(qe *QueryExecutor)
+		err   error
+	}{
+		{desc: "disabled", query: "SELECT * FROM public.orders", setup: func(qe *QueryExecutor) { qe.conn.routeCache = nil }, err: &pq.Error{Code: "42P01"}},
+		{desc: "in transaction", query: "SELECT * FROM public.orders", setup: func(qe *QueryExecutor) { qe.inTransaction = true }, err: &pq.Error{Code: "42P01"}},
+		{desc: "other error", query: "SELECT * FROM public.orders", err: &pq.Error{Code: "42601"}},
+		{desc: "not read-only", query: "DELETE FROM public.orders", err: &pq.Error{Code: "42P01"}},
+		{desc: "hint", query: "/* pgvertica:route=postgres */ SELECT * FROM public.orders", err: &pq.Error{Code: "42P01"}},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			qe, vmock, pgmock := newFallbackQueryExecutor(t)
+			if tC.setup != nil {
+				tC.setup(qe)
+			}
+
+			pgmock.ExpectQuery("FROM public.orders").WillReturnError(tC.err)
+			_, err := qe.executeQuery(tC.query)
+			assert.Equal(t, tC.err, err)
+
+			assert.NoError(t, vmock.ExpectationsWereMet())
+			assert.NoError(t, pgmock.ExpectationsWereMet())
+		})
+	}
+}
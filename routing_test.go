@@ -0,0 +1,155 @@
+package pgvertica
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testRoutingRules = `
+# ROUTE    MATCH...
+reject     table=hr.salaries
+postgres   user=etl_loader,airflow
+vertica    application_name=superset schema=sales
+postgres   regex="(?i)^select \* from sales\.staging_" # staging tables live in Postgres
+`
+
+func routed(query, user, applicationName string) routedQuery {
+	return routedQuery{
+		text:            query,
+		relations:       referencedRelations(significantTokens(tokenizeSQL(query))),
+		user:            user,
+		applicationName: applicationName,
+	}
+}
+
+func TestParseRoutingRules(t *testing.T) {
+	rules, err := ParseRoutingRules(strings.NewReader(testRoutingRules))
+	require.NoError(t, err)
+	require.Len(t, rules, 4)
+
+	assert.Equal(t, RouteReject, rules[0].Route)
+	assert.Equal(t, []string{"hr.salaries"}, rules[0].Tables)
+	assert.Equal(t, 3, rules[0].Line)
+	assert.Equal(t, []string{"etl_loader", "airflow"}, rules[1].Users)
+	assert.Equal(t, []string{"superset"}, rules[2].ApplicationNames)
+	assert.Equal(t, []string{"sales"}, rules[2].Schemas)
+	assert.Equal(t, `(?i)^select \* from sales\.staging_`, rules[3].Regexp.String())
+}
+
+func TestParseRoutingRules_Invalid(t *testing.T) {
+	for _, config := range []string{
+		"federate schema=sales",
+		"vertica schema",
+		"vertica database=sales",
+		"vertica regex=(",
+		`vertica regex="unterminated`,
+	} {
+		_, err := ParseRoutingRules(strings.NewReader(config))
+		assert.Error(t, err, config)
+	}
+}
+
+func TestRoutingRulesMatch(t *testing.T) {
+	rules, err := ParseRoutingRules(strings.NewReader(testRoutingRules))
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc         string
+		query        routedQuery
+		expectedLine int
+	}{
+		{"table with schema", routed("SELECT * FROM hr.salaries", "alice", ""), 3},
+		{"user", routed("SELECT * FROM sales.orders", "airflow", "superset"), 4},
+		{"application and schema", routed("SELECT * FROM sales.orders", "alice", "superset"), 5},
+		{"application without schema", routed("SELECT * FROM public.orders", "alice", "superset"), 0},
+		{"regex", routed("SELECT * FROM sales.staging_orders", "alice", "psql"), 6},
+		{"no rule", routed("SELECT * FROM sales.orders", "alice", "psql"), 0},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			rule := rules.Match(tC.query)
+			if tC.expectedLine == 0 {
+				assert.Nil(t, rule)
+				return
+			}
+			require.NotNil(t, rule)
+			assert.Equal(t, tC.expectedLine, rule.Line)
+		})
+	}
+}
+
+func TestRouteQuery(t *testing.T) {
+	rules, err := ParseRoutingRules(strings.NewReader(testRoutingRules))
+	require.NoError(t, err)
+	schemas := []string{"sales", "hr"}
+
+	testCases := []struct {
+		desc     string
+		query    string
+		user     string
+		expected Route
+		explicit bool
+		rejected bool
+	}{
+		{desc: "heuristic", query: "SELECT * FROM sales.orders", expected: RouteVertica},
+		{desc: "heuristic catalog", query: "SELECT * FROM pg_catalog.pg_class", expected: RoutePostgres},
+		{desc: "rule", query: "SELECT * FROM sales.orders", user: "airflow", expected: RoutePostgres, explicit: true},
+		{desc: "hint over rule", query: "/* pgvertica:route=vertica */ SELECT * FROM sales.orders", user: "airflow", expected: RouteVertica, explicit: true},
+		{desc: "hint over heuristic", query: "SELECT * FROM pg_catalog.pg_class -- PGVertica:Route = postgres", expected: RoutePostgres, explicit: true},
+		{desc: "hint in a string is ignored", query: "SELECT '/* pgvertica:route=postgres */' FROM sales.orders", expected: RouteVertica},
+		{desc: "invalid hint", query: "/* pgvertica:route=reject */ SELECT * FROM sales.orders", expected: RouteVertica},
+		{desc: "reject over hint", query: "/* pgvertica:route=vertica */ SELECT * FROM hr.salaries", rejected: true},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			route, explicit, err := routeQuery(routed(tC.query, tC.user, ""), tokenizeSQL(tC.query), rules, schemas)
+			if tC.rejected {
+				var routingErr *routingError
+				require.ErrorAs(t, err, &routingErr)
+				assert.Equal(t, insufficientPrivilegeCode, routingErr.errorResponse().Code)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tC.expected, route)
+			assert.Equal(t, tC.explicit, explicit)
+		})
+	}
+}
+
+func TestExecuteQuery_RoutingRules(t *testing.T) {
+	vdb, vmock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer vdb.Close()
+	pgdb, pgmock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer pgdb.Close()
+
+	qe := newMockedQueryExecutor()
+	qe.conn.vdb, qe.conn.pgdb = vdb, pgdb
+	qe.conn.user = "airflow"
+	qe.synchronizedSchemas = []string{"sales"}
+	qe.routingRules, err = ParseRoutingRules(strings.NewReader(testRoutingRules))
+	require.NoError(t, err)
+
+	pgmock.ExpectQuery("SELECT \\* FROM sales.orders").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	rows, err := qe.executeQuery("SELECT * FROM sales.orders")
+	require.NoError(t, err)
+	rows.Close()
+
+	qe.applicationName = "superset"
+	qe.conn.user = "alice"
+	vmock.ExpectQuery("SELECT \\* FROM sales.orders").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	rows, err = qe.executeQuery("SELECT * FROM sales.orders")
+	require.NoError(t, err)
+	rows.Close()
+
+	_, err = qe.executeQuery("SELECT * FROM hr.salaries")
+	assert.Equal(t, insufficientPrivilegeCode, qe.getErrorResponse(err).Code)
+
+	assert.NoError(t, vmock.ExpectationsWereMet())
+	assert.NoError(t, pgmock.ExpectationsWereMet())
+}
@@ -3,6 +3,7 @@ package pgvertica
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"reflect"
@@ -30,12 +31,27 @@ const (
 
 type ServerConfig struct {
 	Addr                     string
+	Listen                   []ListenAddr
 	VerticaConnectionString  string
 	PostgresConnectionString string
 	RequirePassword          bool
+	AuthMethod               AuthMethod
+	Credentials              CredentialStore
+	Authenticator            Authenticator
+	AccessRules              HBARules
+	RoutingRules             RoutingRules
+	RoutingFallback          bool
+	RewriteRules             RewriteRules
+	FederationMaxRows        int
 	LogLevel                 int
 	TlsConfig                *tls.Config
+	ClientCertMode           ClientCertMode
+	ClientCertMapping        ClientCertMapping
 	SynchronizedSchemas      []string
+	ParameterStatus          ParameterStatus
+	Pool                     PoolConfig
+	Failover                 FailoverConfig
+	Limits                   Limits
 }
 
 type Listener interface {
@@ -46,9 +62,24 @@ type Listener interface {
 
 type Server struct {
 	mu    sync.Mutex
-	ln    Listener
+	lns   []Listener
 	conns map[*Conn]struct{}
 
+	// sessions maps the process IDs sent in BackendKeyData to their
+	// connections, so cancel requests can find them.
+	sessions      map[uint32]*Conn
+	lastProcessID uint32
+	// draining is set by Shutdown, sessions are then ended once idle.
+	draining bool
+
+	// pools holds the Vertica and Postgres connections shared by sessions.
+	pools  *BackendPools
+	limits *sessionLimits
+	// vnodes balances sessions across the Vertica nodes.
+	vnodes *verticaNodes
+	// routeCache is shared by sessions when the routing fallback is enabled.
+	routeCache *routeCache
+
 	g      errgroup.Group
 	ctx    context.Context
 	cancel func()
@@ -60,36 +91,59 @@ type Server struct {
 
 func NewServer(config *ServerConfig) *Server {
 	s := &Server{
-		conns:   make(map[*Conn]struct{}),
-		config:  config,
-		listen:  net.Listen,
-		newConn: newConn,
+		conns:    make(map[*Conn]struct{}),
+		sessions: make(map[uint32]*Conn),
+		pools:    NewBackendPools(config.Pool),
+		limits:   newSessionLimits(config.Limits),
+		vnodes:   newVerticaNodes(config.VerticaConnectionString, config.Failover.BackupNodes),
+		config:   config,
+		listen:   net.Listen,
+		newConn:  newConn,
+	}
+	if config.RoutingFallback {
+		s.routeCache = newRouteCache()
 	}
 	s.ctx, s.cancel = context.WithCancel(context.Background())
 	return s
 }
 
-func (s *Server) Open() (err error) {
-	s.ln, err = s.listen("tcp", s.config.Addr)
-	if err != nil {
-		return err
+// Open listens on Addr and every Listen address, all of them are served
+// the same way.
+func (s *Server) Open() error {
+	addrs := s.config.listenAddrs()
+	if len(addrs) == 0 {
+		return fmt.Errorf("no listen address")
 	}
 
-	s.g.Go(func() error {
-		if err := s.serve(); s.ctx.Err() != nil {
-			return err // return error unless context canceled
+	for _, addr := range addrs {
+		ln, err := s.listenOn(addr)
+		if err != nil {
+			s.closeListeners()
+			return fmt.Errorf("listen on %s: %w", addr, err)
 		}
-		return nil
-	})
+		s.mu.Lock()
+		s.lns = append(s.lns, ln)
+		s.mu.Unlock()
+
+		s.g.Go(func() error {
+			if err := s.serve(ln); s.ctx.Err() == nil && !s.isDraining() {
+				return err // return error unless context canceled
+			}
+			return nil
+		})
+	}
+
+	if s.vnodes != nil && s.config.Failover.HealthCheckInterval > 0 {
+		s.g.Go(func() error {
+			s.vnodes.watch(s.ctx, s.config.Failover)
+			return nil
+		})
+	}
 	return nil
 }
 
 func (s *Server) Close() (err error) {
-	if s.ln != nil {
-		if e := s.ln.Close(); err == nil {
-			err = e
-		}
-	}
+	err = s.closeListeners()
 	s.cancel()
 
 	// Track and close all open connections.
@@ -97,8 +151,13 @@ func (s *Server) Close() (err error) {
 		err = e
 	}
 
-	if err := s.g.Wait(); err != nil {
-		return err
+	if e := s.g.Wait(); err == nil {
+		err = e
+	}
+
+	// sessions are done, nothing holds pooled connections anymore
+	if e := s.pools.Close(); err == nil {
+		err = e
 	}
 	return err
 }
@@ -128,9 +187,48 @@ func (s *Server) CloseClientConnection(conn *Conn) (err error) {
 	return conn.Close()
 }
 
-func (s *Server) serve() error {
+// Usage returns the sessions and Vertica queries counted against the
+// configured limits.
+func (s *Server) Usage() Usage {
+	return s.limits.usage()
+}
+
+// SetSynchronizedSchemas replaces the list of schemas routed to Vertica.
+// Connections opened afterwards use the new list.
+func (s *Server) SetSynchronizedSchemas(schemas []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.config.SynchronizedSchemas = append([]string(nil), schemas...)
+}
+
+// configSnapshot returns a shallow copy of the config that is safe to use
+// while SetSynchronizedSchemas runs concurrently.
+func (s *Server) configSnapshot() *ServerConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	config := *s.config
+	return &config
+}
+
+// closeListeners stops accepting connections.
+func (s *Server) closeListeners() (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, ln := range s.lns {
+		// Shutdown may have closed them already
+		if e := ln.Close(); err == nil && !errors.Is(e, net.ErrClosed) {
+			err = e
+		}
+	}
+	return err
+}
+
+func (s *Server) serve(ln Listener) error {
 	for {
-		c, err := s.ln.Accept()
+		c, err := ln.Accept()
 		if err != nil {
 			return err
 		}
@@ -158,43 +256,73 @@ func (s *Server) serve() error {
 }
 
 func (s *Server) serveConn(ctx context.Context, initalConn *Conn) error {
-	conn, err := serveConnStartup(ctx, initalConn, s.config)
+	config := s.configSnapshot()
+	backendKey, err := s.newBackendKey()
+	if err != nil {
+		return fmt.Errorf("backend key: %w", err)
+	}
+	initalConn.backendKey = backendKey
+	initalConn.pools = s.pools
+	initalConn.limits = s.limits
+	initalConn.vnodes = s.vnodes
+	initalConn.routeCache = s.routeCache
+
+	conn, err := serveConnStartup(ctx, initalConn, config)
+	var cancelReq *cancelRequest
+	if errors.As(err, &cancelReq) {
+		s.cancelQuery(cancelReq.processID, cancelReq.secretKey)
+		return nil
+	}
 	if err != nil {
 		return fmt.Errorf("startup: %w", err)
 	}
 
-	queryExecutor := newQueryExecutor(ctx, conn, s.config)
+	if conn.releaseSlot != nil {
+		defer conn.releaseSlot()
+	}
+	conn.drain = newSessionDrain(conn)
+	conn.canceler = newQueryCanceler(ctx)
+	defer conn.canceler.close()
+	s.registerSession(conn)
+	defer s.unregisterSession(conn)
+
+	queryExecutor := newQueryExecutor(ctx, conn, config)
+	defer queryExecutor.close()
 
 	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !conn.drain.idle(queryExecutor.idle()) {
+			return nil // terminated by Shutdown
+		}
+
 		msg, err := conn.receiver.Receive()
+		if !conn.drain.begin() {
+			return nil
+		}
 		if err != nil {
 			return fmt.Errorf("receive message: %w", err)
 		}
 
 		Logger.Debug("[recv][s]", "type", reflect.TypeOf(msg), "message", msg)
 
+		queryExecutor.ctx = conn.canceler.begin()
 		switch msg := msg.(type) {
 		case *pgproto3.Query:
 			if err := queryExecutor.handleQueryMessage(msg); err != nil {
 				Logger.Error("query message", "error", err)
 			}
-		case *pgproto3.Parse:
-			if err := queryExecutor.handleParseMessage(msg); err != nil {
-				Logger.Error("parse message", "error", err)
-			}
-		case *pgproto3.Bind:
-			if err := queryExecutor.handleBindMessage(msg); err != nil {
-				Logger.Error("bind message", "error", err)
+		case *pgproto3.Parse, *pgproto3.Bind, *pgproto3.Describe, *pgproto3.Execute, *pgproto3.Close:
+			if err := queryExecutor.handleExtendedMessage(msg); err != nil {
+				Logger.Error("extended query message", "type", reflect.TypeOf(msg), "error", err)
 			}
-		case *pgproto3.Describe:
-			if err := queryExecutor.handleDescribe(msg); err != nil {
-				Logger.Error("describe message", "error", err)
+		case *pgproto3.Flush:
+			if err := queryExecutor.mb.sendQueuedMessages(); err != nil {
+				return err
 			}
-		case *pgproto3.Close:
-			queryExecutor.mb.queueMessages(&pgproto3.CloseComplete{})
 		case *pgproto3.Sync:
-			queryExecutor.mb.queueMessages(&pgproto3.ReadyForQuery{TxStatus: queryExecutor.getTransactionStatus()})
-			if err := queryExecutor.mb.sendQueuedMessages(); err != nil {
+			if err := queryExecutor.handleSync(); err != nil {
 				return err
 			}
 		case *pgproto3.Terminate:
@@ -203,6 +331,8 @@ func (s *Server) serveConn(ctx context.Context, initalConn *Conn) error {
 		default:
 			Logger.Warn("unexpected message type: %#v", msg)
 		}
+		conn.canceler.end()
+		queryExecutor.releaseBackends()
 	}
 }
 
@@ -3,6 +3,7 @@ package pgvertica
 import (
 	"context"
 	"net"
+	"sync"
 	"testing"
 	"time"
 
@@ -12,13 +13,23 @@ import (
 )
 
 type MockListener struct {
+	mu     sync.Mutex
+	closed bool
 }
 
 func (m *MockListener) Accept() (net.Conn, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, net.ErrClosed
+	}
 	return &MockConn{}, nil
 }
 
 func (m *MockListener) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
 	return nil
 }
 
@@ -37,16 +48,18 @@ func mockNewConn(conn net.Conn) *Conn {
 }
 
 func mockServer() *Server {
+	ln := &MockListener{}
 	s := Server{
-		conns: make(map[*Conn]struct{}),
+		conns:    make(map[*Conn]struct{}),
+		sessions: make(map[uint32]*Conn),
+		pools:    NewBackendPools(PoolConfig{}),
 		config: &ServerConfig{
 			Addr:                     "localhost:5433",
 			PostgresConnectionString: "postgres://postgres@localhost:5432/postgres?sslmode=disable",
 			VerticaConnectionString:  "vertica://dbadmin@localhost:5433/docker?sslmode=disable",
 		},
-		ln: &MockListener{},
 		listen: func(string, string) (net.Listener, error) {
-			return &MockListener{}, nil
+			return ln, nil
 		},
 		newConn: mockNewConn,
 	}
@@ -54,7 +67,8 @@ func mockServer() *Server {
 	s.newConn = func(conn net.Conn) *Conn {
 		mockReceiver := new(MockReceiver)
 		mockReceiver.On("ReceiveStartupMessage").Return(&pgproto3.StartupMessage{}, nil)
-		mockReceiver.On("Receive").Return(&pgproto3.Sync{}, nil)
+		mockReceiver.On("Receive").Return(&pgproto3.Sync{}, nil).Once()
+		mockReceiver.On("Receive").Return(&pgproto3.Terminate{}, nil)
 		return &Conn{
 			Conn:     conn,
 			receiver: mockReceiver,
@@ -66,6 +80,7 @@ func mockServer() *Server {
 func TestServerOpen(t *testing.T) {
 	s := mockServer()
 	err := s.Open()
+	defer s.Close()
 	require.NoError(t, err)
 
 	require.NoError(t, err)
@@ -84,8 +99,11 @@ func TestServerClose(t *testing.T) {
 func TestServerCloseClientConnections(t *testing.T) {
 	s := mockServer()
 	require.NoError(t, s.Open())
+	defer s.Close()
 
+	s.mu.Lock()
 	s.conns[newConn(&MockConn{})] = struct{}{}
+	s.mu.Unlock()
 	require.NoError(t, s.CloseClientConnections())
 
 	// conns map should be empty after closing connections.
@@ -101,23 +119,11 @@ func TestServerServeConn(t *testing.T) {
 		receiver: mockReceiver,
 	}
 	s := mockServer()
-	s.newConn = func(conn net.Conn) *Conn {
-		return mockConn
-	}
 
-	go func() {
-		require.NoError(t, s.Open())
-
-	}()
-	defer s.Close()
-
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	s.ctx = ctx
-	s.cancel = cancel
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
 	defer cancel()
 
-	go func() {
-		err := s.serveConn(ctx, mockConn)
-		assert.ErrorIs(t, err, context.DeadlineExceeded)
-	}()
+	err := s.serveConn(ctx, mockConn)
+	require.Error(t, err, "a refused startup ends the connection")
+	assert.Contains(t, err.Error(), "database required")
 }
@@ -0,0 +1,233 @@
+package pgvertica
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const invalidParameterValueCode = "22023"
+
+// startupOnlyParameters are startup parameters that are not session settings.
+var startupOnlyParameters = []string{"user", "database", "password", "options", "replication", "client_encoding"}
+
+var (
+	settingNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+	dateStyleRegexp   = regexp.MustCompile(`^[A-Za-z, ]+$`)
+)
+
+// startupSessionSettings returns the session settings requested by a client
+// in the startup parameters, including the "-c name=value" and
+// "--name=value" switches of the options parameter, keyed by lower-cased
+// name. Client encoding is not included, the proxy always speaks UTF8.
+func startupSessionSettings(params map[string]string) (map[string]string, error) {
+	settings := make(map[string]string)
+	for name, value := range params {
+		if !contains(startupOnlyParameters, name) {
+			settings[strings.ToLower(name)] = value
+		}
+	}
+
+	options, err := parseStartupOptions(params["options"])
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range options {
+		if strings.ToLower(name) != "client_encoding" {
+			settings[strings.ToLower(name)] = value
+		}
+	}
+
+	for name := range settings {
+		if !settingNameRegexp.MatchString(name) {
+			return nil, fmt.Errorf("invalid parameter name \"%s\"", name)
+		}
+	}
+	return settings, nil
+}
+
+// parseStartupOptions parses the options startup parameter the way Postgres
+// does: switches are separated by spaces, a backslash escapes the next
+// character, and "-c name=value" or "--name=value" set a parameter.
+func parseStartupOptions(options string) (map[string]string, error) {
+	args := splitStartupOptions(options)
+	settings := make(map[string]string)
+	for i := 0; i < len(args); i++ {
+		var setting string
+		switch {
+		case args[i] == "-c":
+			if i+1 == len(args) {
+				return nil, fmt.Errorf("invalid command-line argument: -c requires a value")
+			}
+			i++
+			setting = args[i]
+		case strings.HasPrefix(args[i], "-c"):
+			setting = strings.TrimPrefix(args[i], "-c")
+		case strings.HasPrefix(args[i], "--"):
+			setting = strings.TrimPrefix(args[i], "--")
+		default:
+			return nil, fmt.Errorf("invalid command-line argument: %s", args[i])
+		}
+
+		name, value, ok := strings.Cut(setting, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid command-line argument: %s requires a value", name)
+		}
+		// like Postgres, dashes in names given on the command line mean underscores
+		settings[strings.ReplaceAll(name, "-", "_")] = value
+	}
+	return settings, nil
+}
+
+func splitStartupOptions(options string) []string {
+	var args []string
+	var current strings.Builder
+	escaped, inArg := false, false
+	for _, r := range options {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped, inArg = true, true
+		case r == ' ' || r == '\t':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args
+}
+
+// verticaSessionStatements translates session settings to the Vertica
+// statements applying them. Settings without a Vertica equivalent are skipped.
+func verticaSessionStatements(settings map[string]string) []string {
+	var statements []string
+	for _, name := range sortedKeys(settings) {
+		value := settings[name]
+		switch name {
+		case "search_path":
+			var schemas []string
+			for _, schema := range strings.Split(value, ",") {
+				if schema = strings.Trim(strings.TrimSpace(schema), `"'`); schema != "" {
+					schemas = append(schemas, quoteIdentifier(schema))
+				}
+			}
+			if len(schemas) > 0 {
+				statements = append(statements, "SET SEARCH_PATH TO "+strings.Join(schemas, ", "))
+			}
+		case "timezone":
+			statements = append(statements, "SET TIME ZONE TO "+quoteLiteral(value))
+		case "application_name":
+			statements = append(statements, "SELECT SET_CLIENT_LABEL("+quoteLiteral(value)+")")
+		case "datestyle":
+			if !dateStyleRegexp.MatchString(value) {
+				Logger.Warn("Ignore invalid DateStyle for Vertica", "value", value)
+				continue
+			}
+			statements = append(statements, "SET DATESTYLE TO "+value)
+		default:
+			Logger.Debug("Session setting not applied to Vertica", "name", name)
+		}
+	}
+	return statements
+}
+
+// verticaRuntimeSettings are the settings a client changes with SET during
+// the session that are applied to Vertica too, like at startup.
+var verticaRuntimeSettings = []string{"application_name", "datestyle", "search_path", "timezone"}
+
+// verticaSettingReset returns the statement of verticaSessionReset
+// restoring the Vertica default of a setting, or "".
+func verticaSettingReset(name string) string {
+	for _, statement := range verticaSessionReset {
+		if setStatementKey(statement) == name {
+			return statement
+		}
+	}
+	return ""
+}
+
+// verticaSessionReset restores the Vertica defaults of every setting
+// verticaSessionStatements applies, whichever session left them on a
+// pooled connection.
+var verticaSessionReset = []string{
+	"SELECT SET_CLIENT_LABEL('')",
+	"SET DATESTYLE TO ISO, MDY",
+	"SET SEARCH_PATH TO DEFAULT",
+	"SET TIME ZONE TO DEFAULT",
+}
+
+// postgresSessionReset clears every setting of a Postgres connection,
+// including the ones changed by the client with SET.
+var postgresSessionReset = []string{"RESET ALL"}
+
+// postgresSessionStatements applies the session settings to Postgres.
+// Settings Postgres does not know are skipped by looking them up in
+// pg_settings, except custom "prefix.name" ones, which Postgres accepts
+// under any name.
+func postgresSessionStatements(settings map[string]string) []string {
+	statements := make([]string, 0, len(settings))
+	for _, name := range sortedKeys(settings) {
+		statement := fmt.Sprintf("SELECT set_config(%s, %s, false)", quoteLiteral(name), quoteLiteral(settings[name]))
+		if !strings.Contains(name, ".") {
+			statement += " FROM pg_settings WHERE name = " + quoteLiteral(name)
+		}
+		statements = append(statements, statement)
+	}
+	return statements
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func quoteLiteral(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+var (
+	setConfigRegexp   = regexp.MustCompile(`^SELECT set_config\('((?:[^']|'')*)'`)
+	clientLabelRegexp = regexp.MustCompile(`^SELECT SET_CLIENT_LABEL\(`)
+	setLocalRegexp    = regexp.MustCompile(`(?is)^\s*SET\s+LOCAL\s`)
+)
+
+// setStatementKey returns the lower-cased name of the parameter changed by
+// a SET query, a set_config call or the SET_CLIENT_LABEL call standing for
+// application_name on Vertica, or "" for other statements.
+func setStatementKey(statement string) string {
+	if matches := setConfigRegexp.FindStringSubmatch(statement); matches != nil {
+		return strings.ToLower(matches[1])
+	}
+	if clientLabelRegexp.MatchString(statement) {
+		return "application_name"
+	}
+	if param, _, err := parseSetStatement(statement); err == nil {
+		return strings.ToLower(param)
+	}
+	return ""
+}
+
+// isSetLocalQuery reports whether a SET query only lasts until the end of
+// the transaction.
+func isSetLocalQuery(query string) bool {
+	return setLocalRegexp.MatchString(query)
+}
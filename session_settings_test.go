@@ -0,0 +1,216 @@
+package pgvertica
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	vertigo "github.com/vertica/vertica-sql-go"
+)
+
+func TestParseStartupOptions(t *testing.T) {
+	settings, err := parseStartupOptions(`-c search_path=sales,public --statement-timeout=5min -cgeqo=off -c application_name=My\ App`)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"search_path":       "sales,public",
+		"statement_timeout": "5min",
+		"geqo":              "off",
+		"application_name":  "My App",
+	}, settings)
+
+	for _, options := range []string{"-c", "-c search_path", "-x"} {
+		_, err := parseStartupOptions(options)
+		assert.Error(t, err, options)
+	}
+}
+
+func TestStartupSessionSettings(t *testing.T) {
+	settings, err := startupSessionSettings(map[string]string{
+		"user":             "alice",
+		"database":         "test",
+		"client_encoding":  "LATIN1",
+		"application_name": "Tableau",
+		"TimeZone":         "Europe/Warsaw",
+		"options":          "-c search_path=sales -c client_encoding=LATIN1",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"application_name": "Tableau",
+		"timezone":         "Europe/Warsaw",
+		"search_path":      "sales",
+	}, settings)
+
+	_, err = startupSessionSettings(map[string]string{"options": "-c bad;name=1"})
+	assert.Error(t, err)
+}
+
+func TestVerticaSessionStatements(t *testing.T) {
+	statements := verticaSessionStatements(map[string]string{
+		"application_name":   "Bob's dashboard",
+		"datestyle":          "ISO, DMY",
+		"search_path":        `"$user", sales`,
+		"timezone":           "Europe/Warsaw",
+		"extra_float_digits": "3",
+	})
+
+	assert.Equal(t, []string{
+		"SELECT SET_CLIENT_LABEL('Bob''s dashboard')",
+		"SET DATESTYLE TO ISO, DMY",
+		`SET SEARCH_PATH TO "$user", "sales"`,
+		"SET TIME ZONE TO 'Europe/Warsaw'",
+	}, statements)
+
+	assert.Empty(t, verticaSessionStatements(map[string]string{"datestyle": "ISO; DROP TABLE x"}))
+}
+
+func TestPostgresSessionStatements(t *testing.T) {
+	statements := postgresSessionStatements(map[string]string{"search_path": "sales, public", "application_name": "it's", "myapp.tenant": "7"})
+
+	assert.Equal(t, []string{
+		"SELECT set_config('application_name', 'it''s', false) FROM pg_settings WHERE name = 'application_name'",
+		"SELECT set_config('myapp.tenant', '7', false)",
+		"SELECT set_config('search_path', 'sales, public', false) FROM pg_settings WHERE name = 'search_path'",
+	}, statements)
+}
+
+func TestSetStatementKey(t *testing.T) {
+	assert.Equal(t, "search_path", setStatementKey("SELECT set_config('search_path', 'sales', false)"))
+	assert.Equal(t, "search_path", setStatementKey("SET Search_Path TO sales"))
+	assert.Equal(t, "timezone", setStatementKey("SET TIME ZONE 'UTC'"))
+	assert.Equal(t, "application_name", setStatementKey("SELECT SET_CLIENT_LABEL('bi')"))
+	assert.Equal(t, "", setStatementKey("SELECT 1"))
+
+	assert.True(t, isSetLocalQuery("set local statement_timeout = 10"))
+	assert.False(t, isSetLocalQuery("SET statement_timeout = 10"))
+}
+
+func TestHandleStartupMessage_InvalidOptions(t *testing.T) {
+	mockConn := &MockConn{}
+	c := &Conn{Conn: mockConn}
+	msg := &pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"database": "test", "user": "alice", "options": "-c search_path"},
+	}
+
+	err := handleStartupMessage(context.Background(), c, msg, &ServerConfig{})
+
+	assert.Error(t, err)
+	response := lastWrittenMessage(t, mockConn.buf.Bytes()).(*pgproto3.ErrorResponse)
+	assert.Equal(t, invalidParameterValueCode, response.Code)
+}
+
+func TestSessionSettingsFailed(t *testing.T) {
+	testCases := []struct {
+		desc string
+		err  error
+		code string
+	}{
+		{desc: "vertica queue timeout", err: &limitError{message: "timed out waiting for a Vertica query slot"}, code: tooManyConnectionsCode},
+		{desc: "postgres error", err: fmt.Errorf("session setting SET x: %w", &pq.Error{Code: "22P02", Message: "invalid input syntax"}), code: "22P02"},
+		{desc: "vertica error", err: fmt.Errorf("session setting SET x: %w", &vertigo.VError{SQLState: "22V23", Message: "invalid time zone"}), code: "22V23"},
+		{desc: "other error", err: errors.New("connection reset"), code: invalidParameterValueCode},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			mockConn := &MockConn{}
+
+			err := sessionSettingsFailed(&Conn{Conn: mockConn}, tC.err)
+
+			assert.ErrorIs(t, err, tC.err)
+			response := lastWrittenMessage(t, mockConn.buf.Bytes()).(*pgproto3.ErrorResponse)
+			assert.Equal(t, "FATAL", response.Severity)
+			assert.Equal(t, tC.code, response.Code)
+		})
+	}
+}
+
+func TestFollowVerticaSettings_SearchPath(t *testing.T) {
+	vdb, vmock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	require.NoError(t, err)
+	defer vdb.Close()
+
+	qe := newMockedQueryExecutor()
+	qe.conn.settings = map[string]string{"search_path": "public"}
+	qe.conn.vlease = backendLease{setup: verticaSessionStatements(qe.conn.settings), reset: verticaSessionReset}
+	for _, statement := range verticaSessionReset {
+		vmock.ExpectExec(statement).WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	vmock.ExpectExec(`SET SEARCH_PATH TO "public"`).WillReturnResult(sqlmock.NewResult(0, 0))
+	_, err = qe.conn.vlease.acquire(context.Background(), vdb)
+	require.NoError(t, err)
+
+	// the held connection gets the new path, the next leases get it too
+	vmock.ExpectExec(`SET SEARCH_PATH TO "sales", "public"`).WillReturnResult(sqlmock.NewResult(0, 0))
+	qe.followVerticaSettings("SET search_path TO 'sales', public")
+	assert.Equal(t, []string{`SET SEARCH_PATH TO "sales", "public"`}, qe.conn.vlease.setup)
+	assert.Equal(t, "sales", searchPathSchema(qe.searchPath, qe.conn.user, nil))
+
+	vmock.ExpectExec(`SET SEARCH_PATH TO "public"`).WillReturnResult(sqlmock.NewResult(0, 0))
+	qe.followVerticaSettings("RESET ALL")
+	assert.Equal(t, []string{`SET SEARCH_PATH TO "public"`}, qe.conn.vlease.setup)
+	assert.Equal(t, "public", qe.searchPath)
+
+	// without a startup value the Vertica default is restored
+	qe.conn.settings = nil
+	vmock.ExpectExec("SET SEARCH_PATH TO DEFAULT").WillReturnResult(sqlmock.NewResult(0, 0))
+	qe.followVerticaSettings("RESET search_path")
+	assert.Empty(t, qe.conn.vlease.setup)
+	assert.Empty(t, qe.searchPath)
+
+	qe.followVerticaSettings("SET LOCAL search_path TO hr")
+	assert.NoError(t, vmock.ExpectationsWereMet())
+}
+
+func TestExecuteStatement_SetTimeZoneAppliedToVertica(t *testing.T) {
+	vdb, vmock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	require.NoError(t, err)
+	defer vdb.Close()
+	pgdb, pgmock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	require.NoError(t, err)
+	defer pgdb.Close()
+
+	qe := newMockedQueryExecutor()
+	qe.conn.vdb, qe.conn.pgdb = vdb, pgdb
+	qe.conn.vlease = backendLease{setup: []string{"SET TIME ZONE TO 'UTC'"}, reset: verticaSessionReset}
+
+	pgmock.ExpectQuery("SET TimeZone = 'Europe/Warsaw'").WillReturnRows(sqlmock.NewRows(nil))
+	pgmock.ExpectQuery("SET application_name = 'report'").WillReturnRows(sqlmock.NewRows(nil))
+	require.NoError(t, qe.executeStatement("SET TimeZone = 'Europe/Warsaw'"))
+	require.NoError(t, qe.executeStatement("SET application_name = 'report'"))
+	assert.NoError(t, pgmock.ExpectationsWereMet())
+
+	// the next Vertica lease gets the settings changed on Postgres
+	for _, statement := range verticaSessionReset {
+		vmock.ExpectExec(statement).WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	vmock.ExpectExec("SET TIME ZONE TO 'Europe/Warsaw'").WillReturnResult(sqlmock.NewResult(0, 0))
+	vmock.ExpectExec("SELECT SET_CLIENT_LABEL('report')").WillReturnResult(sqlmock.NewResult(0, 0))
+	_, err = qe.conn.vlease.acquire(context.Background(), vdb)
+	require.NoError(t, err)
+	assert.NoError(t, vmock.ExpectationsWereMet())
+}
+
+func TestRunPortal_SetSearchPathAppliedToVertica(t *testing.T) {
+	pgdb, pgmock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	require.NoError(t, err)
+	defer pgdb.Close()
+
+	qe := newMockedQueryExecutor()
+	qe.conn.pgdb = pgdb
+	qe.conn.vlease = backendLease{reset: verticaSessionReset}
+
+	pgmock.ExpectPrepare("SET search_path TO sales").ExpectQuery().WillReturnRows(sqlmock.NewRows(nil))
+	require.NoError(t, qe.handleParse(&pgproto3.Parse{Query: "SET search_path TO sales"}))
+	require.NoError(t, qe.handleBind(&pgproto3.Bind{}))
+	require.NoError(t, qe.handleExtendedMessage(&pgproto3.Execute{}))
+
+	assert.Equal(t, []string{`SET SEARCH_PATH TO "sales"`}, qe.conn.vlease.setup)
+	assert.Equal(t, "sales", qe.searchPath)
+	assert.NoError(t, pgmock.ExpectationsWereMet())
+}
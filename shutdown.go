@@ -0,0 +1,137 @@
+package pgvertica
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+const adminShutdownCode = "57P01"
+
+// shutdownPollInterval is how often Shutdown checks whether the sessions ended.
+const shutdownPollInterval = 50 * time.Millisecond
+
+// sessionDrain lets Shutdown end a session once it is idle, i.e. waiting for
+// the next query after ReadyForQuery, outside a transaction and without open
+// cursors or portals, without interrupting its work.
+type sessionDrain struct {
+	mu         sync.Mutex
+	conn       *Conn
+	busy       bool
+	draining   bool
+	terminated bool
+}
+
+func newSessionDrain(conn *Conn) *sessionDrain {
+	return &sessionDrain{conn: conn}
+}
+
+// idle is called before the session waits for the next message, with
+// whether it is idle. A draining idle session is terminated, idle then
+// returns false.
+func (d *sessionDrain) idle(idle bool) bool {
+	d.mu.Lock()
+	d.busy = !idle
+	terminate := d.draining && !d.busy && !d.terminated
+	if terminate {
+		d.terminated = true
+	}
+	terminated := d.terminated
+	d.mu.Unlock()
+
+	if terminate {
+		d.terminate()
+	}
+	return !terminated
+}
+
+// begin is called when the session received a message. It returns false
+// when the session was terminated meanwhile and must not process it.
+func (d *sessionDrain) begin() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.busy = true
+	return !d.terminated
+}
+
+// drain terminates the session right away when it is idle, otherwise once
+// its query or transaction completes.
+func (d *sessionDrain) drain() {
+	d.mu.Lock()
+	d.draining = true
+	terminate := !d.busy && !d.terminated
+	if terminate {
+		d.terminated = true
+	}
+	d.mu.Unlock()
+
+	if terminate {
+		d.terminate()
+	}
+}
+
+// terminate tells the client and closes the connection. It is called once,
+// by whoever set terminated, without holding d.mu: the write may block on a
+// slow client.
+func (d *sessionDrain) terminate() {
+	Logger.Info("terminating idle session for shutdown", "address", d.conn.RemoteAddr())
+	if err := writeMessages(d.conn, &pgproto3.ErrorResponse{
+		Severity: "FATAL",
+		Code:     adminShutdownCode,
+		Message:  "terminating connection due to administrator command",
+	}); err != nil {
+		Logger.Warn("Can't notify session about shutdown", "error", err)
+	}
+	// unblocks the session waiting for the next message
+	d.conn.Conn.Close()
+}
+
+// Shutdown stops accepting connections and waits for the sessions to end.
+// Idle sessions are terminated with SQLSTATE 57P01, the others once their
+// query or transaction completes. When ctx is done first the remaining
+// sessions are closed and ctx.Err() is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.draining = true
+	sessions := make([]*Conn, 0, len(s.sessions))
+	for _, conn := range s.sessions {
+		sessions = append(sessions, conn)
+	}
+	s.mu.Unlock()
+
+	Logger.Info("draining sessions", "sessions", len(sessions))
+	s.closeListeners()
+	for _, conn := range sessions {
+		conn.drain.drain()
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for s.connectionCount() > 0 {
+		select {
+		case <-ctx.Done():
+			Logger.Warn("shutdown deadline reached, closing remaining sessions", "connections", s.connectionCount())
+			s.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return s.Close()
+}
+
+func (s *Server) isDraining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.draining
+}
+
+func (s *Server) connectionCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.conns)
+}
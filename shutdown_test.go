@@ -0,0 +1,112 @@
+package pgvertica
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionDrain(t *testing.T) {
+	mockConn := &MockConn{}
+	drain := newSessionDrain(&Conn{Conn: mockConn})
+
+	assert.True(t, drain.begin())
+	drain.drain()
+	assert.Empty(t, mockConn.buf.Bytes(), "running queries are not interrupted")
+
+	assert.True(t, drain.idle(false), "open transactions may complete")
+	assert.True(t, drain.begin())
+	assert.Empty(t, mockConn.buf.Bytes())
+
+	assert.False(t, drain.idle(true))
+	response := lastWrittenMessage(t, mockConn.buf.Bytes()).(*pgproto3.ErrorResponse)
+	assert.Equal(t, adminShutdownCode, response.Code)
+	assert.Equal(t, "FATAL", response.Severity)
+	assert.False(t, drain.begin())
+}
+
+func TestQueryExecutor_Idle(t *testing.T) {
+	qe := newMockedQueryExecutor()
+	qe.cursors = make(map[string]*Cursor)
+	assert.True(t, qe.idle())
+
+	// Parse, Bind and Execute before the Sync are one unit of work
+	qe.preparedStatements[""] = &PreparedStatement{query: "SELECT 1"}
+	require.NoError(t, qe.handleExtendedMessage(&pgproto3.Bind{}))
+	assert.False(t, qe.idle(), "the portal may still be executed")
+	require.NoError(t, qe.handleSync())
+	assert.True(t, qe.idle())
+
+	require.NoError(t, qe.handleExtendedMessage(&pgproto3.Close{ObjectType: 'S', Name: "none"}))
+	assert.False(t, qe.idle(), "no ReadyForQuery sent yet")
+	require.NoError(t, qe.handleSync())
+	assert.True(t, qe.idle())
+
+	qe.cursors["c"] = &Cursor{}
+	assert.False(t, qe.idle(), "the cursor may still be fetched")
+}
+
+// pipeSession registers a session whose client end is returned. The session
+// waits for the next message until its connection is closed.
+func pipeSession(s *Server, processID uint32, busy bool) net.Conn {
+	server, client := net.Pipe()
+	conn := newConn(server)
+	conn.backendKey.ProcessID = processID
+	conn.drain = newSessionDrain(conn)
+	if busy {
+		conn.drain.begin()
+	}
+
+	s.mu.Lock()
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
+	s.registerSession(conn)
+
+	go func() {
+		conn.receiver.Receive()
+		s.unregisterSession(conn)
+		s.CloseClientConnection(conn)
+	}()
+	return client
+}
+
+func TestServerShutdown(t *testing.T) {
+	s := mockServer()
+	require.NoError(t, s.Open())
+	client := pipeSession(s, 1, false)
+
+	received := make(chan *pgproto3.ErrorResponse, 1)
+	go func() {
+		msg, err := pgproto3.NewFrontend(pgproto3.NewChunkReader(client), client).Receive()
+		if err == nil {
+			received <- msg.(*pgproto3.ErrorResponse)
+		}
+		close(received)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, s.Shutdown(ctx))
+
+	response := <-received
+	require.NotNil(t, response)
+	assert.Equal(t, adminShutdownCode, response.Code)
+	assert.Empty(t, s.conns)
+}
+
+func TestServerShutdown_Deadline(t *testing.T) {
+	s := mockServer()
+	require.NoError(t, s.Open())
+	pipeSession(s, 1, true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	assert.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+	assert.Empty(t, s.conns, "sessions still running at the deadline are closed")
+}
@@ -0,0 +1,325 @@
+package pgvertica
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type sqlTokenKind int
+
+const (
+	// sqlIdentifier is an unquoted identifier or a keyword.
+	sqlIdentifier sqlTokenKind = iota
+	sqlQuotedIdentifier
+	// sqlString is a '...', E'...' or dollar quoted string literal.
+	sqlString
+	sqlNumber
+	// sqlParameter is a $n placeholder.
+	sqlParameter
+	// sqlOperator is an operator or a punctuation character like ( or ,.
+	sqlOperator
+	sqlComment
+)
+
+// sqlToken is a lexical token of a query.
+type sqlToken struct {
+	kind sqlTokenKind
+	// text is the token as written in the query.
+	text string
+	// value is the identifier folded to lower case, the unquoted identifier
+	// or the content of a string literal.
+	value string
+	// pos is the byte offset of the token in the query.
+	pos int
+}
+
+// isKeyword reports whether the token is the unquoted keyword, keyword must
+// be upper case.
+func (t sqlToken) isKeyword(keyword string) bool {
+	return t.kind == sqlIdentifier && strings.ToUpper(t.text) == keyword
+}
+
+func (t sqlToken) isOperator(operator string) bool {
+	return t.kind == sqlOperator && t.text == operator
+}
+
+// isName reports whether the token can name a relation or a column.
+func (t sqlToken) isName() bool {
+	return t.kind == sqlIdentifier || t.kind == sqlQuotedIdentifier
+}
+
+const sqlOperatorChars = "+-*/<>=~!@#%^&|`?"
+
+// tokenizeSQL splits a query into tokens following the PostgreSQL lexical
+// rules. Whitespace is dropped, comments are kept. Unterminated strings,
+// quoted identifiers and comments extend to the end of the query.
+func tokenizeSQL(query string) []sqlToken {
+	l := sqlLexer{query: query}
+	for l.pos < len(l.query) {
+		l.next()
+	}
+	return l.tokens
+}
+
+type sqlLexer struct {
+	query  string
+	pos    int
+	tokens []sqlToken
+}
+
+func (l *sqlLexer) emit(kind sqlTokenKind, start int, value string) {
+	l.tokens = append(l.tokens, sqlToken{kind: kind, text: l.query[start:l.pos], value: value, pos: start})
+}
+
+func (l *sqlLexer) peek(offset int) byte {
+	if l.pos+offset < len(l.query) {
+		return l.query[l.pos+offset]
+	}
+	return 0
+}
+
+func (l *sqlLexer) next() {
+	start := l.pos
+	c := l.query[l.pos]
+	switch {
+	case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v':
+		l.pos++
+	case c == '-' && l.peek(1) == '-':
+		end := strings.IndexByte(l.query[l.pos:], '\n')
+		if end < 0 {
+			l.pos = len(l.query)
+		} else {
+			l.pos += end
+		}
+		l.emit(sqlComment, start, "")
+	case c == '/' && l.peek(1) == '*':
+		l.blockComment()
+		l.emit(sqlComment, start, "")
+	case c == '\'':
+		l.emit(sqlString, start, l.quoted('\'', false))
+	case (c == 'e' || c == 'E') && l.peek(1) == '\'':
+		l.pos++
+		l.emit(sqlString, start, l.quoted('\'', true))
+	case c == '"':
+		l.emit(sqlQuotedIdentifier, start, l.quoted('"', false))
+	case c == '$' && isDigit(l.peek(1)):
+		l.pos++
+		for l.pos < len(l.query) && isDigit(l.query[l.pos]) {
+			l.pos++
+		}
+		l.emit(sqlParameter, start, "")
+	case c == '$':
+		if value, ok := l.dollarQuoted(); ok {
+			l.emit(sqlString, start, value)
+		} else {
+			l.pos++
+			l.emit(sqlOperator, start, "")
+		}
+	case isDigit(c) || c == '.' && isDigit(l.peek(1)) && !l.afterName():
+		l.number()
+		l.emit(sqlNumber, start, "")
+	case isIdentifierStart(l.query[l.pos:]):
+		for l.pos < len(l.query) && isIdentifierPart(l.query[l.pos:]) {
+			_, size := utf8.DecodeRuneInString(l.query[l.pos:])
+			l.pos += size
+		}
+		l.emit(sqlIdentifier, start, strings.ToLower(l.query[start:l.pos]))
+	case c == ':' && l.peek(1) == ':':
+		l.pos += 2
+		l.emit(sqlOperator, start, "")
+	case strings.IndexByte(sqlOperatorChars, c) >= 0:
+		l.pos++
+		for l.pos < len(l.query) && strings.IndexByte(sqlOperatorChars, l.query[l.pos]) >= 0 &&
+			!strings.HasPrefix(l.query[l.pos:], "--") && !strings.HasPrefix(l.query[l.pos:], "/*") {
+			l.pos++
+		}
+		l.emit(sqlOperator, start, "")
+	default:
+		_, size := utf8.DecodeRuneInString(l.query[l.pos:])
+		l.pos += size
+		l.emit(sqlOperator, start, "")
+	}
+}
+
+// blockComment skips a /* */ comment, which may be nested.
+func (l *sqlLexer) blockComment() {
+	depth := 0
+	for l.pos < len(l.query) {
+		switch {
+		case strings.HasPrefix(l.query[l.pos:], "/*"):
+			depth++
+			l.pos += 2
+		case strings.HasPrefix(l.query[l.pos:], "*/"):
+			depth--
+			l.pos += 2
+			if depth == 0 {
+				return
+			}
+		default:
+			l.pos++
+		}
+	}
+}
+
+// quoted reads a literal enclosed in quote, where a doubled quote stands
+// for itself. backslashEscapes enables the escapes of E'...' strings.
+func (l *sqlLexer) quoted(quote byte, backslashEscapes bool) string {
+	var value strings.Builder
+	l.pos++ // opening quote
+	for l.pos < len(l.query) {
+		c := l.query[l.pos]
+		switch {
+		case c == quote && l.peek(1) == quote:
+			value.WriteByte(quote)
+			l.pos += 2
+		case c == quote:
+			l.pos++
+			return value.String()
+		case c == '\\' && backslashEscapes && l.pos+1 < len(l.query):
+			value.WriteByte(l.query[l.pos+1])
+			l.pos += 2
+		default:
+			value.WriteByte(c)
+			l.pos++
+		}
+	}
+	return value.String()
+}
+
+// dollarQuoted reads a $tag$...$tag$ string, it returns false when the
+// query has no dollar quote at the current position.
+func (l *sqlLexer) dollarQuoted() (string, bool) {
+	end := strings.IndexByte(l.query[l.pos+1:], '$')
+	if end < 0 {
+		return "", false
+	}
+	tag := l.query[l.pos : l.pos+end+2]
+	if !isDollarQuoteTag(tag[1 : len(tag)-1]) {
+		return "", false
+	}
+
+	contentStart := l.pos + len(tag)
+	contentEnd := strings.Index(l.query[contentStart:], tag)
+	if contentEnd < 0 {
+		l.pos = len(l.query)
+		return l.query[contentStart:], true
+	}
+	l.pos = contentStart + contentEnd + len(tag)
+	return l.query[contentStart : contentStart+contentEnd], true
+}
+
+func (l *sqlLexer) number() {
+	for l.pos < len(l.query) && (isDigit(l.query[l.pos]) || l.query[l.pos] == '.' || l.query[l.pos] == '_') {
+		l.pos++
+	}
+	if c := l.peek(0); c == 'e' || c == 'E' {
+		offset := 1
+		if sign := l.peek(1); sign == '+' || sign == '-' {
+			offset++
+		}
+		if isDigit(l.peek(offset)) {
+			l.pos += offset
+			for l.pos < len(l.query) && isDigit(l.query[l.pos]) {
+				l.pos++
+			}
+		}
+	}
+}
+
+// afterName reports whether the previous token is a name, so a following
+// '.' qualifies it instead of starting a number.
+func (l *sqlLexer) afterName() bool {
+	if len(l.tokens) == 0 {
+		return false
+	}
+	last := l.tokens[len(l.tokens)-1]
+	return last.isName() && last.pos+len(last.text) == l.pos
+}
+
+// isDollarQuoteTag reports whether name may appear between the dollars of
+// a dollar quote, it may be empty.
+func isDollarQuoteTag(name string) bool {
+	if name == "" {
+		return true
+	}
+	if !isIdentifierStart(name) {
+		return false
+	}
+	for _, r := range name {
+		if !isIdentifierPart(string(r)) {
+			return false
+		}
+	}
+	return true
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentifierStart(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return r == '_' || unicode.IsLetter(r)
+}
+
+func isIdentifierPart(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return r == '_' || r == '$' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// significantTokens drops the comments.
+func significantTokens(tokens []sqlToken) []sqlToken {
+	significant := make([]sqlToken, 0, len(tokens))
+	for _, token := range tokens {
+		if token.kind != sqlComment {
+			significant = append(significant, token)
+		}
+	}
+	return significant
+}
+
+// statementText returns the query from its first significant token, without
+// the whitespace and comments before it.
+func statementText(query string) string {
+	for _, token := range tokenizeSQL(query) {
+		if token.kind != sqlComment {
+			return query[token.pos:]
+		}
+	}
+	return ""
+}
+
+// splitStatements splits a query at the semicolons outside string literals,
+// quoted identifiers and comments. Statements holding nothing but comments
+// are dropped, comments of the others are kept for the routing hints.
+func splitStatements(query string) []string {
+	var statements []string
+	start, significant := 0, false
+	for _, token := range tokenizeSQL(query) {
+		switch {
+		case token.isOperator(";"):
+			if significant {
+				statements = append(statements, strings.TrimSpace(query[start:token.pos]))
+			}
+			start, significant = token.pos+1, false
+		case token.kind != sqlComment:
+			significant = true
+		}
+	}
+	if significant {
+		statements = append(statements, strings.TrimSpace(query[start:]))
+	}
+	return statements
+}
+
+// stripLeadingComments returns the query starting at its first token that
+// is not a comment.
+func stripLeadingComments(query string) string {
+	for _, token := range tokenizeSQL(query) {
+		if token.kind != sqlComment {
+			return query[token.pos:]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,82 @@
+package pgvertica
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenizeSQL(t *testing.T) {
+	type token struct {
+		kind  sqlTokenKind
+		value string
+	}
+	testCases := []struct {
+		desc     string
+		input    string
+		expected []token
+	}{
+		{
+			desc:  "keywords and identifiers are folded",
+			input: `SELECT Id, "Name" FROM "My""Schema".t`,
+			expected: []token{
+				{sqlIdentifier, "select"}, {sqlIdentifier, "id"}, {sqlOperator, ""}, {sqlQuotedIdentifier, "Name"},
+				{sqlIdentifier, "from"}, {sqlQuotedIdentifier, `My"Schema`}, {sqlOperator, ""}, {sqlIdentifier, "t"},
+			},
+		},
+		{
+			desc:  "string literals",
+			input: `'it''s' E'a\'b' $$x'y$$ $tag$ $$ $tag$`,
+			expected: []token{
+				{sqlString, "it's"}, {sqlString, "a'b"}, {sqlString, "x'y"}, {sqlString, " $$ "},
+			},
+		},
+		{
+			desc:  "comments",
+			input: "SELECT 1 -- FROM x\n/* outer /* nested */ FROM y */ + 2.5e3",
+			expected: []token{
+				{sqlIdentifier, "select"}, {sqlNumber, ""}, {sqlComment, ""}, {sqlComment, ""}, {sqlOperator, ""}, {sqlNumber, ""},
+			},
+		},
+		{
+			desc:  "parameters and casts",
+			input: "$1::int <> .5",
+			expected: []token{
+				{sqlParameter, ""}, {sqlOperator, ""}, {sqlIdentifier, "int"}, {sqlOperator, ""}, {sqlNumber, ""},
+			},
+		},
+		{
+			desc:     "unterminated string",
+			input:    "'open",
+			expected: []token{{sqlString, "open"}},
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			var tokens []token
+			for _, tok := range tokenizeSQL(tC.input) {
+				tokens = append(tokens, token{tok.kind, tok.value})
+			}
+			assert.Equal(t, tC.expected, tokens)
+		})
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected []string
+	}{
+		{"SELECT 1", []string{"SELECT 1"}},
+		{"SET a = 'x;y'; SELECT \"a;b\" FROM t;", []string{"SET a = 'x;y'", `SELECT "a;b" FROM t`}},
+		{"SELECT $$;$$; -- ;\n", []string{"SELECT $$;$$"}},
+		{"/* pgvertica:route=vertica */ SELECT 1;; SELECT 2", []string{"/* pgvertica:route=vertica */ SELECT 1", "SELECT 2"}},
+		{" ; -- only a comment", nil},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.input, func(t *testing.T) {
+			assert.Equal(t, tC.expected, splitStatements(tC.input))
+		})
+	}
+}
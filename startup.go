@@ -3,11 +3,17 @@ package pgvertica
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 
 	"github.com/jackc/pgproto3/v2"
+	"github.com/lib/pq"
+	vertigo "github.com/vertica/vertica-sql-go"
 )
 
+// connectionFailureCode is sent when the proxy can't connect to a backend.
+const connectionFailureCode = "08006"
+
 func serveConnStartup(ctx context.Context, c *Conn, config *ServerConfig) (*Conn, error) {
 	msg, err := c.receiver.ReceiveStartupMessage()
 	if err != nil {
@@ -20,12 +26,21 @@ func serveConnStartup(ctx context.Context, c *Conn, config *ServerConfig) (*Conn
 			return nil, fmt.Errorf("startup message: %w", err)
 		}
 		return c, nil
+	case *pgproto3.CancelRequest:
+		Logger.Debug("received cancel request", "pid", msg.ProcessID)
+		return c, &cancelRequest{processID: msg.ProcessID, secretKey: msg.SecretKey}
 	case *pgproto3.SSLRequest:
 		conn, err := handleSSLRequestMessage(ctx, c, msg, config)
 		if err != nil {
 			return conn, fmt.Errorf("ssl request message: %w", err)
 		}
 		return conn, nil
+	case *pgproto3.GSSEncRequest:
+		conn, err := handleGSSEncRequestMessage(ctx, c, msg, config)
+		if err != nil {
+			return conn, fmt.Errorf("gssenc request message: %w", err)
+		}
+		return conn, nil
 	default:
 		return c, fmt.Errorf("unexpected startup message: %#v", msg)
 	}
@@ -34,34 +49,41 @@ func serveConnStartup(ctx context.Context, c *Conn, config *ServerConfig) (*Conn
 func handleStartupMessage(ctx context.Context, c *Conn, msg *pgproto3.StartupMessage, config *ServerConfig) error {
 	Logger.Debug("received startup message", "message", msg)
 
+	if negotiate := negotiateProtocolVersion(msg); negotiate != nil {
+		Logger.Info("negotiate protocol version", "requested", fmt.Sprintf("%d.%d", msg.ProtocolVersion>>16, msg.ProtocolVersion&0xffff), "unrecognized_options", negotiate.UnrecognizedOptions)
+		if err := writeMessages(c, negotiate); err != nil {
+			return err
+		}
+	}
+
 	vparams := make(map[string]string)
 
 	name := getParameter(msg.Parameters, "database")
 	if name == "" {
-		return writeMessages(c, &pgproto3.ErrorResponse{Message: "database required"})
+		return startupFailed(c, &pgproto3.ErrorResponse{Code: invalidAuthSpecCode, Message: "database required"})
 	}
 
 	for k, v := range msg.Parameters {
 		vparams[k] = v
 	}
+	user := vparams["user"]
 
-	if config.RequirePassword {
-		if err := writeMessages(c, &pgproto3.AuthenticationCleartextPassword{}); err != nil {
-			return err
-		}
+	settings, err := startupSessionSettings(msg.Parameters)
+	if err != nil {
+		return startupFailed(c, &pgproto3.ErrorResponse{Code: invalidParameterValueCode, Message: err.Error()})
+	}
 
-		pmsg, err := c.receiver.Receive()
-		if err != nil {
-			return err
-		}
+	method, err := checkAccessRules(c, name, vparams["user"], config)
+	if err != nil {
+		return authenticationFailed(c, err)
+	}
 
-		switch pmsg := pmsg.(type) {
-		case *pgproto3.PasswordMessage:
-			vparams["password"] = pmsg.Password
-		default:
-			return fmt.Errorf("unexpected message type: %#v", pmsg)
-		}
+	credentials, err := authenticateUser(c, vparams["user"], method, config)
+	if err != nil {
+		return authenticationFailed(c, err)
 	}
+	vparams["user"] = credentials.User
+	vparams["password"] = credentials.Password
 
 	pgdbName, err := getDBNameFromConnString(config.PostgresConnectionString)
 	if err != nil {
@@ -73,40 +95,133 @@ func handleStartupMessage(ctx context.Context, c *Conn, msg *pgproto3.StartupMes
 	}
 
 	if vparams["database"] != pgdbName {
-		return writeMessages(c, &pgproto3.ErrorResponse{
+		return startupFailed(c, &pgproto3.ErrorResponse{
 			Message: fmt.Sprintf("database %s does not exist", vparams["database"]),
 			Code:    "3D000",
 		})
 	}
 	vparams["database"] = vdbName
 
-	vdb, vErr := connectToDB(RealDBOpener{}, "vertica", config.VerticaConnectionString, vparams)
+	releaseSlot, err := c.limits.admit(user, name)
+	if err != nil {
+		Logger.Warn("connection rejected", "address", c.RemoteAddr(), "user", user, "database", name, "error", err)
+		return startupFailed(c, err.(*limitError).errorResponse("FATAL"))
+	}
+	defer func() {
+		if c.releaseSlot == nil {
+			releaseSlot()
+		}
+	}()
+
+	vdb, vErr := newVerticaCredentialVerifier(config, c.dbOpener(), c.vnodes).verify(vparams)
 	if vErr != nil {
+		if _, ok := vErr.(*AuthError); ok {
+			return authenticationFailed(c, vErr)
+		}
 		Logger.Error("Can't connect to Vertica")
-		return writeMessages(
-			c, &pgproto3.ErrorResponse{Message: vErr.Error()},
-		)
+		return startupFailed(c, &pgproto3.ErrorResponse{Code: connectionFailureCode, Message: vErr.Error()})
 	}
 	c.vdb = vdb
+	c.vlease = backendLease{setup: verticaSessionStatements(settings), reset: verticaSessionReset, limits: c.limits}
 	Logger.Info("established connection to Vertica")
 
-	pgdb, pgErr := connectToDB(RealDBOpener{}, "postgres", config.PostgresConnectionString, nil)
+	pgdb, pgErr := connectToDB(c.dbOpener(), "postgres", config.PostgresConnectionString, nil)
 	if pgErr != nil {
 		Logger.Error("Can't connect to Postgres")
-		return writeMessages(
-			c, &pgproto3.ErrorResponse{Message: pgErr.Error()},
-		)
+		return startupFailed(c, &pgproto3.ErrorResponse{Code: connectionFailureCode, Message: pgErr.Error()})
 	}
 	c.pgdb = pgdb
+	c.pglease = backendLease{setup: postgresSessionStatements(settings), reset: postgresSessionReset}
 	Logger.Info("established connection to Postgres")
 
-	return writeMessages(c,
-		&pgproto3.AuthenticationOk{},
-		&pgproto3.ParameterStatus{Name: "server_version", Value: ServerVersion},
-		&pgproto3.ParameterStatus{Name: "ApplicationName", Value: ApplicationName},
-		&pgproto3.ParameterStatus{Name: "client_encoding", Value: "UTF8"},
-		&pgproto3.ReadyForQuery{TxStatus: 'I'},
-	)
+	// lease a connection of each pool once, so invalid settings fail the login
+	timeZone := defaultTimeZone
+	vconn, err := c.vlease.acquire(ctx, vdb)
+	if err == nil {
+		timeZone = verticaTimeZone(ctx, vconn)
+		c.vlease.release()
+		_, err = c.pglease.acquire(ctx, pgdb)
+		c.pglease.release()
+	}
+	if err != nil {
+		Logger.Error("Can't apply session settings", "error", err)
+		return sessionSettingsFailed(c, err)
+	}
+	c.parameterStatus = startupParameterStatus(config, settings, user, timeZone)
+	c.user = user
+	c.settings = settings
+
+	messages := []pgproto3.Message{&pgproto3.AuthenticationOk{}}
+	messages = append(messages, parameterStatusMessages(c.parameterStatus)...)
+	messages = append(messages, &c.backendKey, &pgproto3.ReadyForQuery{TxStatus: 'I'})
+	if err := writeMessages(c, messages...); err != nil {
+		return err
+	}
+	c.releaseSlot = releaseSlot
+	return nil
+}
+
+// authenticateUser returns the Vertica credentials of the user, skipping the
+// password exchange when a client certificate already authenticated it.
+func authenticateUser(c *Conn, user string, method AuthMethod, config *ServerConfig) (*VerticaCredentials, error) {
+	authenticator := config.authenticator()
+
+	if config.ClientCertMode != ClientCertNone {
+		certAuthenticated, err := checkClientCertificate(c.verifiedClientCertificate(), user, config)
+		if err != nil {
+			return nil, err
+		}
+		if certAuthenticator, ok := authenticator.(CertificateAuthenticator); ok && certAuthenticated {
+			return certAuthenticator.AuthenticateCertificate(user)
+		}
+	}
+
+	password, err := authenticatePassword(c, user, method, config.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	return authenticator.Authenticate(user, password)
+}
+
+func authenticationFailed(c *Conn, err error) error {
+	if authErr, ok := err.(*AuthError); ok {
+		Logger.Warn("authentication failed", "address", c.RemoteAddr(), "error", authErr)
+		if werr := writeMessages(c, authErr.errorResponse()); werr != nil {
+			return werr
+		}
+	}
+	return fmt.Errorf("authentication: %w", err)
+}
+
+// startupFailed sends the FATAL error refusing a login and returns it, so
+// the connection is closed instead of entering the query loop.
+func startupFailed(c *Conn, response *pgproto3.ErrorResponse) error {
+	response.Severity = "FATAL"
+	if err := writeMessages(c, response); err != nil {
+		return err
+	}
+	return errors.New(response.Message)
+}
+
+// sessionSettingsFailed ends a login whose session settings could not be
+// applied, with the SQLSTATE of the backend error when there is one.
+func sessionSettingsFailed(c *Conn, err error) error {
+	response := &pgproto3.ErrorResponse{Severity: "FATAL", Code: invalidParameterValueCode, Message: err.Error()}
+	var lerr *limitError
+	var pqerr *pq.Error
+	var verr *vertigo.VError
+	switch {
+	case errors.As(err, &lerr):
+		response.Code = tooManyConnectionsCode
+	case errors.As(err, &pqerr):
+		response.Code = string(pqerr.Code)
+	case errors.As(err, &verr) && verr.SQLState != "":
+		response.Code = verr.SQLState
+	}
+	if werr := writeMessages(c, response); werr != nil {
+		return werr
+	}
+	return fmt.Errorf("session settings: %w", err)
 }
 
 func handleSSLRequestMessage(ctx context.Context, c *Conn, msg *pgproto3.SSLRequest, config *ServerConfig) (*Conn, error) {
@@ -118,6 +233,16 @@ func handleSSLRequestMessage(ctx context.Context, c *Conn, msg *pgproto3.SSLRequ
 	}
 }
 
+// handleGSSEncRequestMessage refuses GSSAPI encryption, clients then continue
+// with an SSLRequest or a plain StartupMessage.
+func handleGSSEncRequestMessage(ctx context.Context, c *Conn, msg *pgproto3.GSSEncRequest, config *ServerConfig) (*Conn, error) {
+	Logger.Debug("received gssenc request message", "message", msg)
+	if _, err := c.Write([]byte("N")); err != nil {
+		return c, err
+	}
+	return serveConnStartup(ctx, c, config)
+}
+
 func startWithoutSSL(ctx context.Context, c *Conn, config *ServerConfig) (*Conn, error) {
 	Logger.Info("SSL is not configured, use plain TCP")
 	if _, err := c.Write([]byte("N")); err != nil {
@@ -133,7 +258,9 @@ func startWithSSL(ctx context.Context, c *Conn, config *ServerConfig) (*Conn, er
 	}
 
 	tlsConn := tls.Server(c.Conn, config.TlsConfig)
+	backendKey, pools, limits, vnodes, routeCache := c.backendKey, c.pools, c.limits, c.vnodes, c.routeCache
 	c = newConn(tlsConn)
+	c.backendKey, c.pools, c.limits, c.vnodes, c.routeCache = backendKey, pools, limits, vnodes, routeCache
 	if err := tlsConn.Handshake(); err != nil {
 		return c, err
 	}
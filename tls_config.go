@@ -0,0 +1,325 @@
+package pgvertica
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ClientCertMode string
+
+const (
+	// ClientCertNone does not ask clients for a certificate.
+	ClientCertNone ClientCertMode = ""
+	// ClientCertOptional verifies a client certificate against the CA bundle
+	// when the client sends one, so machine and human clients can share a port.
+	ClientCertOptional ClientCertMode = "optional"
+	// ClientCertVerifyCA requires a client certificate signed by the CA bundle.
+	ClientCertVerifyCA ClientCertMode = "verify-ca"
+	// ClientCertVerifyFull additionally requires the certificate to identify
+	// the user named in the startup message.
+	ClientCertVerifyFull ClientCertMode = "verify-full"
+)
+
+func ParseClientCertMode(mode string) (ClientCertMode, error) {
+	switch ClientCertMode(mode) {
+	case ClientCertNone, ClientCertOptional, ClientCertVerifyCA, ClientCertVerifyFull:
+		return ClientCertMode(mode), nil
+	default:
+		return "", fmt.Errorf("unknown client cert mode: %s", mode)
+	}
+}
+
+// TLSOptions describes where the server certificate and the client CA bundle
+// are read from. KeyFile may be empty when CertFile holds both the
+// certificate and the private key.
+type TLSOptions struct {
+	CertFile       string
+	KeyFile        string
+	ClientCAFile   string
+	ClientCertMode ClientCertMode
+}
+
+func LoadTLSConfig(x509SSLCertPath string) (*tls.Config, error) {
+	return LoadTLSConfigWithOptions(TLSOptions{CertFile: x509SSLCertPath})
+}
+
+func LoadTLSConfigWithOptions(options TLSOptions) (*tls.Config, error) {
+	keyPair, err := loadKeyPair(options.CertFile, options.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{keyPair},
+		ClientAuth:   tls.NoClientCert,
+	}
+	if err := configureClientAuth(tlsConfig, options); err != nil {
+		return nil, err
+	}
+	return tlsConfig, nil
+}
+
+// LoadReloadableTLSConfig works like LoadTLSConfigWithOptions, but the server
+// certificate is served by the returned CertificateReloader, so rotated
+// cert/key files are picked up by new handshakes without a restart.
+func LoadReloadableTLSConfig(options TLSOptions) (*tls.Config, *CertificateReloader, error) {
+	reloader, err := NewCertificateReloader(options.CertFile, options.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig := &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		ClientAuth:     tls.NoClientCert,
+	}
+	if err := configureClientAuth(tlsConfig, options); err != nil {
+		return nil, nil, err
+	}
+	return tlsConfig, reloader, nil
+}
+
+func configureClientAuth(tlsConfig *tls.Config, options TLSOptions) error {
+	if options.ClientCertMode == ClientCertNone {
+		return nil
+	}
+	if options.ClientCAFile == "" {
+		return fmt.Errorf("client cert mode %s requires a client CA file", options.ClientCertMode)
+	}
+
+	Logger.Info("Load client CA bundle", "file", options.ClientCAFile)
+	caBytes, err := ioutil.ReadFile(options.ClientCAFile)
+	if err != nil {
+		return err
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caBytes) {
+		return fmt.Errorf("%s does not contain any PEM certificate", options.ClientCAFile)
+	}
+	tlsConfig.ClientCAs = clientCAs
+
+	if options.ClientCertMode == ClientCertOptional {
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	} else {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return nil
+}
+
+func loadKeyPair(certPath string, keyPath string) (tls.Certificate, error) {
+	if _, err := os.Stat(certPath); os.IsNotExist(err) {
+		return tls.Certificate{}, fmt.Errorf("%s file does not exist", certPath)
+	}
+	if keyPath == "" {
+		keyPath = certPath
+	}
+
+	Logger.Info("Create tls config from .pem files", "cert", certPath, "key", keyPath)
+	certBytes, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyBytes, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certBytes, keyBytes)
+}
+
+// CertificateReloader serves the server certificate through
+// tls.Config.GetCertificate and replaces it when Reload is called or, with
+// Watch, when the cert/key files change. Established TLS sessions are not
+// affected, only new handshakes get the new certificate.
+type CertificateReloader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.RWMutex
+	keyPair  *tls.Certificate
+	modTimes []time.Time
+}
+
+func NewCertificateReloader(certFile string, keyFile string) (*CertificateReloader, error) {
+	if keyFile == "" {
+		keyFile = certFile
+	}
+	r := &CertificateReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the cert/key files again. On error the previous certificate
+// stays in use.
+func (r *CertificateReloader) Reload() error {
+	modTimes := r.readModTimes()
+	keyPair, err := loadKeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keyPair = &keyPair
+	r.modTimes = modTimes
+	Logger.Info("TLS certificate loaded", "cert", r.certFile)
+	return nil
+}
+
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.keyPair, nil
+}
+
+// Watch checks the cert/key files every interval and reloads them when their
+// modification time changes, until ctx is done.
+func (r *CertificateReloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := r.reloadIfChanged(); err != nil {
+				Logger.Error("TLS certificate reload failed, keep the previous one", "error", err)
+			}
+		}
+	}
+}
+
+// reloadIfChanged reloads the cert/key files when their modification time
+// changed since the last reload and reports whether it did.
+func (r *CertificateReloader) reloadIfChanged() (bool, error) {
+	if !r.filesChanged() {
+		return false, nil
+	}
+	if err := r.Reload(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (r *CertificateReloader) filesChanged() bool {
+	modTimes := r.readModTimes()
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for i := range modTimes {
+		if !modTimes[i].Equal(r.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *CertificateReloader) readModTimes() []time.Time {
+	modTimes := make([]time.Time, 2)
+	for i, path := range []string{r.certFile, r.keyFile} {
+		if info, err := os.Stat(path); err == nil {
+			modTimes[i] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+// ClientCertMapping maps certificate identities (the subject CN or a DNS,
+// email or URI SAN) to the proxy users they may log in as.
+type ClientCertMapping map[string][]string
+
+// LoadClientCertMapping reads a ClientCertMapping from a file with one
+// "identity user" pair per line. Empty lines and '#' comments are skipped.
+func LoadClientCertMapping(path string) (ClientCertMapping, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	mapping := make(ClientCertMapping)
+	for i, line := range strings.Split(string(content), "\n") {
+		if j := strings.Index(line, "#"); j >= 0 {
+			line = line[:j]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected identity and user", path, i+1)
+		}
+		mapping[fields[0]] = append(mapping[fields[0]], fields[1])
+	}
+	return mapping, nil
+}
+
+func certificateIdentities(cert *x509.Certificate) []string {
+	identities := []string{}
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, cert.Subject.CommonName)
+	}
+	identities = append(identities, cert.DNSNames...)
+	identities = append(identities, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		identities = append(identities, uri.String())
+	}
+	return identities
+}
+
+// certificateMatchesUser reports whether one of the certificate identities is
+// the user itself or is mapped to it.
+func certificateMatchesUser(cert *x509.Certificate, user string, mapping ClientCertMapping) bool {
+	for _, identity := range certificateIdentities(cert) {
+		if identity == user || contains(mapping[identity], user) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifiedClientCertificate returns the client certificate verified during
+// the TLS handshake or nil when the client did not send one.
+func (c *Conn) verifiedClientCertificate() *x509.Certificate {
+	tlsConn, ok := c.Conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	return state.PeerCertificates[0]
+}
+
+// checkClientCertificate reports whether the user is authenticated by the
+// client certificate, so no password has to be requested. With verify-full
+// a certificate that does not identify the user is rejected.
+func checkClientCertificate(cert *x509.Certificate, user string, config *ServerConfig) (bool, error) {
+	if cert == nil {
+		if config.ClientCertMode == ClientCertVerifyCA || config.ClientCertMode == ClientCertVerifyFull {
+			return false, &AuthError{
+				Code:    invalidAuthSpecCode,
+				Message: "connection requires a valid client certificate",
+			}
+		}
+		return false, nil
+	}
+
+	if certificateMatchesUser(cert, user, config.ClientCertMapping) {
+		Logger.Info("User authenticated with client certificate", "user", user, "subject", cert.Subject.String())
+		return true, nil
+	}
+	if config.ClientCertMode == ClientCertVerifyFull {
+		return false, &AuthError{
+			Code:    invalidAuthSpecCode,
+			Message: fmt.Sprintf("certificate authentication failed for user \"%s\"", user),
+		}
+	}
+	return false, nil
+}
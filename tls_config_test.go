@@ -0,0 +1,251 @@
+package pgvertica
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCertificate struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newTestCertificate(t *testing.T, commonName string, dnsNames []string, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signerCert, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signerCert, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCert, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return &testCertificate{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (tc *testCertificate) tlsCertificate(t *testing.T) tls.Certificate {
+	keyPair, err := tls.X509KeyPair(tc.certPEM, tc.keyPEM)
+	require.NoError(t, err)
+	return keyPair
+}
+
+func TestLoadTLSConfig_CombinedFile(t *testing.T) {
+	server := newTestCertificate(t, "localhost", nil, nil)
+	path := writeTempFile(t, string(append(server.certPEM, server.keyPEM...)))
+
+	tlsConfig, err := LoadTLSConfig(path)
+	require.NoError(t, err)
+	assert.Len(t, tlsConfig.Certificates, 1)
+	assert.Equal(t, tls.NoClientCert, tlsConfig.ClientAuth)
+
+	_, err = LoadTLSConfig(path + ".missing")
+	assert.Error(t, err)
+}
+
+func TestLoadTLSConfigWithOptions(t *testing.T) {
+	ca := newTestCertificate(t, "test-ca", nil, nil)
+	server := newTestCertificate(t, "localhost", nil, ca)
+	options := TLSOptions{
+		CertFile:     writeTempFile(t, string(server.certPEM)),
+		KeyFile:      writeTempFile(t, string(server.keyPEM)),
+		ClientCAFile: writeTempFile(t, string(ca.certPEM)),
+	}
+
+	for mode, expected := range map[ClientCertMode]tls.ClientAuthType{
+		ClientCertNone:       tls.NoClientCert,
+		ClientCertOptional:   tls.VerifyClientCertIfGiven,
+		ClientCertVerifyCA:   tls.RequireAndVerifyClientCert,
+		ClientCertVerifyFull: tls.RequireAndVerifyClientCert,
+	} {
+		options.ClientCertMode = mode
+		tlsConfig, err := LoadTLSConfigWithOptions(options)
+		require.NoError(t, err, mode)
+		assert.Equal(t, expected, tlsConfig.ClientAuth, mode)
+	}
+
+	options.ClientCAFile = ""
+	options.ClientCertMode = ClientCertVerifyCA
+	_, err := LoadTLSConfigWithOptions(options)
+	assert.Error(t, err, "verify modes require a CA bundle")
+}
+
+func TestLoadClientCertMapping(t *testing.T) {
+	path := writeTempFile(t, "# identity  user\nsuperset-worker superset\nsuperset-worker superset_admin\n")
+
+	mapping, err := LoadClientCertMapping(path)
+	require.NoError(t, err)
+	assert.Equal(t, ClientCertMapping{"superset-worker": {"superset", "superset_admin"}}, mapping)
+}
+
+func TestCheckClientCertificate(t *testing.T) {
+	ca := newTestCertificate(t, "test-ca", nil, nil)
+	client := newTestCertificate(t, "superset-worker", []string{"worker.internal"}, ca)
+	mapping := ClientCertMapping{"worker.internal": {"superset"}}
+
+	testCases := []struct {
+		desc          string
+		cert          *x509.Certificate
+		user          string
+		mode          ClientCertMode
+		authenticated bool
+		fails         bool
+	}{
+		{desc: "mapped SAN", cert: client.cert, user: "superset", mode: ClientCertVerifyCA, authenticated: true},
+		{desc: "CN equal to user", cert: client.cert, user: "superset-worker", mode: ClientCertVerifyFull, authenticated: true},
+		{desc: "unmapped user falls back to password", cert: client.cert, user: "alice", mode: ClientCertVerifyCA},
+		{desc: "unmapped user with verify-full", cert: client.cert, user: "alice", mode: ClientCertVerifyFull, fails: true},
+		{desc: "missing cert with verify-ca", cert: nil, user: "alice", mode: ClientCertVerifyCA, fails: true},
+		{desc: "missing cert with optional", cert: nil, user: "alice", mode: ClientCertOptional},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			config := &ServerConfig{ClientCertMode: tC.mode, ClientCertMapping: mapping}
+			authenticated, err := checkClientCertificate(tC.cert, tC.user, config)
+			if tC.fails {
+				require.Error(t, err)
+				assert.Equal(t, invalidAuthSpecCode, err.(*AuthError).Code)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tC.authenticated, authenticated)
+		})
+	}
+}
+
+func TestAuthenticateUser_ClientCertificate(t *testing.T) {
+	ca := newTestCertificate(t, "test-ca", nil, nil)
+	server := newTestCertificate(t, "localhost", []string{"localhost"}, ca)
+	client := newTestCertificate(t, "superset-worker", nil, ca)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	serverSide, clientSide := net.Pipe()
+	tlsServer := tls.Server(serverSide, &tls.Config{
+		Certificates: []tls.Certificate{server.tlsCertificate(t)},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	defer tlsServer.Close()
+	defer clientSide.Close()
+
+	go func() {
+		tlsClient := tls.Client(clientSide, &tls.Config{
+			Certificates: []tls.Certificate{client.tlsCertificate(t)},
+			RootCAs:      clientCAs,
+			ServerName:   "localhost",
+		})
+		_ = tlsClient.Handshake()
+	}()
+	require.NoError(t, tlsServer.Handshake())
+
+	config := &ServerConfig{
+		ClientCertMode:    ClientCertVerifyCA,
+		ClientCertMapping: ClientCertMapping{"superset-worker": {"superset"}},
+		Authenticator: &ServiceAccountAuthenticator{
+			Users:    VerticaPassthroughAuthenticator{},
+			Accounts: map[string]VerticaCredentials{"superset": {User: "bi_reader", Password: "vertica-secret"}},
+		},
+	}
+	// the receiver is never used, as no password is requested
+	c := &Conn{Conn: tlsServer}
+
+	credentials, err := authenticateUser(c, "superset", AuthMethodScramSHA256, config)
+	require.NoError(t, err)
+	assert.Equal(t, &VerticaCredentials{User: "bi_reader", Password: "vertica-secret"}, credentials)
+}
+
+func TestCertificateReloader(t *testing.T) {
+	first := newTestCertificate(t, "first", nil, nil)
+	second := newTestCertificate(t, "second", nil, nil)
+	certFile := writeTempFile(t, string(first.certPEM))
+	keyFile := writeTempFile(t, string(first.keyPEM))
+
+	reloader, err := NewCertificateReloader(certFile, keyFile)
+	require.NoError(t, err)
+	served := func() string {
+		keyPair, err := reloader.GetCertificate(nil)
+		require.NoError(t, err)
+		cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+		require.NoError(t, err)
+		return cert.Subject.CommonName
+	}
+	assert.Equal(t, "first", served())
+
+	require.NoError(t, os.WriteFile(certFile, second.certPEM, 0600))
+	require.NoError(t, os.WriteFile(keyFile, second.keyPEM, 0600))
+	require.NoError(t, reloader.Reload())
+	assert.Equal(t, "second", served())
+
+	require.NoError(t, os.WriteFile(certFile, []byte("garbage"), 0600))
+	assert.Error(t, reloader.Reload())
+	assert.Equal(t, "second", served(), "a failed reload keeps the previous certificate")
+}
+
+func TestCertificateReloader_Watch(t *testing.T) {
+	first := newTestCertificate(t, "first", nil, nil)
+	second := newTestCertificate(t, "second", nil, nil)
+	path := writeTempFile(t, string(append(first.certPEM, first.keyPEM...)))
+
+	tlsConfig, reloader, err := LoadReloadableTLSConfig(TLSOptions{CertFile: path})
+	require.NoError(t, err)
+	assert.Empty(t, tlsConfig.Certificates)
+
+	reloaded, err := reloader.reloadIfChanged()
+	require.NoError(t, err)
+	assert.False(t, reloaded, "files not changed yet")
+
+	require.NoError(t, os.WriteFile(path, append(second.certPEM, second.keyPEM...), 0600))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+
+	reloaded, err = reloader.reloadIfChanged()
+	require.NoError(t, err)
+	assert.True(t, reloaded)
+	keyPair, err := tlsConfig.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, second.cert.Raw, keyPair.Certificate[0])
+
+	// Watch stops once its context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	reloader.Watch(ctx, time.Hour)
+}
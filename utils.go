@@ -2,11 +2,9 @@ package pgvertica
 
 import (
 	"bytes"
-	"crypto/tls"
 	"database/sql"
 	"encoding/binary"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"reflect"
 	"strconv"
@@ -50,8 +48,11 @@ func getTypeOID(databaseType string) uint32 {
 }
 
 func getCommandTag(query string) string {
-	query = strings.ToLower(strings.TrimSpace(query))
-	command := strings.Split(query, " ")[0]
+	query = strings.ToLower(strings.TrimSpace(stripLeadingComments(query)))
+	var command string
+	if fields := strings.Fields(query); len(fields) > 0 {
+		command = fields[0]
+	}
 
 	if command == "insert" {
 		return "INSERT 0 1"
@@ -200,25 +201,3 @@ func scanRowToBinary(rows *sql.Rows, cols []*sql.ColumnType) (*pgproto3.DataRow,
 	}
 	return &row, nil
 }
-
-func LoadTLSConfig(x509SSLCertPath string) (*tls.Config, error) {
-	if _, err := os.Stat(x509SSLCertPath); os.IsNotExist(err) {
-		return nil, fmt.Errorf("%s file does not exist", x509SSLCertPath)
-	}
-
-	Logger.Info("Create tls config from .pem file", "file", x509SSLCertPath)
-	pemBytes, err := ioutil.ReadFile(x509SSLCertPath)
-	if err != nil {
-		return nil, err
-	}
-
-	keyPair, err := tls.X509KeyPair(pemBytes, pemBytes)
-	if err != nil {
-		return nil, err
-	}
-	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{keyPair},
-		ClientAuth:   tls.NoClientCert,
-	}
-	return tlsConfig, nil
-}
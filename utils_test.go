@@ -40,6 +40,7 @@ func TestGetCommandTag(t *testing.T) {
 		{"UPDATE", "UPDATE table SET name = 'b' WHERE id = 1", "UPDATE 1"},
 		{"SELECT", "SELECT * FROM table", "SELECT 1"},
 		{"Invalid command", "INVALID COMMAND", "INVALID"},
+		{"Leading comment", "/* pgvertica:route=vertica */\nSELECT 1", "SELECT 1"},
 	}
 
 	for _, test := range tests {